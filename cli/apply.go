@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"bufio"
+	"cvmspot/service"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var applyYesFlag bool
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "执行一次调和，将资源维护到配置的期望状态",
+	Long:  `计算并列出每个实例管理器的变更（同 plan），确认后按依赖顺序（私有网络、子网、安全组 -> 实例 -> 弹性公网IP -> DNS记录 -> 标签）执行`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := *client.Cfg
+		cfg.SetConfig()
+
+		plans, err := service.BuildPlans(client, &cfg, false)
+		if err != nil {
+			fmt.Printf("计算变更失败: %v\n", err)
+			os.Exit(1)
+		}
+		if len(plans) == 0 {
+			fmt.Println("---没有开启自动维护的实例管理器---")
+			return
+		}
+		for _, plan := range plans {
+			plan.Print(os.Stdout)
+		}
+
+		if !applyYesFlag {
+			fmt.Print("是否执行以上变更？输入 yes 确认: ")
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if strings.TrimSpace(answer) != "yes" {
+				fmt.Println("---已取消---")
+				return
+			}
+		}
+
+		failed := 0
+		for _, plan := range plans {
+			if err := plan.Apply(); err != nil {
+				fmt.Printf("实例管理器 %s 执行变更失败: %v\n", plan.Manager, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("---变更执行完成---")
+	},
+}
+
+func init() {
+	applyCmd.Flags().BoolVarP(&applyYesFlag, "yes", "y", false, "跳过确认直接执行")
+}
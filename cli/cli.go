@@ -47,6 +47,9 @@ var cvmCmd = &cobra.Command{
 func Execute(c *tcloud.Client) {
 	client = c
 	rootCmd.AddCommand(cvmCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(planCmd)
+	rootCmd.AddCommand(applyCmd)
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
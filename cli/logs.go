@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"cvmspot/utils"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	followFlag bool
+	allFlag    bool
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <实例ID>",
+	Short: "查看实例初始化日志",
+	Long:  `查看实例初始化日志，默认显示最近一次初始化的日志`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir := client.Cfg.Provision.LogDir
+		files, err := utils.ProvisionLogFiles(dir, args[0])
+		if err != nil {
+			fmt.Printf("查询初始化日志失败: %v\n", err)
+			os.Exit(1)
+		}
+		if len(files) == 0 && !followFlag {
+			fmt.Printf("---未找到实例 %s 的初始化日志---\n", args[0])
+			return
+		}
+
+		if allFlag {
+			for _, file := range files[:max(len(files)-1, 0)] {
+				printLogFile(file)
+			}
+		}
+		if followFlag {
+			followLog(dir, args[0])
+			return
+		}
+		printLogFile(files[len(files)-1])
+	},
+}
+
+// printLogFile 打印日志文件内容
+func printLogFile(file string) {
+	fmt.Printf("==> %s <==\n", filepath.Base(file))
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Printf("打开日志文件失败: %v\n", err)
+		return
+	}
+	defer f.Close()
+	io.Copy(os.Stdout, f)
+}
+
+// followLog 持续输出最近一次初始化的日志，出现新的初始化日志时切换到新文件，Ctrl+C 退出
+func followLog(dir, instanceId string) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	var current *os.File
+	var currentName string
+	defer func() {
+		if current != nil {
+			current.Close()
+		}
+	}()
+
+	for {
+		files, err := utils.ProvisionLogFiles(dir, instanceId)
+		if err == nil && len(files) > 0 && files[len(files)-1] != currentName {
+			// 输出旧文件剩余内容后切换到新文件
+			if current != nil {
+				io.Copy(os.Stdout, current)
+				current.Close()
+			}
+			currentName = files[len(files)-1]
+			current, err = os.Open(currentName)
+			if err != nil {
+				fmt.Printf("打开日志文件失败: %v\n", err)
+				return
+			}
+			fmt.Printf("==> %s <==\n", filepath.Base(currentName))
+		}
+		if current != nil {
+			io.Copy(os.Stdout, current)
+		}
+
+		select {
+		case <-sigChan:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&followFlag, "follow", "f", false, "持续输出最近一次初始化的日志")
+	logsCmd.Flags().BoolVarP(&allFlag, "all", "a", false, "显示所有初始化日志")
+}
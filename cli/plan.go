@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"cvmspot/service"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var planDryRunFlag bool
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "查看实例管理器下一次检查将执行的变更",
+	Long:  `对比配置和腾讯云现有资源，以 diff 形式列出每个实例管理器的私有网络、子网、安全组、实例、弹性公网IP、DNS记录和标签变更，不修改任何资源`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := *client.Cfg
+		cfg.SetConfig()
+
+		plans, err := service.BuildPlans(client, &cfg, planDryRunFlag)
+		if err != nil {
+			fmt.Printf("计算变更失败: %v\n", err)
+			os.Exit(1)
+		}
+		if len(plans) == 0 {
+			fmt.Println("---没有开启自动维护的实例管理器---")
+			return
+		}
+
+		var create, update, remove int
+		for _, plan := range plans {
+			plan.Print(os.Stdout)
+			c, u, r := plan.Count()
+			create, update, remove = create+c, update+u, remove+r
+		}
+		fmt.Printf("合计: 创建 %d，更新 %d，删除 %d\n", create, update, remove)
+	},
+}
+
+func init() {
+	planCmd.Flags().BoolVar(&planDryRunFlag, "dry-run", false, "调用 RunInstances 预检创建实例的参数和库存（不会创建实例）")
+}
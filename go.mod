@@ -3,14 +3,18 @@ module cvmspot
 go 1.24.5
 
 require (
+	github.com/olekukonko/tablewriter v1.0.7
+	github.com/pkg/sftp v1.13.9
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/cobra v1.9.1
 	github.com/spf13/viper v1.20.1
+	github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cam v1.0.1200
 	github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common v1.0.1205
 	github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm v1.0.1204
 	github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/dnspod v1.0.1200
 	github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/tag v1.0.1200
 	github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vpc v1.0.1203
+	golang.org/x/crypto v0.40.0
 )
 
 require (
@@ -24,9 +28,7 @@ require (
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/olekukonko/errors v0.0.0-20250405072817-4e6d85265da6 // indirect
 	github.com/olekukonko/ll v0.0.8 // indirect
-	github.com/olekukonko/tablewriter v1.0.7 // indirect
 	github.com/pelletier/go-toml/v2 v2.2.3 // indirect
-	github.com/pkg/sftp v1.13.9 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/sagikazarmark/locafero v0.7.0 // indirect
 	github.com/sourcegraph/conc v0.3.0 // indirect
@@ -34,10 +36,8 @@ require (
 	github.com/spf13/cast v1.7.1 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
 	github.com/subosito/gotenv v1.6.0 // indirect
-	github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cam v1.0.1200 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
-	golang.org/x/crypto v0.40.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -40,6 +40,14 @@ func initConfig(cfg *utils.Config) error {
 		return fmt.Errorf("不能初始化配置-腾讯云管理器: %v", err)
 	}
 
+	if err := viper.UnmarshalKey("ssh", &cfg.SshConfig); err != nil {
+		return fmt.Errorf("不能初始化配置-SSH: %v", err)
+	}
+
+	if err := viper.UnmarshalKey("provision", &cfg.Provision); err != nil {
+		return fmt.Errorf("不能初始化配置-实例初始化: %v", err)
+	}
+
 	secretId := strings.TrimSpace(os.Getenv("TENCENTCLOUD_SECRET_ID"))
 	secretKey := strings.TrimSpace(os.Getenv("TENCENTCLOUD_SECRET_KEY"))
 
@@ -0,0 +1,370 @@
+package service
+
+import (
+	"cmp"
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	cvm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm/v20170312"
+)
+
+// dnsOwnerPrefix 默认所有者标记前缀，写入记录备注
+const dnsOwnerPrefix = "cvmspot:"
+
+// 默认解析线路，以及按健康状态设置权重时的默认权重
+const (
+	defaultRecordLine      = "默认"
+	defaultHealthyWeight   = 10
+	defaultUnhealthyWeight = 1
+	maxRecordWeight        = 100
+)
+
+// dnsLineAliases 线路英文别名
+var dnsLineAliases = map[string]string{
+	"default":  "默认",
+	"telecom":  "电信",
+	"unicom":   "联通",
+	"mobile":   "移动",
+	"overseas": "境外",
+}
+
+// dnsTarget 实例IP期望的记录线路和权重
+type dnsTarget struct {
+	instanceId string
+	line       string
+	weight     *uint64 // 为空时不设置权重
+}
+
+// describe 返回记录属性的可读描述
+func (t dnsTarget) describe() string {
+	if t.weight == nil {
+		return "线路 " + t.line
+	}
+	return fmt.Sprintf("线路 %s，权重 %d", t.line, *t.weight)
+}
+
+// dnsLineName 将线路别名转换为 DNSPod 线路名称，为空时为默认线路
+func dnsLineName(line string) string {
+	if name, ok := dnsLineAliases[line]; ok {
+		return name
+	}
+	if line == "" {
+		return defaultRecordLine
+	}
+	return line
+}
+
+// instanceLine 返回实例所在可用区或地域匹配的第一条线路，未匹配时使用 record_line
+func instanceLine(db *utils.DomainBindingConfig, instance *cvm.Instance) string {
+	zone := ""
+	if instance.Placement != nil {
+		zone = utils.StringValue(instance.Placement.Zone)
+	}
+	region := zone
+	if len(zone) > 2 {
+		region = zone[:len(zone)-2]
+	}
+	for _, line := range db.Lines {
+		if slices.Contains(line.Zones, zone) || slices.Contains(line.Regions, region) {
+			return dnsLineName(line.Line)
+		}
+	}
+	return dnsLineName(db.RecordLine)
+}
+
+// bindings 返回开启的域名绑定，补全默认所有者标记并检查配置
+// domain_binding 的默认所有者标记为 cvmspot:<实例管理器名称>（兼容旧版本创建的记录），
+// domain_bindings 中的为 cvmspot:<实例管理器名称>:<完整域名>，与配置顺序无关，避免同一主域名下的实例主机记录互相覆盖
+func (m *InstanceManager) bindings() ([]*utils.DomainBindingConfig, error) {
+	configs := m.Ibm.Bindings()
+	bindings := make([]*utils.DomainBindingConfig, 0, len(configs))
+	seen := make(map[string]bool, len(configs))
+	for i := range configs {
+		db := &configs[i]
+		name := db.FQDN()
+		if seen[name] {
+			return nil, fmt.Errorf("域名绑定 %s 重复", name)
+		}
+		seen[name] = true
+		if db.RecordType != "" && db.RecordType != tcloud.RecordA && db.RecordType != tcloud.RecordAAAA {
+			return nil, fmt.Errorf("域名绑定 %s 的记录类型 %s 不支持，只支持 A 或 AAAA", name, db.RecordType)
+		}
+		if db.Owner == "" {
+			// Bindings 总是先返回开启的 domain_binding
+			legacy := i == 0 && m.Ibm.DomainBinding.Enabled
+			db.Owner = dnsOwnerPrefix + m.Ibm.Name
+			if !legacy {
+				db.Owner += ":" + name
+			}
+		}
+		for _, other := range bindings {
+			if other.Domain == db.Domain && other.Owner == db.Owner && (other.HostnameTemplate != "" || db.HostnameTemplate != "") {
+				return nil, fmt.Errorf("域名绑定 %s 与 %s 使用相同的所有者标记 %s，无法区分实例主机记录", name, other.FQDN(), db.Owner)
+			}
+		}
+		bindings = append(bindings, db)
+	}
+	return bindings, nil
+}
+
+// recordTypeEnabled 返回域名绑定是否维护指定类型的记录：record_type 为 AAAA 时只维护 AAAA 记录，否则维护 A 记录，开启 ipv6 时同时维护 AAAA 记录
+func recordTypeEnabled(db *utils.DomainBindingConfig, recordType string) bool {
+	if db.RecordType == tcloud.RecordAAAA {
+		return recordType == tcloud.RecordAAAA
+	}
+	return recordType == tcloud.RecordA || db.IPv6
+}
+
+// instanceWeight 按配置计算实例记录的权重（1-100），未配置权重时返回空
+func instanceWeight(p *Plan, db *utils.DomainBindingConfig, instance *cvm.Instance) *uint64 {
+	d, a := p.desire, p.actual
+	cfg := db.Weight
+	var weight uint64
+	switch cfg.By {
+	case utils.WeightByCPU:
+		weight = uint64(max(utils.Int64Value(instance.CPU), 0))
+	case utils.WeightByMemory:
+		weight = uint64(max(utils.Int64Value(instance.Memory), 0))
+	case utils.WeightByHealth:
+		// 运行中且已应用当前初始化配置（或由旧版本初始化）的实例为健康实例
+		applied := a.applied[utils.StringValue(instance.InstanceId)]
+		healthy := utils.StringValue(instance.InstanceState) == "RUNNING" &&
+			(d.hashes == nil || applied == d.hashes.Pipeline || applied == legacyExecTagValue)
+		weight = cmp.Or(cfg.Unhealthy, defaultUnhealthyWeight)
+		if healthy {
+			weight = cmp.Or(cfg.Healthy, defaultHealthyWeight)
+		}
+	default:
+		return nil
+	}
+	return common.Uint64Ptr(min(max(weight, 1), maxRecordWeight))
+}
+
+// dnsTargets 返回指定记录类型下每个实例IP期望的线路和权重，域名绑定不维护该类型记录时为空
+func dnsTargets(p *Plan, db *utils.DomainBindingConfig, recordType string) map[string]dnsTarget {
+	a := p.actual
+	targets := make(map[string]dnsTarget)
+	if !recordTypeEnabled(db, recordType) {
+		return targets
+	}
+	instances := make(map[string]*cvm.Instance, len(a.instances))
+	for _, ins := range a.instances {
+		instances[utils.StringValue(ins.InstanceId)] = ins
+	}
+	for ip, id := range instanceIPs(a.instances, recordType) {
+		targets[ip] = dnsTarget{instanceId: id, line: instanceLine(db, instances[id]), weight: instanceWeight(p, db, instances[id])}
+	}
+	return targets
+}
+
+// dnsRecordChange 单条DNS记录的修改，保留记录ID
+type dnsRecordChange struct {
+	record *tcloud.DnsRcordR
+	value  string // 修改后的记录值
+	reason string
+}
+
+// dnsDiff 单个记录类型的DNS记录变更
+type dnsDiff struct {
+	remove  []*tcloud.DnsRcordR
+	modify  []dnsRecordChange
+	add     []string
+	foreign []string // 已有没有所有者标记的记录、且未接管的实例IP
+}
+
+// diffDNSRecords 对比单个记录类型的现有记录和实例IP，只修改和删除带所有者标记的记录
+// IP不属于当前实例的记录优先修改为缺少记录的实例IP以复用记录ID，每条线路的有效记录数不超过 prase_num
+func diffDNSRecords(records []*tcloud.DnsRcordR, targets map[string]dnsTarget, db *utils.DomainBindingConfig) dnsDiff {
+	var diff dnsDiff
+	covered := make(map[string]bool, len(records))
+	stale := make([]*tcloud.DnsRcordR, 0)
+	valid := make(map[string]int) // 线路 -> 有效记录数
+	for _, record := range records {
+		if utils.StringValue(record.Remark) != db.Owner {
+			continue
+		}
+		value := utils.StringValue(record.Value)
+		target, ok := targets[value]
+		if !ok || covered[value] {
+			stale = append(stale, record)
+			continue
+		}
+		covered[value] = true
+		valid[target.line]++
+		if reason := recordDrift(record, target, db); reason != "" {
+			diff.modify = append(diff.modify, dnsRecordChange{record: record, value: value, reason: reason})
+		}
+	}
+	for _, record := range records {
+		value := utils.StringValue(record.Value)
+		target, ok := targets[value]
+		if utils.StringValue(record.Remark) == db.Owner || !ok || covered[value] {
+			continue
+		}
+		covered[value] = true
+		if !db.Adopt {
+			diff.foreign = append(diff.foreign, value)
+			continue
+		}
+		valid[target.line]++
+		diff.modify = append(diff.modify, dnsRecordChange{record: record, value: value, reason: "接管记录，备注 " + db.Owner})
+	}
+
+	ips := make([]string, 0, len(targets))
+	for ip := range targets {
+		if !covered[ip] {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	missing := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		line := targets[ip].line
+		if valid[line] < db.PraseNum {
+			valid[line]++
+			missing = append(missing, ip)
+		}
+	}
+
+	for len(stale) > 0 && len(missing) > 0 {
+		diff.modify = append(diff.modify, dnsRecordChange{record: stale[0], value: missing[0],
+			reason: fmt.Sprintf("%s -> %s", utils.StringValue(stale[0].Value), missing[0])})
+		stale, missing = stale[1:], missing[1:]
+	}
+	diff.remove = stale
+	diff.add = missing
+	return diff
+}
+
+// recordDrift 返回带所有者标记的记录与期望的线路、权重或TTL差异，一致时返回空字符串
+func recordDrift(record *tcloud.DnsRcordR, target dnsTarget, db *utils.DomainBindingConfig) string {
+	if line := utils.StringValue(record.RecordLine); line != target.line {
+		return fmt.Sprintf("线路 %s -> %s", line, target.line)
+	}
+	if target.weight != nil && utils.Uint64Value(record.Weight) != *target.weight {
+		return fmt.Sprintf("权重 %d -> %d", utils.Uint64Value(record.Weight), *target.weight)
+	}
+	if db.TTL != 0 && record.TTL != nil && *record.TTL != db.TTL {
+		return fmt.Sprintf("TTL %d -> %d", *record.TTL, db.TTL)
+	}
+	return ""
+}
+
+// diffDNS 计算单个域名绑定的DNS记录变更，A 和 AAAA 记录分别对比
+// 子域名下的 CNAME 和 URL 转发记录与 A/AAAA 记录不能共存，按 on_conflict 跳过或删除；TXT 等其他类型记录不做处理
+func (m *InstanceManager) diffDNS(p *Plan, db *utils.DomainBindingConfig, state *dnsState) {
+	if !state.recordsObserved {
+		return
+	}
+	name := db.FQDN()
+
+	conflicts := make([]*tcloud.DnsRcordR, 0)
+	for _, record := range state.records {
+		if tcloud.ConflictsWithAddress(utils.StringValue(record.RecordType)) {
+			conflicts = append(conflicts, record)
+		}
+	}
+	if len(conflicts) > 0 && db.OnConflict != utils.ConflictReplace {
+		for _, record := range conflicts {
+			p.warn("%s 已存在 %s 记录 %s，与 A/AAAA 记录冲突，不维护DNS记录（on_conflict: replace 删除冲突记录）",
+				name, utils.StringValue(record.RecordType), utils.StringValue(record.Value))
+		}
+		return
+	}
+	for _, record := range conflicts {
+		p.add(Action{Type: ActionDelete, Resource: ResourceDNSRecord, ID: strconv.FormatUint(*record.RecordId, 10), Name: name, Value: utils.StringValue(record.Value),
+			Detail: fmt.Sprintf("%s %s（与 A/AAAA 记录冲突）", utils.StringValue(record.RecordType), utils.StringValue(record.Value))})
+	}
+
+	// 不维护的记录类型没有期望的记录，带所有者标记的该类型记录会被删除
+	for _, recordType := range []string{tcloud.RecordA, tcloud.RecordAAAA} {
+		targets := dnsTargets(p, db, recordType)
+		records := make([]*tcloud.DnsRcordR, 0, len(state.records))
+		for _, record := range state.records {
+			if utils.StringValue(record.RecordType) == recordType {
+				records = append(records, record)
+			}
+		}
+
+		diff := diffDNSRecords(records, targets, db)
+		for _, record := range diff.remove {
+			p.add(Action{Type: ActionDelete, Resource: ResourceDNSRecord, ID: strconv.FormatUint(*record.RecordId, 10), Name: name, Value: utils.StringValue(record.Value),
+				Detail: recordType + " " + utils.StringValue(record.Value)})
+		}
+		for _, change := range diff.modify {
+			p.add(Action{Type: ActionUpdate, Resource: ResourceDNSRecord, ID: strconv.FormatUint(*change.record.RecordId, 10), Name: name, Value: change.value,
+				Detail: fmt.Sprintf("%s %s（%s）", recordType, change.value, change.reason)})
+		}
+		for _, ip := range diff.add {
+			target := targets[ip]
+			p.add(Action{Type: ActionCreate, Resource: ResourceDNSRecord, Name: name, Value: ip,
+				Detail: fmt.Sprintf("%s %s（%s，%s，TTL %d）", recordType, ip, target.instanceId, target.describe(), db.TTL)})
+		}
+		for _, ip := range diff.foreign {
+			p.warn("%s 已存在没有所有者标记的 %s 记录 %s，不会修改（adopt: true 接管）", name, recordType, ip)
+		}
+	}
+}
+
+// applyDNS 删除、修改和添加单个域名绑定的DNS记录，修改和添加的记录写入所有者标记、实例对应的线路和权重，单条记录失败不影响其他记录
+func (m *InstanceManager) applyDNS(p *Plan, db *utils.DomainBindingConfig) {
+	actions := make([]Action, 0)
+	for _, act := range p.filter(ResourceDNSRecord) {
+		if act.Name == db.FQDN() {
+			actions = append(actions, act)
+		}
+	}
+	if len(actions) == 0 {
+		return
+	}
+	targets := dnsTargets(p, db, tcloud.RecordA)
+	for ip, target := range dnsTargets(p, db, tcloud.RecordAAAA) {
+		targets[ip] = target
+	}
+	for _, act := range actions {
+		value := act.Value
+		recordType := tcloud.DNSRecordType(value)
+		target := targets[value]
+		record := &tcloud.DnsRecordP{
+			Domain:     &db.Domain,
+			SubDomain:  &db.SubDomain,
+			RecordType: &recordType,
+			RecordLine: &target.line,
+			Value:      &value,
+			TTL:        &db.TTL,
+			Remark:     &db.Owner,
+			Weight:     target.weight,
+		}
+		switch act.Type {
+		case ActionDelete:
+			recordId, err := strconv.ParseUint(act.ID, 10, 64)
+			if err != nil {
+				continue
+			}
+			m.Log.Infof("删除DNS记录: %s", act.Detail)
+			if err := m.Client.RemoveDNSRecord(&db.Domain, &recordId); err != nil {
+				m.Log.Errorf("删除DNS记录失败: %v", err)
+			}
+		case ActionUpdate:
+			recordId, err := strconv.ParseUint(act.ID, 10, 64)
+			if err != nil {
+				continue
+			}
+			record.RecordId = &recordId
+			m.Log.Infof("修改DNS记录 %d: %s", recordId, act.Detail)
+			if err := m.Client.ModifyDNSRecord(record); err != nil {
+				m.Log.Errorf("修改DNS记录失败: %v", err)
+			}
+		case ActionCreate:
+			m.Log.Infof("添加DNS记录: %s %s", recordType, value)
+			if err := m.Client.AddDNSRecord(record); err != nil {
+				m.Log.Errorf("添加DNS记录失败: %v", err)
+			}
+		}
+	}
+}
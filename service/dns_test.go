@@ -0,0 +1,284 @@
+package service
+
+import (
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	cvm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm/v20170312"
+)
+
+const testOwner = "cvmspot:web"
+
+// testRecord 生成线路为默认、TTL 600 的A记录
+func testRecord(id uint64, value, remark string) *tcloud.DnsRcordR {
+	return &tcloud.DnsRcordR{
+		RecordId:   common.Uint64Ptr(id),
+		Value:      common.StringPtr(value),
+		RecordType: common.StringPtr(tcloud.RecordA),
+		RecordLine: common.StringPtr(defaultRecordLine),
+		TTL:        common.Uint64Ptr(600),
+		Remark:     common.StringPtr(remark),
+	}
+}
+
+func testTargets(ips ...string) map[string]dnsTarget {
+	targets := make(map[string]dnsTarget, len(ips))
+	for i, ip := range ips {
+		targets[ip] = dnsTarget{instanceId: fmt.Sprintf("ins-%d", i+1), line: defaultRecordLine}
+	}
+	return targets
+}
+
+func TestDiffDNSRecords(t *testing.T) {
+	ttlRecord := testRecord(1, "1.1.1.1", testOwner)
+	ttlRecord.TTL = common.Uint64Ptr(60)
+
+	tests := []struct {
+		name    string
+		records []*tcloud.DnsRcordR
+		targets map[string]dnsTarget
+		adopt   bool
+		remove  []uint64
+		modify  []string // 记录ID:修改后的值
+		add     []string
+		foreign []string
+	}{
+		{
+			name:    "记录与实例一致",
+			records: []*tcloud.DnsRcordR{testRecord(1, "1.1.1.1", testOwner), testRecord(2, "2.2.2.2", testOwner)},
+			targets: testTargets("1.1.1.1", "2.2.2.2"),
+		},
+		{
+			name:    "添加缺少的记录",
+			targets: testTargets("1.1.1.1", "2.2.2.2"),
+			add:     []string{"1.1.1.1", "2.2.2.2"},
+		},
+		{
+			name:    "添加的记录数不超过 prase_num",
+			records: []*tcloud.DnsRcordR{testRecord(1, "1.1.1.1", testOwner)},
+			targets: testTargets("1.1.1.1", "3.3.3.3", "2.2.2.2"),
+			add:     []string{"2.2.2.2"},
+		},
+		{
+			name:    "失效记录修改为新实例IP",
+			records: []*tcloud.DnsRcordR{testRecord(1, "1.1.1.1", testOwner), testRecord(2, "9.9.9.9", testOwner)},
+			targets: testTargets("1.1.1.1", "2.2.2.2"),
+			modify:  []string{"2:2.2.2.2"},
+		},
+		{
+			name:    "没有新实例时删除失效记录",
+			records: []*tcloud.DnsRcordR{testRecord(1, "1.1.1.1", testOwner), testRecord(2, "9.9.9.9", testOwner)},
+			targets: testTargets("1.1.1.1"),
+			remove:  []uint64{2},
+		},
+		{
+			name:    "重复记录",
+			records: []*tcloud.DnsRcordR{testRecord(1, "1.1.1.1", testOwner), testRecord(2, "1.1.1.1", testOwner)},
+			targets: testTargets("1.1.1.1"),
+			remove:  []uint64{2},
+		},
+		{
+			name:    "TTL不一致",
+			records: []*tcloud.DnsRcordR{ttlRecord},
+			targets: testTargets("1.1.1.1"),
+			modify:  []string{"1:1.1.1.1"},
+		},
+		{
+			name:    "不修改其他所有者的记录",
+			records: []*tcloud.DnsRcordR{testRecord(1, "9.9.9.9", ""), testRecord(2, "8.8.8.8", "cvmspot:db")},
+			targets: testTargets("1.1.1.1"),
+			add:     []string{"1.1.1.1"},
+		},
+		{
+			name:    "未接管的实例IP记录",
+			records: []*tcloud.DnsRcordR{testRecord(1, "1.1.1.1", "")},
+			targets: testTargets("1.1.1.1"),
+			foreign: []string{"1.1.1.1"},
+		},
+		{
+			name:    "接管实例IP记录",
+			records: []*tcloud.DnsRcordR{testRecord(1, "1.1.1.1", "")},
+			targets: testTargets("1.1.1.1"),
+			adopt:   true,
+			modify:  []string{"1:1.1.1.1"},
+		},
+		{
+			name:    "实例全部删除",
+			records: []*tcloud.DnsRcordR{testRecord(1, "1.1.1.1", testOwner), testRecord(2, "9.9.9.9", "")},
+			targets: testTargets(),
+			remove:  []uint64{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &utils.DomainBindingConfig{Owner: testOwner, PraseNum: 2, TTL: 600, Adopt: tt.adopt}
+			diff := diffDNSRecords(tt.records, tt.targets, db)
+
+			remove := make([]uint64, 0)
+			for _, record := range diff.remove {
+				remove = append(remove, *record.RecordId)
+			}
+			modify := make([]string, 0)
+			for _, change := range diff.modify {
+				modify = append(modify, fmt.Sprintf("%d:%s", *change.record.RecordId, change.value))
+			}
+			check := func(field string, got, want interface{}) {
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %v, want %v", field, got, want)
+				}
+			}
+			check("remove", remove, orEmpty(tt.remove))
+			check("modify", modify, orEmpty(tt.modify))
+			check("add", orEmpty(diff.add), orEmpty(tt.add))
+			check("foreign", orEmpty(diff.foreign), orEmpty(tt.foreign))
+		})
+	}
+}
+
+func TestInstanceLine(t *testing.T) {
+	db := &utils.DomainBindingConfig{
+		RecordLine: "overseas",
+		Lines: []utils.DNSLineConfig{
+			{Line: "telecom", Zones: []string{"ap-guangzhou-3"}},
+			{Line: "联通", Regions: []string{"ap-guangzhou", "ap-shanghai"}},
+		},
+	}
+	tests := []struct {
+		name string
+		db   *utils.DomainBindingConfig
+		zone string
+		want string
+	}{
+		{name: "按可用区匹配并转换别名", db: db, zone: "ap-guangzhou-3", want: "电信"},
+		{name: "按地域匹配", db: db, zone: "ap-guangzhou-6", want: "联通"},
+		{name: "未匹配时使用 record_line", db: db, zone: "ap-hongkong-2", want: "境外"},
+		{name: "未配置线路", db: &utils.DomainBindingConfig{}, zone: "ap-guangzhou-3", want: defaultRecordLine},
+		{name: "实例没有可用区", db: db, want: "境外"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &cvm.Instance{}
+			if tt.zone != "" {
+				instance.Placement = &cvm.Placement{Zone: common.StringPtr(tt.zone)}
+			}
+			if got := instanceLine(tt.db, instance); got != tt.want {
+				t.Errorf("instanceLine() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstanceWeight(t *testing.T) {
+	tests := []struct {
+		name    string
+		weight  utils.DNSWeightConfig
+		cpu     int64
+		memory  int64
+		state   string
+		applied string
+		hashes  bool
+		want    uint64 // 0 表示不设置权重
+	}{
+		{name: "未配置权重"},
+		{name: "按CPU", weight: utils.DNSWeightConfig{By: utils.WeightByCPU}, cpu: 4, want: 4},
+		{name: "按内存", weight: utils.DNSWeightConfig{By: utils.WeightByMemory}, memory: 16, want: 16},
+		{name: "权重不小于1", weight: utils.DNSWeightConfig{By: utils.WeightByCPU}, want: 1},
+		{name: "权重不大于100", weight: utils.DNSWeightConfig{By: utils.WeightByMemory}, memory: 512, want: 100},
+		{name: "健康实例默认权重", weight: utils.DNSWeightConfig{By: utils.WeightByHealth}, state: "RUNNING", want: defaultHealthyWeight},
+		{name: "未运行实例", weight: utils.DNSWeightConfig{By: utils.WeightByHealth}, state: "PENDING", want: defaultUnhealthyWeight},
+		{name: "配置的健康权重", weight: utils.DNSWeightConfig{By: utils.WeightByHealth, Healthy: 50, Unhealthy: 5}, state: "RUNNING", hashes: true, applied: "h1", want: 50},
+		{name: "初始化配置未应用", weight: utils.DNSWeightConfig{By: utils.WeightByHealth, Healthy: 50, Unhealthy: 5}, state: "RUNNING", hashes: true, applied: "h0", want: 5},
+		{name: "旧版本初始化的实例", weight: utils.DNSWeightConfig{By: utils.WeightByHealth}, state: "RUNNING", hashes: true, applied: legacyExecTagValue, want: defaultHealthyWeight},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plan{desire: &desiredState{}, actual: &actualState{applied: map[string]string{"ins-1": tt.applied}}}
+			if tt.hashes {
+				p.desire.hashes = &PipelineHashes{Pipeline: "h1"}
+			}
+			instance := &cvm.Instance{
+				InstanceId:    common.StringPtr("ins-1"),
+				CPU:           common.Int64Ptr(tt.cpu),
+				Memory:        common.Int64Ptr(tt.memory),
+				InstanceState: common.StringPtr(tt.state),
+			}
+			got := instanceWeight(p, &utils.DomainBindingConfig{Weight: tt.weight}, instance)
+			if got == nil {
+				if tt.want != 0 {
+					t.Errorf("instanceWeight() = nil, want %d", tt.want)
+				}
+				return
+			}
+			if *got != tt.want {
+				t.Errorf("instanceWeight() = %d, want %d", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffDNSRecordsLines(t *testing.T) {
+	weighted := func(record *tcloud.DnsRcordR, line string, weight uint64) *tcloud.DnsRcordR {
+		record.RecordLine = common.StringPtr(line)
+		record.Weight = common.Uint64Ptr(weight)
+		return record
+	}
+	targets := map[string]dnsTarget{
+		"1.1.1.1": {instanceId: "ins-1", line: "电信", weight: common.Uint64Ptr(10)},
+		"2.2.2.2": {instanceId: "ins-2", line: "电信", weight: common.Uint64Ptr(10)},
+		"3.3.3.3": {instanceId: "ins-3", line: "联通", weight: common.Uint64Ptr(10)},
+	}
+	tests := []struct {
+		name    string
+		records []*tcloud.DnsRcordR
+		modify  []string
+		add     []string
+	}{
+		{
+			name:    "每条线路分别计算 prase_num",
+			records: []*tcloud.DnsRcordR{weighted(testRecord(1, "1.1.1.1", testOwner), "电信", 10)},
+			add:     []string{"3.3.3.3"},
+		},
+		{
+			name:    "线路不一致",
+			records: []*tcloud.DnsRcordR{weighted(testRecord(1, "1.1.1.1", testOwner), "默认", 10)},
+			modify:  []string{"1:1.1.1.1"},
+			add:     []string{"3.3.3.3"},
+		},
+		{
+			name:    "权重不一致",
+			records: []*tcloud.DnsRcordR{weighted(testRecord(1, "3.3.3.3", testOwner), "联通", 1)},
+			modify:  []string{"1:3.3.3.3"},
+			add:     []string{"1.1.1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &utils.DomainBindingConfig{Owner: testOwner, PraseNum: 1, TTL: 600}
+			diff := diffDNSRecords(tt.records, targets, db)
+			modify := make([]string, 0)
+			for _, change := range diff.modify {
+				modify = append(modify, fmt.Sprintf("%d:%s", *change.record.RecordId, change.value))
+			}
+			if !reflect.DeepEqual(modify, orEmpty(tt.modify)) {
+				t.Errorf("modify = %v, want %v", modify, tt.modify)
+			}
+			if !reflect.DeepEqual(orEmpty(diff.add), orEmpty(tt.add)) {
+				t.Errorf("add = %v, want %v", diff.add, tt.add)
+			}
+			if len(diff.remove) != 0 {
+				t.Errorf("remove = %v, want none", diff.remove)
+			}
+		})
+	}
+}
+
+func orEmpty[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
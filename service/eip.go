@@ -0,0 +1,311 @@
+package service
+
+import (
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	cvm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm/v20170312"
+	vpc "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vpc/v20170312"
+)
+
+// 等待新申请的弹性公网IP可绑定的最大次数和间隔
+const (
+	eipWaitRetries  = 10
+	eipWaitInterval = 3 * time.Second
+)
+
+// eipBinding 待绑定的弹性公网IP和实例
+type eipBinding struct {
+	address    *vpc.Address
+	instanceId string
+}
+
+// eipDiff 弹性公网IP变更
+type eipDiff struct {
+	associate []eipBinding   // 绑定已有的空闲弹性公网IP
+	allocate  []string       // 没有空闲弹性公网IP、需要新申请的实例
+	release   []*vpc.Address // 按 release 策略释放的弹性公网IP
+	idle      []*vpc.Address // 超出期望实例数量、按 retain 策略保留的空闲弹性公网IP
+	blocked   []*vpc.Address // 被封堵或欠费、不能绑定的弹性公网IP
+}
+
+// addressUsable 弹性公网IP未绑定且可以绑定
+func addressUsable(address *vpc.Address) bool {
+	return utils.StringValue(address.AddressStatus) == tcloud.AddressUnbind &&
+		!utils.BoolValue(address.IsBlocked) && !utils.BoolValue(address.IsArrears)
+}
+
+// diffEipAddresses 对比实例和弹性公网IP：运行中且未绑定弹性公网IP的实例按创建时间依次绑定空闲的弹性公网IP，没有空闲时新申请
+// 已绑定和可绑定的弹性公网IP数量超过期望实例数量（及当前实例数量，包括尚未运行的实例）时，
+// release 策略释放多余的空闲弹性公网IP，被封堵或欠费的弹性公网IP不计入，接管的弹性公网IP不会释放
+func diffEipAddresses(instances []*cvm.Instance, addresses []*vpc.Address, adopted []string, count int64, policy string) eipDiff {
+	var diff eipDiff
+	bound := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		if id := utils.StringValue(address.InstanceId); id != "" {
+			bound[id] = true
+		}
+	}
+	usable := int64(len(bound))
+
+	// 接管的弹性公网IP优先绑定，其余按ID排序，保证多次计算结果一致
+	free := make([]*vpc.Address, 0, len(addresses))
+	for _, address := range addresses {
+		switch {
+		case addressUsable(address):
+			free = append(free, address)
+			usable++
+		case utils.StringValue(address.AddressStatus) == tcloud.AddressUnbind:
+			diff.blocked = append(diff.blocked, address)
+		}
+	}
+	sort.SliceStable(free, func(i, j int) bool {
+		ai := slices.Contains(adopted, utils.StringValue(free[i].AddressId))
+		aj := slices.Contains(adopted, utils.StringValue(free[j].AddressId))
+		if ai != aj {
+			return ai
+		}
+		return utils.StringValue(free[i].AddressId) < utils.StringValue(free[j].AddressId)
+	})
+
+	sorted := make([]*cvm.Instance, len(instances))
+	copy(sorted, instances)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ci, cj := utils.StringValue(sorted[i].CreatedTime), utils.StringValue(sorted[j].CreatedTime)
+		if ci != cj {
+			return ci < cj
+		}
+		return utils.StringValue(sorted[i].InstanceId) < utils.StringValue(sorted[j].InstanceId)
+	})
+	for _, ins := range sorted {
+		id := utils.StringValue(ins.InstanceId)
+		// 弹性公网IP只能绑定到运行中的实例
+		if bound[id] || utils.StringValue(ins.InstanceState) != "RUNNING" {
+			continue
+		}
+		if len(free) > 0 {
+			diff.associate = append(diff.associate, eipBinding{address: free[0], instanceId: id})
+			free = free[1:]
+			continue
+		}
+		diff.allocate = append(diff.allocate, id)
+	}
+
+	// 尚未运行的实例稍后同样需要绑定弹性公网IP
+	excess := usable + int64(len(diff.allocate)) - max(count, int64(len(instances)))
+	for i := len(free) - 1; i >= 0 && excess > 0; i-- {
+		if slices.Contains(adopted, utils.StringValue(free[i].AddressId)) {
+			continue
+		}
+		if policy == utils.EipRelease {
+			diff.release = append(diff.release, free[i])
+		} else {
+			diff.idle = append(diff.idle, free[i])
+		}
+		excess--
+	}
+	return diff
+}
+
+// observeEips 查询带实例管理器标签的弹性公网IP和配置接管的弹性公网IP
+func (m *InstanceManager) observeEips(p *Plan) error {
+	d, a := p.desire, p.actual
+	addresses, err := m.Client.FindAddresses(m.Cfg.TConfig.TagKey, m.Ibm.Name)
+	if err != nil {
+		return err
+	}
+	adopted, err := m.Client.DescribeAddresses(d.eip.AddressIds)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(adopted))
+	for _, address := range adopted {
+		id := utils.StringValue(address.AddressId)
+		found[id] = true
+		if !slices.ContainsFunc(addresses, func(x *vpc.Address) bool { return utils.StringValue(x.AddressId) == id }) {
+			addresses = append(addresses, address)
+		}
+	}
+	for _, id := range d.eip.AddressIds {
+		if !found[id] {
+			p.warn("接管的弹性公网IP %s 不存在", id)
+		}
+	}
+
+	// 绑定到其他资源（非本实例管理器实例）的弹性公网IP不参与绑定和释放
+	alive := make(map[string]bool, len(a.instances))
+	for _, ins := range a.instances {
+		alive[utils.StringValue(ins.InstanceId)] = true
+	}
+	a.eips = make([]*vpc.Address, 0, len(addresses))
+	for _, address := range addresses {
+		if id := utils.StringValue(address.InstanceId); id != "" && !alive[id] {
+			p.warn("弹性公网IP %s（%s）已绑定到 %s，不由实例管理器维护", utils.StringValue(address.AddressId), utils.StringValue(address.AddressIp), id)
+			continue
+		}
+		a.eips = append(a.eips, address)
+	}
+	return nil
+}
+
+// diffEips 计算弹性公网IP的申请、绑定和释放
+func (m *InstanceManager) diffEips(p *Plan) {
+	d, a := p.desire, p.actual
+	diff := diffEipAddresses(a.instances, a.eips, d.eip.AddressIds, d.count, d.eip.ReleasePolicy)
+	for _, binding := range diff.associate {
+		p.add(Action{Type: ActionUpdate, Resource: ResourceEip, ID: utils.StringValue(binding.address.AddressId), Value: utils.StringValue(binding.address.AddressIp),
+			Detail: fmt.Sprintf("绑定 %s 到实例 %s", utils.StringValue(binding.address.AddressIp), binding.instanceId)})
+	}
+	for _, instanceId := range diff.allocate {
+		p.add(Action{Type: ActionCreate, Resource: ResourceEip, Name: m.Ibm.Name,
+			Detail: "申请并绑定到实例 " + instanceId})
+	}
+	for _, address := range diff.release {
+		p.add(Action{Type: ActionDelete, Resource: ResourceEip, ID: utils.StringValue(address.AddressId), Value: utils.StringValue(address.AddressIp),
+			Detail: fmt.Sprintf("释放未绑定的 %s（超出期望实例数量 %d）", utils.StringValue(address.AddressIp), d.count)})
+	}
+	if len(diff.idle) > 0 {
+		p.warn("%d 个弹性公网IP未绑定实例且超出期望实例数量，按 retain 策略保留（闲置的弹性公网IP会收取费用）: %s", len(diff.idle), addressIPs(diff.idle))
+	}
+	if len(diff.blocked) > 0 {
+		p.warn("%d 个弹性公网IP被封堵或欠费，不能绑定: %s", len(diff.blocked), addressIPs(diff.blocked))
+	}
+}
+
+// countRunning 返回运行中的实例数量
+func countRunning(instances []*cvm.Instance) int {
+	n := 0
+	for _, ins := range instances {
+		if utils.StringValue(ins.InstanceState) == "RUNNING" {
+			n++
+		}
+	}
+	return n
+}
+
+// addressIPs 返回弹性公网IP地址列表的描述
+func addressIPs(addresses []*vpc.Address) string {
+	ips := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		ips = append(ips, utils.StringValue(address.AddressIp))
+	}
+	return strings.Join(ips, ", ")
+}
+
+// applyEips 申请、绑定和释放弹性公网IP，返回实例ID -> 成功发起绑定的弹性公网IP地址
+// 单个弹性公网IP绑定失败不影响其他实例，申请失败时返回错误
+func (m *InstanceManager) applyEips(p *Plan) (map[string]string, error) {
+	d, a := p.desire, p.actual
+	associated := make(map[string]string)
+	if len(p.filter(ResourceEip)) == 0 {
+		return associated, nil
+	}
+	diff := diffEipAddresses(a.instances, a.eips, d.eip.AddressIds, d.count, d.eip.ReleasePolicy)
+
+	bindings := diff.associate
+	if len(diff.allocate) > 0 {
+		m.Log.WithField("count", len(diff.allocate)).Info("申请弹性公网IP")
+		ids, err := m.Client.AllocateAddresses(&tcloud.AllocateEipP{
+			Count:        int64(len(diff.allocate)),
+			Name:         m.Ibm.Name,
+			TagKey:       m.Cfg.TConfig.TagKey,
+			TagVal:       m.Ibm.Name,
+			ChargeType:   d.eip.ChargeType,
+			BandwidthOut: d.eip.BandwidthOut,
+			ISP:          d.eip.ISP,
+		})
+		if err != nil {
+			return associated, err
+		}
+		addresses, err := m.waitAddresses(ids)
+		if err != nil {
+			return associated, err
+		}
+		a.eips = append(a.eips, addresses...)
+		for i, address := range addresses {
+			if i < len(diff.allocate) {
+				bindings = append(bindings, eipBinding{address: address, instanceId: diff.allocate[i]})
+			}
+		}
+	}
+
+	for _, binding := range bindings {
+		addressId, ip := utils.StringValue(binding.address.AddressId), utils.StringValue(binding.address.AddressIp)
+		m.Log.WithFields(logrus.Fields{"弹性公网IP": ip, "实例ID": binding.instanceId}).Info("绑定弹性公网IP")
+		if err := m.Client.AssociateAddress(addressId, binding.instanceId); err != nil {
+			m.Log.Error(err)
+			continue
+		}
+		associated[binding.instanceId] = ip
+	}
+
+	if len(diff.release) > 0 {
+		ids := make([]string, 0, len(diff.release))
+		for _, address := range diff.release {
+			ids = append(ids, utils.StringValue(address.AddressId))
+		}
+		m.Log.WithField("弹性公网IP", addressIPs(diff.release)).Info("释放未绑定的弹性公网IP")
+		if err := m.Client.ReleaseAddresses(ids); err != nil {
+			m.Log.Error(err)
+		}
+	}
+	return associated, nil
+}
+
+// waitAddresses 等待新申请的弹性公网IP创建完成
+func (m *InstanceManager) waitAddresses(ids []string) ([]*vpc.Address, error) {
+	for loopNum := 1; ; loopNum++ {
+		addresses, err := m.Client.DescribeAddresses(ids)
+		if err != nil {
+			return nil, err
+		}
+		ready := len(addresses) == len(ids)
+		for _, address := range addresses {
+			if utils.StringValue(address.AddressStatus) != tcloud.AddressUnbind {
+				ready = false
+			}
+		}
+		if ready {
+			sort.Slice(addresses, func(i, j int) bool {
+				return utils.StringValue(addresses[i].AddressId) < utils.StringValue(addresses[j].AddressId)
+			})
+			return addresses, nil
+		}
+		if loopNum >= eipWaitRetries {
+			return nil, fmt.Errorf("等待弹性公网IP %v 创建超时", ids)
+		}
+		time.Sleep(eipWaitInterval)
+	}
+}
+
+// waitEips 等待实例的公网IP变为绑定的弹性公网IP（绑定为异步操作），返回最新的实例列表
+func (m *InstanceManager) waitEips(associated map[string]string) ([]*cvm.Instance, error) {
+	for loopNum := 1; ; loopNum++ {
+		instanceSet, err := m.Client.GetInsInfo(m.Cfg.TConfig.TagKey, m.Ibm.Name)
+		if err != nil {
+			return nil, fmt.Errorf("获取实例信息失败: %v", err)
+		}
+		done := 0
+		for _, ins := range instanceSet {
+			ip, ok := associated[utils.StringValue(ins.InstanceId)]
+			if ok && slices.ContainsFunc(ins.PublicIpAddresses, func(x *string) bool { return utils.StringValue(x) == ip }) {
+				done++
+			}
+		}
+		if done >= len(associated) {
+			return instanceSet, nil
+		}
+		if loopNum >= instanceWaitRetries {
+			m.Log.Warnf("等待弹性公网IP绑定超时（%d/%d），下次调和时继续", done, len(associated))
+			return instanceSet, nil
+		}
+		m.Log.Debugf("正在进行第 %d/%d 次等待弹性公网IP绑定完成...", loopNum, instanceWaitRetries)
+		time.Sleep(instanceWaitInterval)
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"reflect"
+	"testing"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	cvm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm/v20170312"
+	vpc "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vpc/v20170312"
+)
+
+func freeAddress(id string) *vpc.Address {
+	return &vpc.Address{AddressId: common.StringPtr(id), AddressStatus: common.StringPtr(tcloud.AddressUnbind)}
+}
+
+func boundAddress(id, instanceId string) *vpc.Address {
+	return &vpc.Address{AddressId: common.StringPtr(id), AddressStatus: common.StringPtr(tcloud.AddressBind), InstanceId: common.StringPtr(instanceId)}
+}
+
+// unusableAddress 未绑定但被封堵（blocked 为 true）或欠费的弹性公网IP
+func unusableAddress(id string, blocked bool) *vpc.Address {
+	address := freeAddress(id)
+	if blocked {
+		address.IsBlocked = common.BoolPtr(true)
+	} else {
+		address.IsArrears = common.BoolPtr(true)
+	}
+	return address
+}
+
+func eipInstance(id, state, createdTime string) *cvm.Instance {
+	return &cvm.Instance{
+		InstanceId:    common.StringPtr(id),
+		InstanceState: common.StringPtr(state),
+		CreatedTime:   common.StringPtr(createdTime),
+	}
+}
+
+func addressIds(addresses []*vpc.Address) []string {
+	ids := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		ids = append(ids, *address.AddressId)
+	}
+	return ids
+}
+
+func TestDiffEipAddresses(t *testing.T) {
+	const day1, day2 = "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z"
+	tests := []struct {
+		name      string
+		instances []*cvm.Instance
+		addresses []*vpc.Address
+		adopted   []string
+		count     int64
+		policy    string
+		associate []string // 地址ID:实例ID
+		allocate  []string
+		release   []string
+		idle      []string
+		blocked   []string
+	}{
+		{
+			name:      "实例都已绑定",
+			instances: []*cvm.Instance{eipInstance("ins-1", "RUNNING", day1), eipInstance("ins-2", "RUNNING", day2)},
+			addresses: []*vpc.Address{boundAddress("eip-1", "ins-1"), boundAddress("eip-2", "ins-2")},
+			count:     2,
+		},
+		{
+			name:      "绑定空闲的弹性公网IP",
+			instances: []*cvm.Instance{eipInstance("ins-1", "RUNNING", day1)},
+			addresses: []*vpc.Address{freeAddress("eip-1")},
+			count:     1,
+			associate: []string{"eip-1:ins-1"},
+		},
+		{
+			name:      "没有空闲时申请",
+			instances: []*cvm.Instance{eipInstance("ins-1", "RUNNING", day1), eipInstance("ins-2", "RUNNING", day2)},
+			addresses: []*vpc.Address{boundAddress("eip-1", "ins-1")},
+			count:     2,
+			allocate:  []string{"ins-2"},
+		},
+		{
+			name:      "未运行的实例不绑定",
+			instances: []*cvm.Instance{eipInstance("ins-1", "PENDING", day1)},
+			addresses: []*vpc.Address{freeAddress("eip-1")},
+			count:     1,
+		},
+		{
+			name:      "按实例创建时间依次绑定",
+			instances: []*cvm.Instance{eipInstance("ins-1", "RUNNING", day2), eipInstance("ins-2", "RUNNING", day1)},
+			addresses: []*vpc.Address{freeAddress("eip-2"), freeAddress("eip-1")},
+			count:     2,
+			associate: []string{"eip-1:ins-2", "eip-2:ins-1"},
+		},
+		{
+			name:      "接管的弹性公网IP优先绑定",
+			instances: []*cvm.Instance{eipInstance("ins-1", "RUNNING", day1)},
+			addresses: []*vpc.Address{freeAddress("eip-1"), freeAddress("eip-2")},
+			adopted:   []string{"eip-2"},
+			count:     1,
+			policy:    utils.EipRelease,
+			associate: []string{"eip-2:ins-1"},
+			release:   []string{"eip-1"},
+		},
+		{
+			name:      "被封堵或欠费的弹性公网IP不绑定",
+			instances: []*cvm.Instance{eipInstance("ins-1", "RUNNING", day1)},
+			addresses: []*vpc.Address{unusableAddress("eip-1", true), unusableAddress("eip-2", false)},
+			count:     3,
+			allocate:  []string{"ins-1"},
+			blocked:   []string{"eip-1", "eip-2"},
+		},
+		{
+			name:      "被封堵的弹性公网IP不计入多余数量",
+			instances: []*cvm.Instance{eipInstance("ins-1", "RUNNING", day1), eipInstance("ins-2", "PENDING", day2)},
+			addresses: []*vpc.Address{boundAddress("eip-1", "ins-1"), freeAddress("eip-2"), unusableAddress("eip-3", true)},
+			count:     2,
+			policy:    utils.EipRelease,
+			blocked:   []string{"eip-3"},
+		},
+		{
+			name:      "为尚未运行的替换实例保留空闲弹性公网IP",
+			instances: []*cvm.Instance{eipInstance("ins-1", "RUNNING", day1), eipInstance("ins-2", "PENDING", day2)},
+			addresses: []*vpc.Address{boundAddress("eip-1", "ins-1"), freeAddress("eip-2")},
+			count:     1,
+			policy:    utils.EipRelease,
+		},
+		{
+			name:      "retain 策略保留多余的弹性公网IP",
+			instances: []*cvm.Instance{eipInstance("ins-1", "RUNNING", day1)},
+			addresses: []*vpc.Address{boundAddress("eip-1", "ins-1"), freeAddress("eip-2")},
+			count:     1,
+			policy:    utils.EipRetain,
+			idle:      []string{"eip-2"},
+		},
+		{
+			name:      "release 策略从后向前释放多余的弹性公网IP",
+			addresses: []*vpc.Address{freeAddress("eip-1"), freeAddress("eip-2"), freeAddress("eip-3")},
+			count:     1,
+			policy:    utils.EipRelease,
+			release:   []string{"eip-3", "eip-2"},
+		},
+		{
+			name:      "接管的弹性公网IP不释放",
+			addresses: []*vpc.Address{freeAddress("eip-1"), freeAddress("eip-2")},
+			adopted:   []string{"eip-1"},
+			policy:    utils.EipRelease,
+			release:   []string{"eip-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := diffEipAddresses(tt.instances, tt.addresses, tt.adopted, tt.count, tt.policy)
+
+			associate := make([]string, 0, len(diff.associate))
+			for _, b := range diff.associate {
+				associate = append(associate, *b.address.AddressId+":"+b.instanceId)
+			}
+			check := func(field string, got, want []string) {
+				if !reflect.DeepEqual(orEmpty(got), orEmpty(want)) {
+					t.Errorf("%s = %v, want %v", field, got, want)
+				}
+			}
+			check("associate", associate, tt.associate)
+			check("allocate", diff.allocate, tt.allocate)
+			check("release", addressIds(diff.release), tt.release)
+			check("idle", addressIds(diff.idle), tt.idle)
+			check("blocked", addressIds(diff.blocked), tt.blocked)
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package service
+
+import (
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	cvm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm/v20170312"
+)
+
+// hostnamePattern 实例主机记录允许的字符
+var hostnamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+// HostnameVars 实例主机记录模板可使用的变量
+type HostnameVars struct {
+	Index        int // 实例序号，从1开始，实例存在期间保持不变，实例删除后序号可被新实例复用
+	InstanceId   string
+	InstanceName string
+	Zone         string
+	Region       string
+	Manager      string
+	SubDomain    string // 域名绑定的二级域名
+}
+
+// hostRecord 实例的主机记录
+type hostRecord struct {
+	instanceId string
+	index      int
+	subDomain  string
+	recordType string
+	value      string
+	line       string
+}
+
+// remark 返回实例主机记录的备注：<所有者标记>/<实例ID>/<序号>
+func (r hostRecord) remark(owner string) string {
+	return fmt.Sprintf("%s/%s/%d", owner, r.instanceId, r.index)
+}
+
+// parseHostRemark 解析实例主机记录的备注，不是此所有者的实例主机记录时返回 false
+func parseHostRemark(remark, owner string) (string, int, bool) {
+	rest, ok := strings.CutPrefix(remark, owner+"/")
+	if !ok {
+		return "", 0, false
+	}
+	instanceId, index, ok := strings.Cut(rest, "/")
+	if !ok {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(index)
+	if err != nil || n <= 0 {
+		return "", 0, false
+	}
+	return instanceId, n, true
+}
+
+// hostRecordChange 实例主机记录的修改，保留记录ID
+type hostRecordChange struct {
+	record *tcloud.DnsRcordR
+	want   hostRecord
+	reason string
+}
+
+// instanceIP 返回实例指定记录类型的第一个IP，没有时返回空字符串
+func instanceIP(instance *cvm.Instance, recordType string) string {
+	addrs := instance.PublicIpAddresses
+	if recordType == tcloud.RecordAAAA {
+		addrs = append(append([]*string{}, instance.PublicIPv6Addresses...), instance.IPv6Addresses...)
+	}
+	for _, ip := range addrs {
+		if ip != nil && *ip != "" {
+			return *ip
+		}
+	}
+	return ""
+}
+
+// instanceReady 实例运行中，且配置了初始化步骤时已完成过初始化
+func instanceReady(p *Plan, instance *cvm.Instance) bool {
+	if utils.StringValue(instance.InstanceState) != "RUNNING" {
+		return false
+	}
+	return p.desire.hashes == nil || p.actual.applied[utils.StringValue(instance.InstanceId)] != ""
+}
+
+// desiredHostRecords 计算实例的主机记录：实例就绪后创建记录，已有记录的实例保留记录直到实例删除
+// 序号使用初始化状态中记录的实例序号，与模板变量 {{.Index}} 和环境变量 CVMSPOT_INDEX 一致
+func (m *InstanceManager) desiredHostRecords(p *Plan, db *utils.DomainBindingConfig, state *dnsState) ([]hostRecord, error) {
+	a := p.actual
+
+	recorded := make(map[string]bool)
+	for _, record := range state.hostRecords {
+		if instanceId, _, ok := parseHostRemark(utils.StringValue(record.Remark), db.Owner); ok {
+			recorded[instanceId] = true
+		}
+	}
+
+	instances := make([]*cvm.Instance, len(a.instances))
+	copy(instances, a.instances)
+	sort.SliceStable(instances, func(i, j int) bool {
+		ci, cj := utils.StringValue(instances[i].CreatedTime), utils.StringValue(instances[j].CreatedTime)
+		if ci != cj {
+			return ci < cj
+		}
+		return utils.StringValue(instances[i].InstanceId) < utils.StringValue(instances[j].InstanceId)
+	})
+
+	recordTypes := make([]string, 0, 2)
+	for _, recordType := range []string{tcloud.RecordA, tcloud.RecordAAAA} {
+		if recordTypeEnabled(db, recordType) {
+			recordTypes = append(recordTypes, recordType)
+		}
+	}
+	records := make([]hostRecord, 0, len(instances))
+	for _, ins := range instances {
+		id := utils.StringValue(ins.InstanceId)
+		if !recorded[id] && (!instanceReady(p, ins) || instanceIP(ins, recordTypes[0]) == "") {
+			continue
+		}
+		index, err := m.States.Index(id, m.Ibm.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		zone := ""
+		if ins.Placement != nil {
+			zone = utils.StringValue(ins.Placement.Zone)
+		}
+		name, err := utils.RenderTemplate("hostname_template", []byte(db.HostnameTemplate), HostnameVars{
+			Index:        index,
+			InstanceId:   id,
+			InstanceName: utils.StringValue(ins.InstanceName),
+			Zone:         zone,
+			Region:       m.Region,
+			Manager:      m.Ibm.Name,
+			SubDomain:    db.SubDomain,
+		})
+		if err != nil {
+			return nil, err
+		}
+		subDomain := strings.ToLower(strings.TrimSpace(string(name)))
+		if !hostnamePattern.MatchString(subDomain) {
+			return nil, fmt.Errorf("实例 %s 的主机记录 %q 格式错误", id, subDomain)
+		}
+
+		for _, recordType := range recordTypes {
+			ip := instanceIP(ins, recordType)
+			if ip == "" {
+				continue
+			}
+			records = append(records, hostRecord{
+				instanceId: id,
+				index:      index,
+				subDomain:  subDomain,
+				recordType: recordType,
+				value:      ip,
+				line:       instanceLine(db, ins),
+			})
+		}
+	}
+	return records, nil
+}
+
+// diffHostRecords 对比实例主机记录，删除已删除实例的记录和重复记录，记录的主机名、IP、线路、TTL 或备注变化时修改记录
+func diffHostRecords(existing []*tcloud.DnsRcordR, desired []hostRecord, db *utils.DomainBindingConfig) ([]*tcloud.DnsRcordR, []hostRecordChange, []hostRecord) {
+	want := make(map[string]hostRecord, len(desired))
+	for _, record := range desired {
+		want[record.instanceId+"/"+record.recordType] = record
+	}
+
+	remove := make([]*tcloud.DnsRcordR, 0)
+	modify := make([]hostRecordChange, 0)
+	matched := make(map[string]bool, len(existing))
+	for _, record := range existing {
+		instanceId, _, ok := parseHostRemark(utils.StringValue(record.Remark), db.Owner)
+		if !ok {
+			continue
+		}
+		key := instanceId + "/" + utils.StringValue(record.RecordType)
+		target, ok := want[key]
+		if !ok || matched[key] {
+			remove = append(remove, record)
+			continue
+		}
+		matched[key] = true
+		if reason := hostRecordDrift(record, target, db); reason != "" {
+			modify = append(modify, hostRecordChange{record: record, want: target, reason: reason})
+		}
+	}
+
+	add := make([]hostRecord, 0)
+	for _, record := range desired {
+		if !matched[record.instanceId+"/"+record.recordType] {
+			add = append(add, record)
+		}
+	}
+	return remove, modify, add
+}
+
+// hostRecordDrift 返回实例主机记录与期望的差异，一致时返回空字符串
+func hostRecordDrift(record *tcloud.DnsRcordR, want hostRecord, db *utils.DomainBindingConfig) string {
+	switch {
+	case utils.StringValue(record.SubDomain) != want.subDomain:
+		return fmt.Sprintf("主机记录 %s -> %s", utils.StringValue(record.SubDomain), want.subDomain)
+	case utils.StringValue(record.Value) != want.value:
+		return fmt.Sprintf("%s -> %s", utils.StringValue(record.Value), want.value)
+	case utils.StringValue(record.RecordLine) != want.line:
+		return fmt.Sprintf("线路 %s -> %s", utils.StringValue(record.RecordLine), want.line)
+	case db.TTL != 0 && utils.Uint64Value(record.TTL) != db.TTL:
+		return fmt.Sprintf("TTL %d -> %d", utils.Uint64Value(record.TTL), db.TTL)
+	case utils.StringValue(record.Remark) != want.remark(db.Owner):
+		return "备注 " + want.remark(db.Owner)
+	}
+	return ""
+}
+
+// observeHostRecords 查询域名绑定的主域名下带此所有者标记的实例主机记录
+func (m *InstanceManager) observeHostRecords(p *Plan, db *utils.DomainBindingConfig, state *dnsState) {
+	records, err := m.Client.GetDomainRecordList(db.Domain)
+	if err != nil {
+		p.warn("%v，本次不调整 %s 的实例主机记录", err, db.Domain)
+		return
+	}
+	state.hostRecords = make([]*tcloud.DnsRcordR, 0)
+	for _, record := range records {
+		if _, _, ok := parseHostRemark(utils.StringValue(record.Remark), db.Owner); ok {
+			state.hostRecords = append(state.hostRecords, record)
+		}
+	}
+	state.hostObserved = true
+}
+
+// diffHostnames 计算单个域名绑定的实例主机记录变更
+func (m *InstanceManager) diffHostnames(p *Plan, db *utils.DomainBindingConfig, state *dnsState) {
+	if !state.hostObserved {
+		return
+	}
+	desired, err := m.desiredHostRecords(p, db, state)
+	if err != nil {
+		p.warn("计算 %s 的实例主机记录失败，不维护实例主机记录: %v", db.FQDN(), err)
+		return
+	}
+	remove, modify, add := diffHostRecords(state.hostRecords, desired, db)
+	for _, record := range remove {
+		p.add(Action{Type: ActionDelete, Resource: ResourceHostRecord, ID: strconv.FormatUint(*record.RecordId, 10),
+			Name: utils.StringValue(record.SubDomain) + "." + db.Domain, Value: utils.StringValue(record.Value),
+			Detail: utils.StringValue(record.RecordType) + " " + utils.StringValue(record.Value)})
+	}
+	for _, change := range modify {
+		p.add(Action{Type: ActionUpdate, Resource: ResourceHostRecord, ID: strconv.FormatUint(*change.record.RecordId, 10),
+			Name: change.want.subDomain + "." + db.Domain, Value: change.want.value,
+			Detail: fmt.Sprintf("%s %s（%s）", change.want.recordType, change.want.value, change.reason)})
+	}
+	for _, record := range add {
+		p.add(Action{Type: ActionCreate, Resource: ResourceHostRecord, Name: record.subDomain + "." + db.Domain, Value: record.value,
+			Detail: fmt.Sprintf("%s %s（%s，线路 %s，TTL %d）", record.recordType, record.value, record.instanceId, record.line, db.TTL)})
+	}
+}
+
+// applyHostnames 按变更计划维护单个域名绑定的实例主机记录，单条记录失败不影响其他记录
+func (m *InstanceManager) applyHostnames(p *Plan, db *utils.DomainBindingConfig, state *dnsState) {
+	if !state.hostObserved || len(p.filter(ResourceHostRecord)) == 0 {
+		return
+	}
+	desired, err := m.desiredHostRecords(p, db, state)
+	if err != nil {
+		m.Log.Errorf("计算 %s 的实例主机记录失败: %v", db.FQDN(), err)
+		return
+	}
+	remove, modify, add := diffHostRecords(state.hostRecords, desired, db)
+	for _, record := range remove {
+		m.Log.Infof("删除实例主机记录: %s.%s %s", utils.StringValue(record.SubDomain), db.Domain, utils.StringValue(record.Value))
+		if err := m.Client.RemoveDNSRecord(&db.Domain, record.RecordId); err != nil {
+			m.Log.Errorf("删除实例主机记录失败: %v", err)
+		}
+	}
+	for _, change := range modify {
+		m.Log.Infof("修改实例主机记录 %s.%s: %s", change.want.subDomain, db.Domain, change.reason)
+		if err := m.Client.ModifyDNSRecord(change.want.params(db, change.record.RecordId)); err != nil {
+			m.Log.Errorf("修改实例主机记录失败: %v", err)
+		}
+	}
+	for _, record := range add {
+		m.Log.Infof("添加实例主机记录: %s.%s %s", record.subDomain, db.Domain, record.value)
+		if err := m.Client.AddDNSRecord(record.params(db, nil)); err != nil {
+			m.Log.Errorf("添加实例主机记录失败: %v", err)
+		}
+	}
+}
+
+// params 返回添加或修改实例主机记录的请求参数
+func (r hostRecord) params(db *utils.DomainBindingConfig, recordId *uint64) *tcloud.DnsRecordP {
+	remark := r.remark(db.Owner)
+	return &tcloud.DnsRecordP{
+		Domain:     &db.Domain,
+		SubDomain:  &r.subDomain,
+		RecordType: &r.recordType,
+		RecordLine: &r.line,
+		Value:      &r.value,
+		TTL:        &db.TTL,
+		Remark:     &remark,
+		RecordId:   recordId,
+	}
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"maps"
+	"path/filepath"
+	"testing"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	cvm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm/v20170312"
+)
+
+func TestParseHostRemark(t *testing.T) {
+	tests := []struct {
+		name       string
+		remark     string
+		instanceId string
+		index      int
+		ok         bool
+	}{
+		{name: "实例主机记录", remark: "cvmspot:web/ins-1/2", instanceId: "ins-1", index: 2, ok: true},
+		{name: "与 remark() 互逆", remark: hostRecord{instanceId: "ins-abc", index: 12}.remark(testOwner), instanceId: "ins-abc", index: 12, ok: true},
+		{name: "其他所有者", remark: "cvmspot:db/ins-1/2"},
+		{name: "所有者前缀相同", remark: "cvmspot:web2/ins-1/2"},
+		{name: "域名绑定记录", remark: testOwner},
+		{name: "空备注"},
+		{name: "缺少序号", remark: "cvmspot:web/ins-1"},
+		{name: "序号不是数字", remark: "cvmspot:web/ins-1/a"},
+		{name: "序号为0", remark: "cvmspot:web/ins-1/0"},
+		{name: "序号为负数", remark: "cvmspot:web/ins-1/-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instanceId, index, ok := parseHostRemark(tt.remark, testOwner)
+			if instanceId != tt.instanceId || index != tt.index || ok != tt.ok {
+				t.Errorf("parseHostRemark(%q) = (%s, %d, %v), want (%s, %d, %v)",
+					tt.remark, instanceId, index, ok, tt.instanceId, tt.index, tt.ok)
+			}
+		})
+	}
+}
+
+// hostInstance 生成带公网IP的实例
+func hostInstance(id, state, createdTime, ip string) *cvm.Instance {
+	return &cvm.Instance{
+		InstanceId:        common.StringPtr(id),
+		InstanceState:     common.StringPtr(state),
+		CreatedTime:       common.StringPtr(createdTime),
+		PublicIpAddresses: []*string{common.StringPtr(ip)},
+	}
+}
+
+func TestDesiredHostRecordsIndex(t *testing.T) {
+	states, err := utils.NewProvisionStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ins-2 先完成初始化，模板渲染时序号为1
+	if _, err := states.Index("ins-2", "web"); err != nil {
+		t.Fatal(err)
+	}
+	m := &InstanceManager{Ibm: &utils.InstanceBindingManager{Name: "web"}, States: states}
+	p := &Plan{desire: &desiredState{}, actual: &actualState{instances: []*cvm.Instance{
+		hostInstance("ins-1", "RUNNING", "2024-01-01 00:00:00", "1.1.1.1"),
+		hostInstance("ins-2", "RUNNING", "2024-01-02 00:00:00", "2.2.2.2"),
+		hostInstance("ins-3", "PENDING", "2024-01-03 00:00:00", "3.3.3.3"),
+	}}}
+	db := &utils.DomainBindingConfig{Owner: testOwner, Domain: "example.com", HostnameTemplate: "frp-{{.Index}}"}
+	// DNS 备注中的序号与初始化状态不一致时以初始化状态为准
+	stale := testRecord(1, "1.1.1.1", hostRecord{instanceId: "ins-1", index: 1}.remark(testOwner))
+	stale.SubDomain = common.StringPtr("frp-1")
+
+	records, err := m.desiredHostRecords(p, db, &dnsState{hostRecords: []*tcloud.DnsRcordR{stale}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, record := range records {
+		got[record.instanceId] = record.subDomain
+		if index, _ := states.Index(record.instanceId, "web"); index != record.index {
+			t.Errorf("实例 %s 主机记录序号 = %d, 初始化状态序号 = %d", record.instanceId, record.index, index)
+		}
+	}
+	want := map[string]string{"ins-1": "frp-2", "ins-2": "frp-1"}
+	if !maps.Equal(got, want) {
+		t.Errorf("desiredHostRecords() = %v, want %v", got, want)
+	}
+	if states.Get("ins-3") != nil {
+		t.Error("未就绪的实例不应分配序号")
+	}
+
+	remove, modify, add := diffHostRecords([]*tcloud.DnsRcordR{stale}, records, db)
+	if len(remove) != 0 || len(modify) != 1 || len(add) != 1 || modify[0].want.subDomain != "frp-2" {
+		t.Errorf("diffHostRecords() remove = %d, modify = %v, add = %v", len(remove), modify, add)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"cvmspot/utils"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -18,11 +19,19 @@ type InstanceManager struct {
 	Log      *logrus.Logger
 	Client   *tcloud.AClient
 	InsCfg   *tcloud.CreateIns
-	Region   string
-	Zone     string
-	Interval time.Duration
+	HostKeys *utils.HostKeyStore
+	States   *utils.ProvisionStore
+	Launches *utils.LaunchStore
+	// 安全组规则动态来源解析，所有实例管理器共用
+	Allowlists *utils.AllowlistResolver
+	Region     string
+	Zone       string
+	Interval   time.Duration
 }
 
+// 跳板机主机密钥记录的归属标识，不随实例管理器的实例清理
+const jumpHostKeyOwner = "@jump"
+
 type InstanceManagerGroup struct {
 	managers []*InstanceManager
 	log      *logrus.Logger
@@ -39,74 +48,148 @@ func NewInstanceManagerGroup(c *tcloud.Client, cfg *utils.Config) *InstanceManag
 
 	c.Log.Debugf("正在初始化实例管理器组...")
 
+	managers, err := newInstanceManagers(c, cfg)
+	if err != nil {
+		c.Log.Fatalf("%v", err)
+	}
+
 	// 初始化实例管理器组
-	group := &InstanceManagerGroup{
-		log:    c.Log, // 使用任意区域的CvmClient中的Log
-		client: c,
+	return &InstanceManagerGroup{
+		managers: managers,
+		log:      c.Log, // 使用任意区域的CvmClient中的Log
+		client:   c,
 	}
+}
 
-	for _, ibm := range cfg.IBManager {
-		if ibm.AutoMaintenance.Enabled {
-			c.Log.Infof("正在查询最低价实例所在可用区")
-			// 获取最低价的实例可用区
-			_, zone, err := c.GetSpotPrice(ibm.Instance.Regions, ibm.Instance.ImageId)
-			if err != nil {
-				c.Log.Fatalf("获取低价可用区失败，退出创建 %v", err)
-				continue
-			}
+// newInstanceManagers 为开启自动维护的实例管理器选择可用区并生成创建实例参数
+// 私有网络、子网和安全组在调和时创建，网络参数由调和填充
+func newInstanceManagers(c *tcloud.Client, cfg *utils.Config) ([]*InstanceManager, error) {
+	// 加载实例主机密钥记录，所有实例管理器共享
+	hostKeys, err := utils.NewHostKeyStore(cfg.SshConfig.KnownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("加载主机密钥记录失败: %v", err)
+	}
 
-			// 查询私网ID
-			aCli := c.RegionClients[zone[:len(zone)-2]]
-			ibm.Instance.SubnetConfig.CidrBlock = strings.Replace(ibm.Instance.SubnetConfig.CidrBlock, "n", zone[len(zone)-1:], -1)
-			vpcId, subnetId, sid, err := aCli.GetOrCreateVpcAndSg(&ibm, zone, cfg.TConfig.TagKey)
-			if err != nil {
-				c.Log.Fatalf("%v", err)
-			} else {
-				c.Log.WithFields(logrus.Fields{
-					"私网ID":  vpcId,
-					"子网ID":  subnetId,
-					"安全组ID": sid,
-				}).Info("获取私有网络和安全组成功")
-			}
+	// 加载实例初始化状态
+	states, err := utils.NewProvisionStore(cfg.Provision.StatePath)
+	if err != nil {
+		return nil, fmt.Errorf("加载实例初始化状态失败: %v", err)
+	}
+
+	// 加载待确认的实例创建请求
+	launches, err := utils.NewLaunchStore(cfg.Provision.LaunchStatePath)
+	if err != nil {
+		return nil, fmt.Errorf("加载实例创建请求记录失败: %v", err)
+	}
 
-			group.managers = append(group.managers, &InstanceManager{
-				Cfg:    cfg,
-				Ibm:    &ibm,
-				Log:    c.Log,
-				Client: aCli,
-				InsCfg: &tcloud.CreateIns{
-					Region:                  zone[:len(zone)-2],
-					InstanceChargeType:      ibm.Instance.InternetChargeType,
-					Zone:                    zone,
-					ImageId:                 ibm.Instance.ImageId,
-					InstanceType:            ibm.Instance.InstanceType,
-					DiskType:                ibm.Instance.SystemDisk.Type,
-					DiskSize:                ibm.Instance.SystemDisk.Size,
-					VpcId:                   vpcId,
-					SubnetId:                subnetId,
-					InternetChargeType:      ibm.Instance.Internet.ChargeType,
-					InternetMaxBandwidthOut: ibm.Instance.Internet.BandwidthOut,
-					InstanceCount:           ibm.AutoMaintenance.DesiredCount,
-					InstanceName:            ibm.Instance.InstanceName,
-					SecurityGroupIds:        []*string{&sid},
-					Tags:                    map[string]string{cfg.TConfig.TagKey: ibm.Name, ibm.DomainBinding.TagKey: ibm.DomainBinding.SubDomain + "." + ibm.DomainBinding.Domain},
-					MaxPrice:                ibm.AutoMaintenance.LowestPrice,
-					Password:                ibm.Instance.UserConfig.Password,
-				},
-				Region:   zone[:len(zone)-2],
-				Zone:     zone,
-				Interval: time.Duration(ibm.AutoMaintenance.CheckInterval) * time.Second,
-			})
+	allowlists := utils.NewAllowlistResolver(c.Log)
+
+	managers := make([]*InstanceManager, 0, len(cfg.IBManager))
+	for _, ibm := range cfg.IBManager {
+		if !ibm.AutoMaintenance.Enabled {
+			continue
+		}
+		c.Log.Infof("正在查询最低价实例所在可用区")
+		// 获取最低价的实例可用区
+		zone, err := selectZone(c, &ibm)
+		if err != nil {
+			return nil, fmt.Errorf("实例管理器 %s 获取低价可用区失败: %v", ibm.Name, err)
+		}
+		region := zone[:len(zone)-2]
+
+		// 生成用户数据
+		userData, err := buildUserData(&ibm, region, zone)
+		if err != nil {
+			return nil, fmt.Errorf("实例管理器 %s 生成用户数据失败: %v", ibm.Name, err)
 		}
+
+		managers = append(managers, &InstanceManager{
+			Cfg:        cfg,
+			Ibm:        &ibm,
+			Log:        c.Log,
+			Client:     c.RegionClients[region],
+			InsCfg:     newCreateIns(cfg, &ibm, zone, userData),
+			HostKeys:   hostKeys,
+			States:     states,
+			Launches:   launches,
+			Allowlists: allowlists,
+			Region:     region,
+			Zone:       zone,
+			Interval:   time.Duration(ibm.AutoMaintenance.CheckInterval) * time.Second,
+		})
 	}
+	return managers, nil
+}
 
-	return group
+// selectZone 查询竞价价格最低的可用区，并将子网网段中的 n 替换为可用区编号
+func selectZone(c *tcloud.Client, ibm *utils.InstanceBindingManager) (string, error) {
+	_, zone, err := c.GetSpotPrice(ibm.Instance.Regions, ibm.Instance.ImageId)
+	if err != nil {
+		return "", err
+	}
+	ibm.Instance.SubnetConfig.CidrBlock = strings.Replace(ibm.Instance.SubnetConfig.CidrBlock, "n", zone[len(zone)-1:], -1)
+	ibm.Instance.SubnetConfig.Ipv6Index = strings.Replace(ibm.Instance.SubnetConfig.Ipv6Index, "n", zone[len(zone)-1:], -1)
+	return zone, nil
+}
+
+// newCreateIns 根据实例管理器配置生成创建实例参数，不含私有网络、子网和安全组
+func newCreateIns(cfg *utils.Config, ibm *utils.InstanceBindingManager, zone, userData string) *tcloud.CreateIns {
+	var ipv6AddressCount uint64
+	if ibm.Instance.VpcConfig.EnableIPv6 {
+		ipv6AddressCount = 1
+	}
+	// 每个标签键记录第一个使用它的域名绑定
+	tags := map[string]string{cfg.TConfig.TagKey: ibm.Name}
+	for _, db := range ibm.Bindings() {
+		if _, exists := tags[db.TagKey]; db.TagKey != "" && !exists {
+			tags[db.TagKey] = db.FQDN()
+		}
+	}
+	return &tcloud.CreateIns{
+		Region:                  zone[:len(zone)-2],
+		InstanceChargeType:      ibm.Instance.InternetChargeType,
+		Zone:                    zone,
+		ImageId:                 ibm.Instance.ImageId,
+		InstanceType:            ibm.Instance.InstanceType,
+		DiskType:                ibm.Instance.SystemDisk.Type,
+		DiskSize:                ibm.Instance.SystemDisk.Size,
+		InternetChargeType:      ibm.Instance.Internet.ChargeType,
+		InternetMaxBandwidthOut: ibm.Instance.Internet.BandwidthOut,
+		PublicIpAssigned:        ibm.Instance.Internet.BandwidthOut > 0 && !ibm.Instance.Internet.EIPMode(),
+		Ipv6AddressCount:        ipv6AddressCount,
+		IPv6AddressType:         ibm.Instance.Internet.IPv6AddressType,
+		InstanceCount:           ibm.AutoMaintenance.DesiredCount,
+		InstanceName:            ibm.Instance.InstanceName,
+		Tags:                    tags,
+		MaxPrice:                ibm.AutoMaintenance.LowestPrice,
+		Password:                ibm.Instance.UserConfig.Password,
+		UserData:                userData,
+		AutomationService:       ibm.Feature.Executor == utils.ExecutorTAT || ibm.Instance.UserConfig.HostKeyVerify == utils.HostKeyVerifyTAT,
+	}
 }
 
 func (g *InstanceManagerGroup) Run(ctx context.Context) {
 	for _, mgr := range g.managers {
 		go mgr.Run(ctx)
 	}
+	go g.logAPIStats(ctx)
+}
+
+// apiStatsInterval 输出腾讯云接口重试统计的间隔
+const apiStatsInterval = 10 * time.Minute
+
+// logAPIStats 定期输出腾讯云接口重试统计
+func (g *InstanceManagerGroup) logAPIStats(ctx context.Context) {
+	ticker := time.NewTicker(apiStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.client.Guard.LogStats()
+		}
+	}
 }
 
 // 运行 实例管理器
@@ -143,165 +226,245 @@ func (m *InstanceManager) Run(ctx context.Context) {
 	}
 }
 
-// syncDNSRecords 同步DNS记录
-func (m *InstanceManager) syncDNSRecords() (map[string]string, error) {
-	var instanceSet []*cvm.Instance
-	var err error
-	loopNum := 1
-	var currentIPs map[string]string // 声明变量但不初始化
-
-	// 获取实例列表
-	for {
-		instanceSet, err = m.Client.GetInsInfo(m.Cfg.TConfig.TagKey, m.Ibm.Name)
-		if err != nil {
-			m.Log.Errorf("获取实例信息失败: %v", err)
-			return nil, err
+// instanceIPs 返回实例的公网IP（A 记录）或IPv6地址（AAAA 记录）到实例ID的映射
+func instanceIPs(instances []*cvm.Instance, recordType string) map[string]string {
+	ips := make(map[string]string)
+	for _, ins := range instances {
+		addrs := ins.PublicIpAddresses
+		if recordType == tcloud.RecordAAAA {
+			// 弹性公网IPv6在 PublicIPv6Addresses 中，普通IPv6地址开通公网带宽后同样可以访问
+			addrs = append(append([]*string{}, ins.PublicIPv6Addresses...), ins.IPv6Addresses...)
 		}
-
-		if len(instanceSet) >= int(m.Ibm.AutoMaintenance.DesiredCount) {
-			// 收集当前实例的所有公网IP
-			currentIPs = make(map[string]string, 0)
-			for _, instance := range instanceSet {
-				for _, ip := range instance.PublicIpAddresses {
-					if ip != nil {
-						currentIPs[*ip] = *instance.InstanceId
-					}
-				}
+		for _, ip := range addrs {
+			if ip != nil && *ip != "" {
+				ips[*ip] = *ins.InstanceId
 			}
+		}
+	}
+	return ips
+}
 
-			if len(currentIPs) >= int(m.Ibm.AutoMaintenance.DesiredCount) {
-				m.Log.Debugf("已存在 %d 个腾讯云实例，开始检测并添加DNS记录", len(instanceSet))
-				break
-			}
+// publicIpAssigned 实例是否有公网IP：分配了公网带宽，或使用弹性公网IP模式（等待绑定弹性公网IP后再连接）
+func (m *InstanceManager) publicIpAssigned() bool {
+	return m.Ibm.Instance.Internet.BandwidthOut > 0 || m.Ibm.Instance.Internet.EIPMode()
+}
 
+// instanceAddress 返回用于连接实例的IP，优先公网IP
+// 实例不分配公网IP时使用私网IP（需经跳板机访问），否则等待公网IP分配完成
+func instanceAddress(instance *cvm.Instance, publicIpAssigned bool) string {
+	for _, ip := range instance.PublicIpAddresses {
+		if ip != nil && *ip != "" {
+			return *ip
 		}
-
-		if loopNum >= 10 {
-			return nil, fmt.Errorf("等待腾讯云实例创建超时....%s", "")
+	}
+	if publicIpAssigned {
+		return ""
+	}
+	for _, ip := range instance.PrivateIpAddresses {
+		if ip != nil && *ip != "" {
+			return *ip
 		}
+	}
+	return ""
+}
 
-		m.Log.Debugf("正在进行第 %d/%d 次等待腾讯云创建实例并分配公网完成...", loopNum, 10)
-		loopNum++
-
-		time.Sleep(time.Second * 5)
-
+// jumpHosts 根据配置生成跳板机列表，跳板机主机密钥以 地址 为键记录
+func (m *InstanceManager) jumpHosts() []utils.JumpHost {
+	jumpHosts := make([]utils.JumpHost, 0, len(m.Ibm.Instance.JumpHosts))
+	for _, jh := range m.Ibm.Instance.JumpHosts {
+		port := jh.Port
+		if port == 0 {
+			port = 22
+		}
+		jumpHosts = append(jumpHosts, utils.JumpHost{
+			Host:            jh.Host,
+			Port:            port,
+			Username:        jh.Username,
+			Password:        jh.Password,
+			PrivateKeyPath:  jh.PrivateKeyPath,
+			HostKeyCallback: m.HostKeys.Callback(fmt.Sprintf("%s:%d", jh.Host, port), jumpHostKeyOwner, jh.HostKeyFingerprints),
+		})
 	}
+	return jumpHosts
+}
 
-	// 获取DNS记录列表
-	dnsRecords, err := m.Client.GetDnsRecordList(&m.Ibm.DomainBinding.Domain, &m.Ibm.DomainBinding.SubDomain)
+// pruneInstanceRecords 删除已不存在实例（如竞价实例被回收）的主机密钥和初始化状态记录
+func (m *InstanceManager) pruneInstanceRecords(instanceSet []*cvm.Instance) {
+	alive := make(map[string]bool, len(instanceSet))
+	for _, instance := range instanceSet {
+		alive[*instance.InstanceId] = true
+	}
+	removed, err := m.HostKeys.Prune(m.Ibm.Name, alive)
+	if err != nil {
+		m.Log.Errorf("清理主机密钥记录失败: %v", err)
+	} else if len(removed) > 0 {
+		m.Log.Infof("已清理实例 %v 的主机密钥记录", removed)
+	}
+	removed, err = m.States.Prune(m.Ibm.Name, alive)
 	if err != nil {
-		m.Log.Errorf("获取DNS记录失败: %v", err)
+		m.Log.Errorf("清理初始化状态记录失败: %v", err)
+	} else if len(removed) > 0 {
+		m.Log.Infof("已清理实例 %v 的初始化状态记录", removed)
 	}
+}
 
-	// 删除无效DNS记录
-	for _, record := range dnsRecords {
-		if record.PublicIp != nil && currentIPs[*record.PublicIp] == "" {
-			m.Log.Infof("删除无效DNS记录: %s", *record.PublicIp)
-			if err := m.Client.RemoveDNSRecord(&m.Ibm.DomainBinding.Domain, record.RecordId); err != nil {
-				m.Log.Errorf("删除DNS记录失败: %v", err)
-			}
+// 初始化实例（根据配置上传文件并执行命令）
+// 实例标签记录已应用的初始化配置哈希，applied 中哈希与当前配置不同的实例重新执行初始化
+func (m *InstanceManager) InitIns(targets []*ProvisionTarget, hashes *PipelineHashes, applied map[string]string) error {
+	tagKey := m.Cfg.Other["execFlagTagKey"].(string)
+	provisioned := func(insId string) {
+		if err := m.Client.AddTag(tagKey, hashes.Pipeline, m.Region, m.Cfg.Uin, insId); err != nil {
+			m.Log.Errorf("添加标签失败: %v", err)
 		}
 	}
 
-	// 添加新DNS记录
-	validRecords := 0
-	for _, record := range dnsRecords {
-		if record.PublicIp != nil && currentIPs[*record.PublicIp] != "" {
-			validRecords++
+	fresh := make([]*ProvisionTarget, 0, len(targets))
+	updates := make([]*ProvisionTarget, 0)
+	for _, target := range targets {
+		insId := *target.Instance.InstanceId
+		switch applied[insId] {
+		case hashes.Pipeline:
+			m.Log.Debugf("实例 %s 初始化配置未变化，跳过", insId)
+		case "":
+			fresh = append(fresh, target)
+		case legacyExecTagValue:
+			// 初始化步骤可能不可重复执行，不重新初始化，只记录步骤状态并更新标签
+			m.Log.Warnf("实例 %s 由旧版本初始化（%s: %s），视为已应用当前初始化配置 %s，不重新初始化", insId, tagKey, legacyExecTagValue, hashes.Pipeline)
+			m.adoptSteps(insId, hashes)
+			provisioned(insId)
+		default:
+			m.Log.Infof("实例 %s 初始化配置已变化（%s -> %s），重新初始化", insId, applied[insId], hashes.Pipeline)
+			updates = append(updates, target)
 		}
 	}
-	if validRecords < m.Ibm.DomainBinding.PraseNum {
-		needAdd := m.Ibm.DomainBinding.PraseNum - validRecords
-		m.Log.Infof("可以添加 %d 条DNS记录", needAdd)
+	if len(fresh)+len(updates) == 0 {
+		return nil
+	}
 
-		added := 0
-		for ip := range currentIPs {
-			if added >= needAdd {
-				break
-			}
+	parallel := m.Cfg.Provision.MaxParallel
+	if parallel <= 0 {
+		parallel = utils.DefaultProvisionMaxParallel
+	}
 
-			// 检查是否已存在该IP的记录
-			exists := false
-			for _, record := range dnsRecords {
-				if record.PublicIp != nil && *record.PublicIp == ip {
-					exists = true
-					break
-				}
-			}
+	pending := append(fresh, updates...)
+	errs := m.provisionAll(fresh, hashes, parallel, false, provisioned)
+	if m.Cfg.Provision.Rolling {
+		// 滚动更新：已初始化的实例逐个重新初始化，失败后停止
+		errs = append(errs, m.provisionAll(updates, hashes, 1, true, provisioned)...)
+	} else {
+		errs = append(errs, m.provisionAll(updates, hashes, parallel, false, provisioned)...)
+	}
 
-			if !exists {
-				ipCopy := ip
-				m.Log.Infof("添加DNS记录: %s", ip)
-				if err := m.Client.AddDNSRecord(&tcloud.DnsRecordP{
-					Domain:     &m.Ibm.DomainBinding.Domain,
-					SubDomain:  &m.Ibm.DomainBinding.SubDomain,
-					RecordType: &m.Ibm.DomainBinding.RecordType,
-					RecordLine: &m.Ibm.DomainBinding.RecordLine,
-					Value:      &ipCopy,
-					TTL:        &m.Ibm.DomainBinding.TTL,
-				}); err != nil {
-					m.Log.Errorf("添加DNS记录失败: %v", err)
-				} else {
-					added++
-				}
-			}
+	succeeded := make([]string, 0, len(pending))
+	failed := make([]string, 0)
+	for i, target := range pending {
+		if errs[i] != nil {
+			failed = append(failed, *target.Instance.InstanceId)
+			m.Log.WithField("实例ID", *target.Instance.InstanceId).Errorf("实例初始化失败: %v", errs[i])
+			continue
 		}
+		succeeded = append(succeeded, *target.Instance.InstanceId)
 	}
+	m.Log.WithFields(logrus.Fields{
+		"实例管理器": m.Ibm.Name,
+		"成功":    succeeded,
+		"失败":    failed,
+	}).Info("实例初始化结果")
 
-	return currentIPs, nil
+	if len(failed) > 0 {
+		return fmt.Errorf("%d/%d 个实例初始化失败: %s", len(failed), len(pending), strings.Join(failed, ", "))
+	}
+	return nil
 }
 
-// 初始化实例（根据配置上传文件并执行命令）
-func (m *InstanceManager) InitIns(ips map[string]string, a *tcloud.AClient, ibm *utils.InstanceBindingManager, region, uin string) error {
-	rows, err := a.GetTag(m.Cfg.Other["execFlagTagKey"].(string), "true")
-	tagIns := make(map[string]bool, 0)
-	if err == nil {
-		for _, res := range rows {
-			if *res.ServiceType == "cvm" && *res.ResourcePrefix == "instance" && *res.ResourceRegion == region {
-				tagIns[*res.ResourceId] = true
-			}
+// adoptSteps 将实例的 run_once 步骤记录为已按当前配置执行成功，之后只重新执行配置变化的步骤
+func (m *InstanceManager) adoptSteps(instanceId string, hashes *PipelineHashes) {
+	index, err := m.States.Index(instanceId, m.Ibm.Name)
+	if err != nil {
+		m.Log.Errorf("分配实例序号失败: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, step := range m.pipeline() {
+		hash := instanceStepHash(hashes.Steps[step.Name], index)
+		if step.Run == utils.RunAlways || m.States.StepSucceeded(instanceId, step.Name, hash) {
+			continue
+		}
+		status := &utils.StepStatus{
+			Name:       step.Name,
+			Type:       step.Type,
+			Status:     utils.StepStatusSuccess,
+			Hash:       hash,
+			StartedAt:  now,
+			FinishedAt: now,
+		}
+		if err := m.States.SetStep(instanceId, m.Ibm.Name, status); err != nil {
+			m.Log.Errorf("记录步骤状态失败: %v", err)
 		}
 	}
+}
 
-	for ip, insId := range ips {
-		if !tagIns[insId] {
-			// m.Log, ibm.Feature.CommandExec.LogFile.
-			ssh, err := utils.NewSClient(ip, 22, ibm.Instance.UserConfig.Username, ibm.Instance.UserConfig.Password, m.Log)
-			if err != nil {
-				return err
-			}
+// legacyExecTagValue 旧版本初始化完成后设置的标签值，不包含初始化配置哈希
+const legacyExecTagValue = "true"
 
-			defer ssh.Close()
-			if ibm.Feature.FileTransfer.Enabled {
-				m.Log.Info("开始上传文件")
-				err = ssh.Upload(ibm.Feature.FileTransfer.LocalPath, ibm.Feature.FileTransfer.RemotePath)
-				if err != nil {
-					return err
-				}
-			}
-
-			if ibm.Feature.CommandExec.Enabled {
-				m.Log.Info("开始执行命令")
-				_, err = ssh.ExecCommand(ibm.Feature.CommandExec.Command)
-				if err != nil {
-					return err
+// appliedHashes 查询地域内实例标签记录的已应用初始化配置哈希，返回 实例ID -> 哈希
+func appliedHashes(a *tcloud.AClient, tagKey, region string) (map[string]string, error) {
+	rows, err := a.GetTag(tagKey, "")
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[string]string, len(rows))
+	for _, res := range rows {
+		if *res.ServiceType == "cvm" && *res.ResourcePrefix == "instance" && *res.ResourceRegion == region {
+			for _, t := range res.Tags {
+				if utils.StringValue(t.TagKey) == tagKey {
+					applied[*res.ResourceId] = utils.StringValue(t.TagValue)
 				}
 			}
-
-			err = a.AddTag(m.Cfg.Other["execFlagTagKey"].(string), "true", region, uin, insId)
-			if err != nil {
-				m.Log.Errorf("添加标签失败: %v", err)
-			}
-		} else {
-			m.Log.Infof("实例 %s 已执行命令，跳过", insId)
 		}
-
 	}
+	return applied, nil
+}
 
-	return nil
+// provisionAll 以最多 parallel 个并发初始化实例，单个实例失败不影响其他实例，返回与 targets 对应的错误
+// stopOnError 为 true 时某个实例失败后不再开始后续实例
+func (m *InstanceManager) provisionAll(targets []*ProvisionTarget, hashes *PipelineHashes, parallel int, stopOnError bool, done func(insId string)) []error {
+	errs := make([]error, len(targets))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stopped := false
+	for i, target := range targets {
+		sem <- struct{}{}
+		mu.Lock()
+		if stopped {
+			mu.Unlock()
+			<-sem
+			errs[i] = fmt.Errorf("前序实例滚动更新失败，未执行")
+			continue
+		}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(i int, target *ProvisionTarget) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := m.provisionInstance(target, hashes); err != nil {
+				errs[i] = err
+				mu.Lock()
+				stopped = stopOnError
+				mu.Unlock()
+				return
+			}
+			done(*target.Instance.InstanceId)
+		}(i, target)
+	}
+	wg.Wait()
+	return errs
 }
 
-// checkIns 检查并维护实例数量到期望状态
+// checkIns 执行一次调和，将实例管理器的资源维护到期望状态
 func (m *InstanceManager) checkIns() {
 	fields := logrus.Fields{
 		"实例管理器": m.Ibm.Name,
@@ -310,57 +473,25 @@ func (m *InstanceManager) checkIns() {
 	}
 	m.Log.WithFields(fields).Debug("开始检查实例状态")
 
-	// 获取当前实例数量
-	desiredCount := m.Ibm.AutoMaintenance.DesiredCount
-	currentCount, err := m.Client.GetInstanceCount(m.Cfg.TConfig.TagKey, m.Ibm.Name)
+	p, err := m.plan()
 	if err != nil {
-		m.Log.WithFields(fields).Errorf("获取实例数量失败: %v", err)
+		m.Log.WithFields(fields).Errorf("计算变更失败: %v", err)
 		return
 	}
+	for _, act := range p.Actions {
+		m.Log.WithFields(logrus.Fields{
+			"资源":   act.Resource,
+			"资源ID": act.ID,
+			"名称":   act.Name,
+		}).Debugf("计划变更 %s: %s", act.Type, act.Detail)
+	}
+	for _, warning := range p.Warnings {
+		m.Log.WithFields(fields).Warn(warning)
+	}
 
-	m.Log.WithFields(logrus.Fields{
-		"当前实例数量": currentCount,
-		"指定实例数量": desiredCount,
-	}).Info("实例数量检查")
-
-	switch {
-	case currentCount < desiredCount:
-		// 实例不足，创建新实例
-		m.Log.WithField("count", desiredCount-currentCount).Info("需要创建新实例")
-		m.InsCfg.InstanceCount = desiredCount - currentCount
-		if _, err := m.Client.RunInstances(m.InsCfg); err != nil {
-			m.Log.WithFields(fields).Errorf("创建实例失败: %v", err)
-			return
-		}
-
-		// 同步DNS记录
-		if ips, err := m.syncDNSRecords(); err != nil {
-			m.Log.WithFields(fields).Errorf("同步DNS记录失败: %v", err)
-		} else if err := m.InitIns(ips, m.Client, m.Ibm, m.Region, m.Cfg.Uin); err != nil {
-			m.Log.WithFields(fields).Errorf("初始化实例失败: %v", err)
-		} else {
-			m.Log.Info("实例创建和初始化完成")
-		}
-
-	case currentCount > desiredCount && m.Ibm.AutoMaintenance.AutoRemove:
-		// 实例过多，删除多余实例
-		removeCount := currentCount - desiredCount
-		m.Log.WithField("count", removeCount).Info("删除多余实例")
-		if err := m.Client.RandomDelete(int64(removeCount)); err != nil {
-			m.Log.WithFields(fields).Errorf("删除实例失败: %v", err)
-		}
-
-	default:
-		// 实例数量正常，检查初始化状态
-		if m.Ibm.Feature.FileTransfer.Enabled || m.Ibm.Feature.CommandExec.Enabled {
-			m.Log.Debug("检查实例初始化状态")
-			if ips, err := m.syncDNSRecords(); err != nil {
-				m.Log.WithFields(fields).Errorf("同步DNS记录失败: %v", err)
-			} else if err := m.InitIns(ips, m.Client, m.Ibm, m.Region, m.Cfg.Uin); err != nil {
-				m.Log.WithFields(fields).Errorf("初始化实例失败: %v", err)
-			} else {
-				m.Log.Debug("实例初始化检查完成")
-			}
-		}
+	if err := p.Apply(); err != nil {
+		m.Log.WithFields(fields).Errorf("执行变更失败: %v", err)
+		return
 	}
+	m.Log.WithFields(fields).Debug("实例检查完成")
 }
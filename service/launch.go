@@ -0,0 +1,140 @@
+package service
+
+import (
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+)
+
+// launchConfirmTimeout 创建请求超过该时间仍未确认时放弃跟踪，已创建的实例会通过标签计入实例数量
+const launchConfirmTimeout = time.Hour
+
+// 创建失败或已销毁的实例状态，不计入待确认实例
+var deadInstanceStates = map[string]bool{
+	"LAUNCH_FAILED": true,
+	"TERMINATING":   true,
+	"SHUTDOWN":      true,
+}
+
+// launch 发起创建 count 个实例的请求，请求先持久化再调用接口，结果未知时保留记录由下次检查确认
+func (m *InstanceManager) launch(count int64) error {
+	launch, err := m.Launches.Begin(m.Ibm.Name, m.Zone, count)
+	if err != nil {
+		return err
+	}
+	return m.runLaunch(launch)
+}
+
+// runLaunch 使用创建请求的 ClientToken 调用 RunInstances，相同 ClientToken 重复调用不会重复创建实例
+func (m *InstanceManager) runLaunch(launch *utils.PendingLaunch) error {
+	insCfg := *m.InsCfg
+	insCfg.InstanceCount = launch.Count
+	insCfg.ClientToken = launch.ClientToken
+
+	ids, err := m.Client.RunInstances(&insCfg)
+	if err != nil {
+		if !tcloud.OutcomeUnknown(err) {
+			// 请求确定失败，不会创建实例
+			if derr := m.Launches.Done(launch.ClientToken); derr != nil {
+				m.Log.Errorf("删除实例创建请求记录失败: %v", derr)
+			}
+		}
+		return err
+	}
+	launch.InstanceIds = common.StringValues(ids)
+	return m.Launches.SetInstances(launch.ClientToken, launch.InstanceIds)
+}
+
+// reconcileLaunches 确认待确认的创建请求，返回已创建但尚未通过标签计入实例数量的实例数
+// 结果未知的请求使用相同 ClientToken 重新请求，仍无法确认时返回错误，此时不应继续创建实例
+func (m *InstanceManager) reconcileLaunches() (int64, error) {
+	launches := m.Launches.Pending(m.Ibm.Name)
+	if len(launches) == 0 {
+		return 0, nil
+	}
+
+	instances, err := m.Client.GetInsInfo(m.Cfg.TConfig.TagKey, m.Ibm.Name)
+	if err != nil {
+		return 0, err
+	}
+	visible := make(map[string]bool, len(instances))
+	for _, ins := range instances {
+		visible[utils.StringValue(ins.InstanceId)] = true
+	}
+
+	var pending int64
+	for _, launch := range launches {
+		log := m.Log.WithFields(logrus.Fields{
+			"实例管理器":       m.Ibm.Name,
+			"可用区":         launch.Zone,
+			"ClientToken": launch.ClientToken,
+		})
+		expired := time.Since(launch.CreatedAt) > launchConfirmTimeout
+
+		if len(launch.InstanceIds) == 0 {
+			if expired {
+				log.Warn("实例创建请求长时间未确认，停止跟踪")
+				m.finishLaunch(launch)
+				continue
+			}
+			log.Info("上次实例创建请求结果未知，使用相同 ClientToken 重新请求")
+			if err := m.runLaunch(launch); err != nil {
+				if tcloud.OutcomeUnknown(err) {
+					return pending, fmt.Errorf("确认实例创建请求 %s 失败: %v", launch.ClientToken, err)
+				}
+				log.Errorf("实例创建请求失败: %v", err)
+				continue
+			}
+		}
+
+		missing := make([]string, 0)
+		for _, id := range launch.InstanceIds {
+			if !visible[id] {
+				missing = append(missing, id)
+			}
+		}
+		if len(missing) == 0 || expired {
+			log.WithField("实例ID", launch.InstanceIds).Debug("实例创建请求已确认")
+			m.finishLaunch(launch)
+			continue
+		}
+
+		// 已创建但尚未出现在标签查询中的实例
+		alive, err := m.countAlive(missing)
+		if err != nil {
+			return pending, err
+		}
+		if alive == 0 {
+			m.finishLaunch(launch)
+			continue
+		}
+		log.WithField("待确认实例数", alive).Info("实例已创建，等待计入实例数量")
+		pending += alive
+	}
+	return pending, nil
+}
+
+// countAlive 返回指定实例中未创建失败或销毁的实例数
+func (m *InstanceManager) countAlive(instanceIds []string) (int64, error) {
+	created, err := m.Client.GetInstancesByIds(instanceIds)
+	if err != nil {
+		return 0, err
+	}
+	alive := int64(0)
+	for _, ins := range created {
+		if !deadInstanceStates[utils.StringValue(ins.InstanceState)] {
+			alive++
+		}
+	}
+	return alive, nil
+}
+
+func (m *InstanceManager) finishLaunch(launch *utils.PendingLaunch) {
+	if err := m.Launches.Done(launch.ClientToken); err != nil {
+		m.Log.Errorf("删除实例创建请求记录失败: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 变更类型
+const (
+	ActionCreate = "create"
+	ActionDelete = "delete"
+	ActionUpdate = "update"
+)
+
+// 资源类型，按依赖顺序排列
+const (
+	ResourceVpc               = "vpc"
+	ResourceSubnet            = "subnet"
+	ResourceSecurityGroup     = "security_group"
+	ResourceSecurityGroupRule = "security_group_rule"
+	ResourceInstance          = "instance"
+	ResourceDNSRecord         = "dns_record"
+	ResourceHostRecord        = "host_record"
+	ResourceEip               = "eip"
+	ResourceTag               = "tag"
+)
+
+// Action 一次调和将对单个资源执行的变更
+type Action struct {
+	Type     string // create/delete/update
+	Resource string // 资源类型
+	ID       string // 资源ID，创建时为空
+	Name     string // 资源名称或域名
+	Value    string // DNS记录值
+	Count    int64  // 创建的实例数量
+	Detail   string // 变更说明
+}
+
+// Plan 单个实例管理器的变更计划，由 Apply 按依赖顺序执行
+type Plan struct {
+	Manager  string
+	Region   string
+	Zone     string
+	Actions  []Action
+	Warnings []string
+
+	m      *InstanceManager
+	desire *desiredState
+	actual *actualState
+}
+
+func (p *Plan) add(a Action) {
+	p.Actions = append(p.Actions, a)
+}
+
+func (p *Plan) warn(format string, args ...interface{}) {
+	p.Warnings = append(p.Warnings, fmt.Sprintf(format, args...))
+}
+
+// filter 返回指定资源类型的变更
+func (p *Plan) filter(resources ...string) []Action {
+	actions := make([]Action, 0)
+	for _, a := range p.Actions {
+		for _, r := range resources {
+			if a.Resource == r {
+				actions = append(actions, a)
+				break
+			}
+		}
+	}
+	return actions
+}
+
+// Count 返回各变更类型的数量
+func (p *Plan) Count() (create, update, remove int) {
+	for _, a := range p.Actions {
+		switch a.Type {
+		case ActionCreate:
+			create++
+		case ActionUpdate:
+			update++
+		case ActionDelete:
+			remove++
+		}
+	}
+	return create, update, remove
+}
+
+var actionMarks = map[string]string{
+	ActionCreate: "+",
+	ActionDelete: "-",
+	ActionUpdate: "~",
+}
+
+// Print 以 diff 形式输出变更计划
+func (p *Plan) Print(w io.Writer) {
+	fmt.Fprintf(w, "实例管理器 %s（%s / %s）\n", p.Manager, p.Region, p.Zone)
+	if len(p.Actions) == 0 {
+		fmt.Fprintln(w, "  无变更")
+	}
+	for _, a := range p.Actions {
+		target := a.ID
+		if a.Name != "" {
+			target = strings.TrimSpace(a.Name + " " + a.ID)
+		}
+		fmt.Fprintf(w, "  %s %-15s %-30s %s\n", actionMarks[a.Type], a.Resource, target, a.Detail)
+	}
+	for _, warning := range p.Warnings {
+		fmt.Fprintf(w, "  ! %s\n", warning)
+	}
+	create, update, remove := p.Count()
+	fmt.Fprintf(w, "  创建 %d，更新 %d，删除 %d\n\n", create, update, remove)
+}
+
+// Apply 按依赖顺序执行变更计划
+func (p *Plan) Apply() error {
+	return p.m.apply(p)
+}
+
+// BuildPlans 计算所有开启自动维护的实例管理器下一次调和将执行的变更，只调用查询接口
+// dryRun 为 true 时调用 RunInstances 预检创建参数和库存
+func BuildPlans(c *tcloud.Client, cfg *utils.Config, dryRun bool) ([]*Plan, error) {
+	managers, err := newInstanceManagers(c, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	plans := make([]*Plan, 0, len(managers))
+	for _, m := range managers {
+		plan, err := m.plan()
+		if err != nil {
+			return nil, fmt.Errorf("实例管理器 %s 计算变更失败: %v", m.Ibm.Name, err)
+		}
+		if dryRun {
+			m.planDryRun(plan)
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// planDryRun 使用 RunInstances 预检创建参数和库存，私有网络、子网或安全组尚未创建时跳过
+func (m *InstanceManager) planDryRun(p *Plan) {
+	a := p.actual
+	sid := a.securityGroupId
+	if a.vpcId == "" || a.subnetId == "" || sid == "" {
+		p.warn("私有网络、子网或安全组尚未创建，跳过创建实例预检")
+		return
+	}
+	if p.desire.vpc.EnableIPv6 && a.subnetIpv6 == "" {
+		p.warn("子网尚未分配IPv6网段，跳过创建实例预检")
+		return
+	}
+	insCfg := *m.InsCfg
+	insCfg.VpcId = a.vpcId
+	insCfg.SubnetId = a.subnetId
+	insCfg.SecurityGroupIds = []*string{&sid}
+	insCfg.InstanceCount = max(p.desire.count, 1)
+	if err := m.Client.DryRunInstances(&insCfg); err != nil {
+		p.warn("创建实例预检未通过: %v", err)
+		return
+	}
+	p.warn("创建实例预检通过（%d 个 %s）", insCfg.InstanceCount, insCfg.InstanceType)
+}
@@ -0,0 +1,589 @@
+package service
+
+import (
+	"context"
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	cvm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm/v20170312"
+)
+
+const (
+	defaultStepTimeout = 600 * time.Second // 步骤默认超时时间
+	defaultRetryDelay  = 5 * time.Second   // 步骤重试默认间隔
+	waitPollInterval   = 3 * time.Second   // 等待类步骤的轮询间隔
+	rebootSettleTime   = 15 * time.Second  // 重启后开始重连前的等待时间
+)
+
+// ProvisionTarget 待初始化的实例
+type ProvisionTarget struct {
+	Ip       string // 连接实例使用的IP
+	Instance *cvm.Instance
+}
+
+// newProvisionTargets 按创建时间排序实例并生成待初始化列表，跳过暂无可连接IP的实例
+func newProvisionTargets(instanceSet []*cvm.Instance, publicIpAssigned bool) []*ProvisionTarget {
+	sorted := make([]*cvm.Instance, len(instanceSet))
+	copy(sorted, instanceSet)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ci, cj := utils.StringValue(sorted[i].CreatedTime), utils.StringValue(sorted[j].CreatedTime)
+		if ci != cj {
+			return ci < cj
+		}
+		return *sorted[i].InstanceId < *sorted[j].InstanceId
+	})
+
+	targets := make([]*ProvisionTarget, 0, len(sorted))
+	for _, instance := range sorted {
+		ip := instanceAddress(instance, publicIpAssigned)
+		if ip == "" {
+			continue
+		}
+		targets = append(targets, &ProvisionTarget{
+			Ip:       ip,
+			Instance: instance,
+		})
+	}
+	return targets
+}
+
+// TemplateVars 模板可使用的实例变量
+type TemplateVars struct {
+	InstanceId   string
+	InstanceName string
+	Ip           string // 连接实例使用的IP
+	PublicIp     string
+	PublicIpv6   string // 实例的IPv6地址，未开启IPv6时为空
+	PrivateIp    string
+	Zone         string
+	Region       string
+	Domain       string // 第一个域名绑定的完整域名，如 frp.test.com
+	Manager      string // 实例管理器名称
+	Index        int    // 实例在实例管理器中的序号，从1开始
+	Secrets      map[string]string
+	Domains      []string // 全部域名绑定的完整域名
+}
+
+// provisioner 按顺序在单个实例上执行初始化步骤
+type provisioner struct {
+	m          *InstanceManager
+	ip         string
+	instanceId string
+	vars       TemplateVars
+	client     utils.Executor
+	hostKeys   []string // 通过 TAT 读取的实例主机密钥指纹
+	log        *logrus.Entry
+	runLog     *utils.ProvisionLog // 本次初始化的实例日志
+}
+
+// provisionInstance 在实例上执行初始化流水线，记录每个步骤的状态，任一步骤失败即停止
+// 每次初始化的步骤和命令输出单独记录到实例初始化日志
+func (m *InstanceManager) provisionInstance(target *ProvisionTarget, hashes *PipelineHashes) (err error) {
+	instanceId := *target.Instance.InstanceId
+	vars, err := m.templateVars(target)
+	if err != nil {
+		return err
+	}
+
+	runLog, err := utils.NewProvisionLog(m.Cfg.Provision.LogDir, instanceId)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		runLog.Close(err)
+	}()
+
+	p := &provisioner{
+		m:          m,
+		ip:         target.Ip,
+		instanceId: instanceId,
+		vars:       vars,
+		runLog:     runLog,
+		log: m.Log.WithFields(logrus.Fields{
+			"实例管理器": m.Ibm.Name,
+			"实例ID":  instanceId,
+		}),
+	}
+	defer p.close()
+
+	ready := false
+	for _, step := range m.pipeline() {
+		status := &utils.StepStatus{
+			Name:      step.Name,
+			Type:      step.Type,
+			Hash:      instanceStepHash(hashes.Steps[step.Name], vars.Index),
+			StartedAt: time.Now(),
+		}
+
+		// run_once 步骤已按当前配置执行成功时跳过，配置变化后重新执行
+		if step.Run != utils.RunAlways && m.States.StepSucceeded(instanceId, step.Name, status.Hash) {
+			p.log.WithField("步骤", step.Name).Info("步骤已执行成功，跳过")
+			continue
+		}
+
+		p.log.WithFields(logrus.Fields{
+			"步骤": step.Name,
+			"类型": step.Type,
+		}).Info("开始执行初始化步骤")
+		// 首个需要执行的步骤前等待SSH就绪
+		if !ready {
+			if err := p.ensureReady(); err != nil {
+				runLog.Note(err.Error())
+				return fmt.Errorf("实例 %s SSH未就绪: %v", instanceId, err)
+			}
+			ready = true
+		}
+
+		runLog.StepStart(step.Name, step.Type)
+		err := p.runWithRetry(step, status)
+
+		status.FinishedAt = time.Now()
+		runLog.StepEnd(status.FinishedAt.Sub(status.StartedAt), err)
+		if err != nil {
+			status.Status = utils.StepStatusFailed
+			status.Error = err.Error()
+		} else {
+			status.Status = utils.StepStatusSuccess
+		}
+		if serr := m.States.SetStep(instanceId, m.Ibm.Name, status); serr != nil {
+			p.log.Errorf("记录步骤状态失败: %v", serr)
+		}
+
+		if err != nil {
+			return fmt.Errorf("实例 %s 步骤 %s 执行失败: %v", instanceId, step.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ensureReady 在配置的超时时间内等待实例SSH就绪
+func (p *provisioner) ensureReady() error {
+	timeout := utils.DefaultSSHWaitTimeout
+	if p.m.Cfg.Provision.SSHWaitTimeout > 0 {
+		timeout = time.Duration(p.m.Cfg.Provision.SSHWaitTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.waitReady(ctx)
+}
+
+// runWithRetry 按配置的重试次数执行步骤
+func (p *provisioner) runWithRetry(step utils.StepConfig, status *utils.StepStatus) error {
+	timeout := defaultStepTimeout
+	if step.Timeout > 0 {
+		timeout = time.Duration(step.Timeout) * time.Second
+	}
+	delay := defaultRetryDelay
+	if step.RetryDelay > 0 {
+		delay = time.Duration(step.RetryDelay) * time.Second
+	}
+
+	var err error
+	for attempt := 1; attempt <= step.Retries+1; attempt++ {
+		status.Attempts = attempt
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = p.runStep(ctx, step)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if attempt <= step.Retries {
+			p.log.WithFields(logrus.Fields{
+				"步骤":   step.Name,
+				"次数":   attempt,
+				"错误信息": err,
+			}).Warnf("步骤执行失败，%v 后重试", delay)
+			p.runLog.Note(fmt.Sprintf("第 %d 次执行失败，%v 后重试: %v", attempt, delay, err))
+			time.Sleep(delay)
+		}
+	}
+	return err
+}
+
+// runStep 执行单个步骤，超时后关闭连接以中断正在执行的操作（TAT 执行器同时取消正在执行的命令）
+func (p *provisioner) runStep(ctx context.Context, step utils.StepConfig) error {
+	if step.Type == utils.StepRebootAndWait {
+		return p.rebootAndWait(ctx, step)
+	}
+
+	if err := p.connect(); err != nil {
+		return err
+	}
+
+	client := p.client
+	done := make(chan error, 1)
+	go func() {
+		done <- p.execStep(ctx, client, step)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		p.close()
+		<-done
+		return fmt.Errorf("步骤执行超时: %v", ctx.Err())
+	}
+}
+
+// execStep 根据步骤类型执行具体操作
+func (p *provisioner) execStep(ctx context.Context, client utils.Executor, step utils.StepConfig) error {
+	switch step.Type {
+	case utils.StepUpload:
+		opts := utils.UploadOptions{
+			Transfer:      step.Transfer,
+			Excludes:      step.Excludes,
+			PreserveOwner: step.PreserveOwner,
+		}
+		if step.Template {
+			opts.Render = utils.TemplateRenderer(p.vars, step.TemplatePatterns)
+		}
+		return client.UploadWithOptions(step.LocalPath, step.RemotePath, opts)
+
+	case utils.StepDownload:
+		// 每个实例下载到独立的本地目录，避免相互覆盖
+		return client.Download(step.RemotePath, filepath.Join(step.LocalPath, p.instanceId))
+
+	case utils.StepExec:
+		return p.runCommand(client, step, step.Command)
+
+	case utils.StepScript:
+		remoteDir := step.RemotePath
+		if remoteDir == "" {
+			remoteDir = "/tmp"
+		}
+		if err := client.UploadWithOptions(step.LocalPath, remoteDir, utils.UploadOptions{}); err != nil {
+			return err
+		}
+		interpreter := step.Command
+		if interpreter == "" {
+			interpreter = "sh"
+		}
+		return p.runCommand(client, step, interpreter+" "+path.Join(remoteDir, filepath.Base(step.LocalPath)))
+
+	case utils.StepTemplate:
+		content, err := utils.RenderTemplateFile(step.LocalPath, p.vars)
+		if err != nil {
+			return err
+		}
+		return client.UploadBytes(content, step.RemotePath)
+
+	case utils.StepWaitForPort:
+		host := step.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		return waitUntil(ctx, func() error {
+			return client.CheckRemotePort(host, step.Port)
+		})
+
+	case utils.StepWaitForFile:
+		return waitUntil(ctx, func() error {
+			exists, err := client.RemoteExists(step.RemotePath)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("文件 %s 不存在", step.RemotePath)
+			}
+			return nil
+		})
+
+	default:
+		return fmt.Errorf("不支持的步骤类型: %s", step.Type)
+	}
+}
+
+// runCommand 执行命令并按步骤配置的断言（预期退出码、标准输出匹配）判断是否成功
+func (p *provisioner) runCommand(client utils.Executor, step utils.StepConfig, command string) error {
+	command, opts, err := p.wrapCommand(step, command)
+	if err != nil {
+		return err
+	}
+	result, err := client.RunWithOptions(command, opts)
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("命令结束，退出码 %d，耗时 %.3fs", result.ExitCode, result.Duration.Seconds())
+	if result.Signal != "" {
+		msg += "，信号 " + result.Signal
+	}
+	p.runLog.Note(msg)
+	return checkResult(step, result)
+}
+
+// checkResult 校验命令执行结果，未配置预期退出码时只接受0
+func checkResult(step utils.StepConfig, result *utils.ExecResult) error {
+	if result.Signal != "" {
+		return result.Err()
+	}
+
+	expect := step.ExpectExitCodes
+	if len(expect) == 0 {
+		expect = []int{0}
+	}
+	if !slices.Contains(expect, result.ExitCode) {
+		return fmt.Errorf("%w 不在预期 %v 中, 输出: %s", &utils.ExitCodeError{Code: result.ExitCode}, expect, result.Output)
+	}
+
+	if step.StdoutMatch != "" {
+		re, err := regexp.Compile(step.StdoutMatch)
+		if err != nil {
+			return fmt.Errorf("stdout_match 正则表达式无效: %v", err)
+		}
+		if !re.MatchString(result.Stdout) {
+			return fmt.Errorf("标准输出不匹配 %q", step.StdoutMatch)
+		}
+	}
+	if step.StdoutNotMatch != "" {
+		re, err := regexp.Compile(step.StdoutNotMatch)
+		if err != nil {
+			return fmt.Errorf("stdout_not_match 正则表达式无效: %v", err)
+		}
+		if loc := re.FindString(result.Stdout); loc != "" {
+			return fmt.Errorf("标准输出匹配了 %q: %s", step.StdoutNotMatch, loc)
+		}
+	}
+	return nil
+}
+
+// rebootAndWait 重启实例，等待SSH重新可连接
+func (p *provisioner) rebootAndWait(ctx context.Context, step utils.StepConfig) error {
+	if err := p.connect(); err != nil {
+		return err
+	}
+
+	command := step.Command
+	if command == "" {
+		// 后台延迟重启，保证命令能正常返回
+		command = "nohup sh -c 'sleep 2; reboot' > /dev/null 2>&1 &"
+	}
+	command, opts, err := p.wrapCommand(step, command)
+	if err != nil {
+		return err
+	}
+	// 重启会断开连接，忽略命令返回的错误
+	if _, err := p.client.RunWithOptions(command, opts); err != nil {
+		p.log.Debugf("重启命令返回: %v", err)
+	}
+	p.close()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("等待实例重启超时: %v", ctx.Err())
+	case <-time.After(rebootSettleTime):
+	}
+
+	// 重新连接，确认SSH已恢复
+	return p.waitReady(ctx)
+}
+
+// connect 建立到实例的连接，已连接时直接返回
+func (p *provisioner) connect() error {
+	if p.client != nil {
+		return nil
+	}
+	ibm := p.m.Ibm
+	if ibm.Feature.Executor == utils.ExecutorTAT {
+		p.client = tcloud.NewTatExecutor(p.m.Client, p.instanceId, ibm.Instance.UserConfig.Username, p.m.Log)
+		p.client.SetOutput(p.runLog.Stdout(), p.runLog.Stderr())
+		return nil
+	}
+	client, err := p.dialSSH()
+	if err != nil {
+		return err
+	}
+	p.client = client
+	return nil
+}
+
+// dialSSH 建立到实例的SSH连接
+func (p *provisioner) dialSSH() (*utils.SClient, error) {
+	ibm := p.m.Ibm
+	fingerprints := ibm.Instance.UserConfig.HostKeyFingerprints
+	if ibm.Instance.UserConfig.HostKeyVerify == utils.HostKeyVerifyTAT && !p.m.HostKeys.Known(p.instanceId) {
+		var err error
+		if fingerprints, err = p.readHostKeys(); err != nil {
+			return nil, err
+		}
+	}
+	hostKeyCallback := p.m.HostKeys.Callback(p.instanceId, ibm.Name, fingerprints)
+	client, err := utils.NewSClient(p.ip, 22, ibm.Instance.UserConfig.Username, ibm.Instance.UserConfig.Password, hostKeyCallback, p.m.Log, p.m.jumpHosts()...)
+	if err != nil {
+		return nil, err
+	}
+	client.SetOutput(p.runLog.Stdout(), p.runLog.Stderr())
+	return client, nil
+}
+
+// readHostKeys 首次连接前通过 TAT 读取实例的主机公钥指纹，用于校验SSH连接的主机密钥
+// TAT 经云 API 认证下发命令，不经过SSH连接，可以在首次连接时发现中间人；读取成功后在本次初始化中缓存
+func (p *provisioner) readHostKeys() ([]string, error) {
+	if p.hostKeys != nil {
+		return p.hostKeys, nil
+	}
+	tat := tcloud.NewTatExecutor(p.m.Client, p.instanceId, "", p.m.Log)
+	defer tat.Close()
+	output, err := tat.ExecCommand(utils.HostKeyReadCommand)
+	if err != nil {
+		return nil, fmt.Errorf("通过TAT读取实例主机公钥失败: %v", err)
+	}
+	fingerprints, err := utils.ParseHostKeyFingerprints(output)
+	if err != nil {
+		return nil, err
+	}
+	p.log.WithField("指纹", strings.Join(fingerprints, ",")).Info("已通过TAT读取实例主机密钥指纹")
+	p.hostKeys = fingerprints
+	return fingerprints, nil
+}
+
+// waitReady 等待实例SSH就绪（TCP、banner、认证）并保留连接，TAT 执行器无需等待
+func (p *provisioner) waitReady(ctx context.Context) error {
+	if p.client != nil || p.m.Ibm.Feature.Executor == utils.ExecutorTAT {
+		return nil
+	}
+	client, err := utils.WaitForSSH(ctx, net.JoinHostPort(p.ip, "22"), utils.SSHWaitOptions{
+		ProbeTCP: len(p.m.Ibm.Instance.JumpHosts) == 0,
+	}, p.dialSSH, p.log)
+	if err != nil {
+		return err
+	}
+	p.client = client
+	return nil
+}
+
+// close 关闭到实例的连接
+func (p *provisioner) close() {
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+}
+
+// managerTemplateVars 生成实例管理器级别的模板变量（不含实例相关变量）
+func managerTemplateVars(ibm *utils.InstanceBindingManager, region, zone string) (TemplateVars, error) {
+	secrets, err := ibm.Feature.ResolveSecrets()
+	if err != nil {
+		return TemplateVars{}, err
+	}
+
+	vars := TemplateVars{
+		Region:  region,
+		Zone:    zone,
+		Manager: ibm.Name,
+		Secrets: secrets,
+	}
+	for _, db := range ibm.Bindings() {
+		vars.Domains = append(vars.Domains, db.FQDN())
+	}
+	if len(vars.Domains) > 0 {
+		vars.Domain = vars.Domains[0]
+	}
+	return vars, nil
+}
+
+// templateVars 生成实例的模板变量
+func (m *InstanceManager) templateVars(target *ProvisionTarget) (TemplateVars, error) {
+	instance := target.Instance
+	zone := m.Zone
+	if instance.Placement != nil {
+		zone = utils.StringValue(instance.Placement.Zone)
+	}
+	vars, err := managerTemplateVars(m.Ibm, m.Region, zone)
+	if err != nil {
+		return TemplateVars{}, err
+	}
+
+	vars.InstanceId = utils.StringValue(instance.InstanceId)
+	vars.InstanceName = utils.StringValue(instance.InstanceName)
+	vars.Ip = target.Ip
+	if vars.Index, err = m.States.Index(vars.InstanceId, m.Ibm.Name); err != nil {
+		return TemplateVars{}, err
+	}
+	if len(instance.PublicIpAddresses) > 0 {
+		vars.PublicIp = utils.StringValue(instance.PublicIpAddresses[0])
+	}
+	if len(instance.PublicIPv6Addresses) > 0 {
+		vars.PublicIpv6 = utils.StringValue(instance.PublicIPv6Addresses[0])
+	} else if len(instance.IPv6Addresses) > 0 {
+		vars.PublicIpv6 = utils.StringValue(instance.IPv6Addresses[0])
+	}
+	if len(instance.PrivateIpAddresses) > 0 {
+		vars.PrivateIp = utils.StringValue(instance.PrivateIpAddresses[0])
+	}
+	return vars, nil
+}
+
+// buildUserData 读取（并按需渲染）用户数据文件，返回 base64 编码后的内容，未开启时返回空字符串
+// 同一批创建的实例共用用户数据，模板中只能使用实例管理器级别的变量
+func buildUserData(ibm *utils.InstanceBindingManager, region, zone string) (string, error) {
+	cfg := ibm.Instance.UserData
+	if !cfg.Enabled {
+		return "", nil
+	}
+
+	var data []byte
+	var err error
+	if cfg.Template {
+		vars, verr := managerTemplateVars(ibm, region, zone)
+		if verr != nil {
+			return "", verr
+		}
+		data, err = utils.RenderTemplateFile(cfg.LocalPath, vars)
+	} else {
+		data, err = os.ReadFile(cfg.LocalPath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("读取用户数据文件失败: %v", err)
+	}
+
+	return tcloud.EncodeUserData(data)
+}
+
+// pipeline 返回实例初始化步骤，配置了用户数据完成标记时首先等待用户数据执行完成
+func (m *InstanceManager) pipeline() []utils.StepConfig {
+	steps := m.Ibm.Feature.Pipeline()
+	userData := m.Ibm.Instance.UserData
+	if !userData.Enabled || userData.WaitMarker == "" {
+		return steps
+	}
+	timeout := userData.WaitTimeout
+	if timeout <= 0 {
+		timeout = int64(defaultStepTimeout / time.Second)
+	}
+	return append([]utils.StepConfig{{
+		Name:       "user_data",
+		Type:       utils.StepWaitForFile,
+		RemotePath: userData.WaitMarker,
+		Timeout:    timeout,
+	}}, steps...)
+}
+
+// waitUntil 轮询执行 check 直到成功或 ctx 结束
+func waitUntil(ctx context.Context, check func() error) error {
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("等待超时，最后错误: %v", strings.TrimSpace(err.Error()))
+		case <-time.After(waitPollInterval):
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"crypto/sha256"
+	"cvmspot/utils"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// pipelineHashLength 写入实例标签的哈希长度（十六进制字符数）
+const pipelineHashLength = 16
+
+// PipelineHashes 初始化配置的内容哈希，输入（步骤配置、上传的文件、模板、密钥）变化时哈希随之变化
+type PipelineHashes struct {
+	Pipeline string            // 整个初始化流程的哈希，记录在实例标签中
+	Steps    map[string]string // 步骤名称 -> 步骤哈希，记录在初始化状态中
+}
+
+// pipelineHashes 计算当前初始化配置的哈希
+func (m *InstanceManager) pipelineHashes() (*PipelineHashes, error) {
+	secrets, err := m.Ibm.Feature.ResolveSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := &PipelineHashes{Steps: make(map[string]string)}
+	total := sha256.New()
+	for _, step := range m.pipeline() {
+		sum, err := stepHash(step, secrets)
+		if err != nil {
+			return nil, fmt.Errorf("步骤 %s: %v", step.Name, err)
+		}
+		hashes.Steps[step.Name] = sum
+		fmt.Fprintf(total, "%s=%s\n", step.Name, sum)
+	}
+	hashes.Pipeline = hex.EncodeToString(total.Sum(nil))[:pipelineHashLength]
+	return hashes, nil
+}
+
+// stepHash 计算单个步骤的哈希：步骤配置、本地文件内容，使用模板或环境变量时包含密钥
+func stepHash(step utils.StepConfig, secrets map[string]string) (string, error) {
+	h := sha256.New()
+	data, err := json.Marshal(step)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+
+	switch step.Type {
+	case utils.StepUpload, utils.StepScript, utils.StepTemplate:
+		if err := hashLocalPath(h, step.LocalPath); err != nil {
+			return "", err
+		}
+	}
+
+	if step.Template || step.Type == utils.StepTemplate || len(step.Env) > 0 {
+		keys := make([]string, 0, len(secrets))
+		for k := range secrets {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(h, "\x00secret:%s=%s", k, secrets[k])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// instanceStepHash 步骤在实例上执行时记录的哈希，包含实例序号（模板和命令环境变量 CVMSPOT_INDEX 可使用序号）
+func instanceStepHash(hash string, index int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00index:%d", hash, index)))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashLocalPath 按相对路径顺序将文件或目录下所有文件的路径和内容写入哈希
+func hashLocalPath(h io.Writer, localPath string) error {
+	return filepath.Walk(localPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "\x00file:%s:%o\x00", filepath.ToSlash(relPath), info.Mode().Perm())
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"cvmspot/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStepHash(t *testing.T) {
+	secrets := map[string]string{"token": "a"}
+	tests := []struct {
+		name    string
+		step    func(dir string) utils.StepConfig
+		modify  func(step *utils.StepConfig)   // 计算基准哈希后修改步骤配置
+		setup   func(t *testing.T, dir string) // 计算基准哈希后修改本地文件
+		secrets map[string]string
+		changed bool
+	}{
+		{
+			name: "配置和文件未变化",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "app", Type: utils.StepUpload, LocalPath: dir, RemotePath: "/opt/app"}
+			},
+		},
+		{
+			name: "远程路径变化",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "app", Type: utils.StepUpload, LocalPath: dir, RemotePath: "/opt/app"}
+			},
+			modify:  func(step *utils.StepConfig) { step.RemotePath = "/opt/app2" },
+			changed: true,
+		},
+		{
+			name: "命令变化",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "run", Type: utils.StepExec, Command: "./run.sh"}
+			},
+			modify:  func(step *utils.StepConfig) { step.Command = "./run.sh --fast" },
+			changed: true,
+		},
+		{
+			name: "文件内容变化",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "app", Type: utils.StepUpload, LocalPath: dir, RemotePath: "/opt/app"}
+			},
+			setup: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, "a.conf"), "port=8080", 0644)
+			},
+			changed: true,
+		},
+		{
+			name: "文件权限变化",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "app", Type: utils.StepUpload, LocalPath: dir, RemotePath: "/opt/app"}
+			},
+			setup: func(t *testing.T, dir string) {
+				if err := os.Chmod(filepath.Join(dir, "a.conf"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			changed: true,
+		},
+		{
+			name: "新增文件",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "app", Type: utils.StepUpload, LocalPath: dir, RemotePath: "/opt/app"}
+			},
+			setup: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, "sub", "b.conf"), "b", 0644)
+			},
+			changed: true,
+		},
+		{
+			name: "未使用模板时密钥变化",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "app", Type: utils.StepUpload, LocalPath: dir, RemotePath: "/opt/app"}
+			},
+			secrets: map[string]string{"token": "b"},
+		},
+		{
+			name: "使用模板时密钥变化",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "app", Type: utils.StepUpload, LocalPath: dir, RemotePath: "/opt/app", Template: true}
+			},
+			secrets: map[string]string{"token": "b"},
+			changed: true,
+		},
+		{
+			name: "使用环境变量时密钥变化",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "run", Type: utils.StepExec, Command: "./run.sh", Env: []string{"TOKEN={{.Secrets.token}}"}}
+			},
+			secrets: map[string]string{"token": "b"},
+			changed: true,
+		},
+		{
+			name: "命令步骤不读取本地文件",
+			step: func(dir string) utils.StepConfig {
+				return utils.StepConfig{Name: "run", Type: utils.StepExec, Command: "./run.sh", LocalPath: dir}
+			},
+			setup: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, "a.conf"), "port=8080", 0644)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFile(t, filepath.Join(dir, "a.conf"), "port=80", 0644)
+			step := tt.step(dir)
+
+			base, err := stepHash(step, secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.modify != nil {
+				tt.modify(&step)
+			}
+			if tt.setup != nil {
+				tt.setup(t, dir)
+			}
+			current := secrets
+			if tt.secrets != nil {
+				current = tt.secrets
+			}
+			got, err := stepHash(step, current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got != base) != tt.changed {
+				t.Errorf("stepHash() 变化 = %v, want %v", got != base, tt.changed)
+			}
+		})
+	}
+}
+
+func TestStepHashMissingPath(t *testing.T) {
+	step := utils.StepConfig{Name: "app", Type: utils.StepUpload, LocalPath: filepath.Join(t.TempDir(), "missing")}
+	if _, err := stepHash(step, nil); err == nil {
+		t.Error("stepHash() 本地路径不存在时应返回错误")
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string, perm os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+}
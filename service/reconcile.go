@@ -0,0 +1,621 @@
+package service
+
+import (
+	"cvmspot/tcloud"
+	"cvmspot/utils"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	cvm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm/v20170312"
+	vpc "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vpc/v20170312"
+)
+
+// 等待新创建实例分配IP的轮询次数和间隔
+const (
+	instanceWaitRetries  = 10
+	instanceWaitInterval = 5 * time.Second
+)
+
+// desiredState 由实例管理器配置生成的期望状态
+type desiredState struct {
+	vpc           utils.VpcConfig
+	subnet        utils.SubnetConfig
+	securityGroup utils.SecurityGroupConfig
+	policies      *vpc.SecurityGroupPolicySet // 配置的安全组规则
+	count         int64
+	autoRemove    bool
+	dns           []*utils.DomainBindingConfig // 开启的域名绑定
+	eip           *utils.EipConfig             // 未使用弹性公网IP模式时为空
+	hashes        *PipelineHashes              // 未配置初始化步骤时为空
+}
+
+// actualState 腾讯云上的实际状态
+type actualState struct {
+	vpcId           string
+	subnetId        string
+	vpcIpv6         string                      // 私有网络的IPv6网段，未开启IPv6或未分配时为空
+	subnetIpv6      string                      // 子网的IPv6网段
+	securityGroupId string                      // 实例使用的安全组，需要创建时为空
+	securityGroups  []*vpc.SecurityGroup        // 带标签的安全组
+	policies        *vpc.SecurityGroupPolicySet // 带标签安全组的现有规则，使用配置的安全组ID时为空
+	instances       []*cvm.Instance
+	pending         int64             // 已创建但尚未计入实例数量的实例
+	eips            []*vpc.Address    // 实例管理器维护的弹性公网IP
+	dns             []*dnsState       // 与 desiredState.dns 一一对应
+	applied         map[string]string // 实例ID -> 已应用的初始化配置哈希
+}
+
+// dnsState 单个域名绑定的DNS记录
+type dnsState struct {
+	records         []*tcloud.DnsRcordR // 子域名下的全部记录
+	recordsObserved bool                // 是否成功查询DNS记录，查询失败时不调整记录
+	hostRecords     []*tcloud.DnsRcordR // 带此所有者标记的实例主机记录
+	hostObserved    bool                // 是否成功查询实例主机记录，查询失败时不调整记录
+}
+
+// desired 根据配置生成期望状态
+func (m *InstanceManager) desired() (*desiredState, error) {
+	inst := m.Ibm.Instance
+	// 展开规则的动态来源（本机出口IP、域名、IP列表）
+	securityGroup := inst.SecurityGroups
+	rules, err := m.Allowlists.ExpandRules(&securityGroup)
+	if err != nil {
+		return nil, fmt.Errorf("解析安全组规则来源失败: %v", err)
+	}
+	securityGroup.Rules = rules
+
+	d := &desiredState{
+		vpc:           inst.VpcConfig,
+		subnet:        inst.SubnetConfig,
+		securityGroup: securityGroup,
+		policies:      tcloud.SecurityGroupPolicies(rules),
+		count:         m.Ibm.AutoMaintenance.DesiredCount,
+		autoRemove:    m.Ibm.AutoMaintenance.AutoRemove,
+	}
+	bindings, err := m.bindings()
+	if err != nil {
+		return nil, err
+	}
+	d.dns = bindings
+	switch inst.Internet.Mode {
+	case "", utils.InternetModePublicIP:
+	case utils.InternetModeEIP:
+		eip := inst.Internet.Eip
+		if eip.ReleasePolicy != "" && eip.ReleasePolicy != utils.EipRetain && eip.ReleasePolicy != utils.EipRelease {
+			return nil, fmt.Errorf("弹性公网IP释放策略 %s 不支持，只支持 retain 或 release", eip.ReleasePolicy)
+		}
+		d.eip = &eip
+	default:
+		return nil, fmt.Errorf("公网地址模式 %s 不支持，只支持 public_ip 或 eip", inst.Internet.Mode)
+	}
+	if len(m.pipeline()) > 0 {
+		hashes, err := m.pipelineHashes()
+		if err != nil {
+			return nil, fmt.Errorf("计算初始化配置哈希失败: %v", err)
+		}
+		d.hashes = hashes
+	}
+	return d, nil
+}
+
+// plan 查询实际状态并与期望状态对比，计算变更计划，只调用查询接口
+func (m *InstanceManager) plan() (*Plan, error) {
+	d, err := m.desired()
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{
+		Manager: m.Ibm.Name,
+		Region:  m.Region,
+		Zone:    m.Zone,
+		m:       m,
+		desire:  d,
+		actual:  &actualState{},
+	}
+
+	if err := m.observeNetwork(p); err != nil {
+		return nil, err
+	}
+	if err := m.observeInstances(p); err != nil {
+		return nil, err
+	}
+	if d.eip != nil {
+		if err := m.observeEips(p); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.observeDetails(p); err != nil {
+		return nil, err
+	}
+
+	m.diffNetwork(p)
+	m.diffInstances(p)
+	if d.eip != nil {
+		m.diffEips(p)
+	}
+	m.diffDetails(p)
+	return p, nil
+}
+
+// observeNetwork 查询私有网络、子网和安全组，配置了资源ID时直接使用
+func (m *InstanceManager) observeNetwork(p *Plan) error {
+	d, a := p.desire, p.actual
+	tagKey := m.Cfg.TConfig.TagKey
+	var err error
+
+	a.vpcId = d.vpc.VpcId
+	if a.vpcId == "" {
+		if a.vpcId, err = m.Client.FindVpc(tagKey, d.vpc.TagVal); err != nil {
+			return err
+		}
+	}
+
+	a.subnetId = d.subnet.SubnetId
+	if a.subnetId == "" && a.vpcId != "" {
+		if a.subnetId, err = m.Client.FindSubnet(a.vpcId, m.Zone, tagKey, d.subnet.TagVal); err != nil {
+			return err
+		}
+	}
+
+	if d.vpc.EnableIPv6 {
+		if a.vpcId != "" {
+			if a.vpcIpv6, err = m.Client.GetVpcIpv6CidrBlock(a.vpcId); err != nil {
+				return err
+			}
+		}
+		if a.subnetId != "" {
+			if a.subnetIpv6, err = m.Client.GetSubnetIpv6CidrBlock(a.subnetId); err != nil {
+				return err
+			}
+		}
+	}
+
+	a.securityGroupId = d.securityGroup.SecurityGroupId
+	if a.securityGroupId == "" {
+		if a.securityGroups, err = m.Client.FindSecurityGroups(tagKey, d.securityGroup.TagVal); err != nil {
+			return err
+		}
+		if len(a.securityGroups) > 0 {
+			a.securityGroupId = utils.StringValue(a.securityGroups[0].SecurityGroupId)
+			if a.policies, err = m.Client.DescribeSecurityGroupPolicies(a.securityGroupId); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// observeInstances 查询实例和已创建但尚未通过标签计入实例数量的实例
+func (m *InstanceManager) observeInstances(p *Plan) error {
+	a := p.actual
+	instances, err := m.Client.GetInsInfo(m.Cfg.TConfig.TagKey, m.Ibm.Name)
+	if err != nil {
+		return err
+	}
+	a.instances = instances
+
+	visible := make(map[string]bool, len(instances))
+	for _, ins := range instances {
+		visible[utils.StringValue(ins.InstanceId)] = true
+	}
+	a.pending = 0
+	for _, launch := range m.Launches.Pending(m.Ibm.Name) {
+		if len(launch.InstanceIds) == 0 {
+			p.warn("创建请求 %s（%s）结果未知，将使用相同 ClientToken 重新请求 %d 个实例", launch.ClientToken, launch.Zone, launch.Count)
+			a.pending += launch.Count
+			continue
+		}
+		missing := make([]string, 0)
+		for _, id := range launch.InstanceIds {
+			if !visible[id] {
+				missing = append(missing, id)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		alive, err := m.countAlive(missing)
+		if err != nil {
+			return err
+		}
+		a.pending += alive
+	}
+	return nil
+}
+
+// observeDetails 查询每个域名绑定的DNS记录和实例标签记录的初始化配置哈希
+func (m *InstanceManager) observeDetails(p *Plan) error {
+	d, a := p.desire, p.actual
+	a.dns = make([]*dnsState, len(d.dns))
+	for i, db := range d.dns {
+		state := &dnsState{}
+		records, err := m.Client.GetDnsRecordList(&db.Domain, &db.SubDomain)
+		if err != nil {
+			p.warn("%v，本次不调整 %s 的DNS记录", err, db.FQDN())
+		}
+		state.records = records
+		state.recordsObserved = err == nil
+		if db.HostnameTemplate != "" {
+			m.observeHostRecords(p, db, state)
+		}
+		a.dns[i] = state
+	}
+	if d.hashes != nil {
+		applied, err := appliedHashes(m.Client, m.Cfg.Other["execFlagTagKey"].(string), m.Region)
+		if err != nil {
+			return err
+		}
+		a.applied = applied
+	}
+	return nil
+}
+
+// diffNetwork 计算私有网络、子网和安全组变更
+func (m *InstanceManager) diffNetwork(p *Plan) {
+	d, a := p.desire, p.actual
+	if a.vpcId == "" {
+		p.add(Action{Type: ActionCreate, Resource: ResourceVpc, Name: d.vpc.VpcName, Detail: "网段 " + d.vpc.CidrBlock})
+	}
+	if a.subnetId == "" {
+		p.add(Action{Type: ActionCreate, Resource: ResourceSubnet, Name: d.subnet.SubnetName, Detail: fmt.Sprintf("网段 %s，可用区 %s", d.subnet.CidrBlock, m.Zone)})
+	}
+	if d.vpc.EnableIPv6 {
+		m.diffIpv6(p)
+	}
+	if a.securityGroupId == "" {
+		p.add(Action{Type: ActionCreate, Resource: ResourceSecurityGroup, Name: d.securityGroup.SecurityName,
+			Detail: fmt.Sprintf("%d 条入站规则，%d 条出站规则", len(d.policies.Ingress), len(d.policies.Egress))})
+		return
+	}
+	if len(a.securityGroups) > 1 {
+		p.warn("存在 %d 个带标签的安全组，只维护 %s 的规则", len(a.securityGroups), a.securityGroupId)
+	}
+	if a.policies == nil {
+		return
+	}
+
+	// 规则顺序或描述变化时重置全部规则，否则只删除和追加有变化的规则
+	ingress := tcloud.DiffSecurityGroupPolicies(d.policies.Ingress, a.policies.Ingress)
+	egress := tcloud.DiffSecurityGroupPolicies(d.policies.Egress, a.policies.Egress)
+	if ingress.Reset || egress.Reset {
+		p.add(Action{Type: ActionUpdate, Resource: ResourceSecurityGroup, ID: a.securityGroupId,
+			Detail: fmt.Sprintf("规则顺序或描述变化，重置为 %d 条入站规则，%d 条出站规则", len(d.policies.Ingress), len(d.policies.Egress))})
+		return
+	}
+	for _, dir := range []struct {
+		name string
+		diff tcloud.PolicyDiff
+	}{{"入站", ingress}, {"出站", egress}} {
+		for _, policy := range dir.diff.Remove {
+			p.add(Action{Type: ActionDelete, Resource: ResourceSecurityGroupRule, ID: a.securityGroupId, Name: dir.name, Detail: tcloud.DescribePolicy(policy)})
+		}
+		for _, policy := range dir.diff.Add {
+			p.add(Action{Type: ActionCreate, Resource: ResourceSecurityGroupRule, ID: a.securityGroupId, Name: dir.name, Detail: tcloud.DescribePolicy(policy)})
+		}
+	}
+}
+
+// diffIpv6 计算私有网络和子网的IPv6网段分配，已分配的网段不做调整
+func (m *InstanceManager) diffIpv6(p *Plan) {
+	d, a := p.desire, p.actual
+	if a.vpcIpv6 == "" {
+		p.add(Action{Type: ActionUpdate, Resource: ResourceVpc, ID: a.vpcId, Name: d.vpc.VpcName, Detail: "申请IPv6网段（/56）"})
+	}
+	if a.subnetIpv6 != "" {
+		return
+	}
+	detail := fmt.Sprintf("分配IPv6网段，序号 %s", d.subnet.Ipv6Index)
+	if a.vpcIpv6 != "" {
+		block, err := tcloud.Ipv6SubnetCidrBlock(a.vpcIpv6, d.subnet.Ipv6Index)
+		if err != nil {
+			p.warn("无法为子网分配IPv6网段: %v", err)
+			return
+		}
+		detail = "分配IPv6网段 " + block
+	}
+	p.add(Action{Type: ActionUpdate, Resource: ResourceSubnet, ID: a.subnetId, Name: d.subnet.SubnetName, Detail: detail})
+}
+
+// diffInstances 计算实例数量变更
+func (m *InstanceManager) diffInstances(p *Plan) {
+	d, a := p.desire, p.actual
+	current := int64(len(a.instances))
+	switch {
+	case current+a.pending < d.count:
+		count := d.count - current - a.pending
+		p.add(Action{Type: ActionCreate, Resource: ResourceInstance, Name: m.Ibm.Instance.InstanceName, Count: count,
+			Detail: fmt.Sprintf("%d 个 %s，出价 %s（当前 %d，待确认 %d，期望 %d）", count, m.Ibm.Instance.InstanceType, m.Ibm.AutoMaintenance.LowestPrice, current, a.pending, d.count)})
+	case current > d.count && d.autoRemove:
+		// 在计划中随机选定要删除的实例，apply 只删除这些实例
+		instances := append([]*cvm.Instance(nil), a.instances...)
+		rand.Shuffle(len(instances), func(i, j int) {
+			instances[i], instances[j] = instances[j], instances[i]
+		})
+		for _, ins := range instances[:current-d.count] {
+			p.add(Action{Type: ActionDelete, Resource: ResourceInstance, ID: utils.StringValue(ins.InstanceId), Name: utils.StringValue(ins.InstanceName),
+				Detail: fmt.Sprintf("删除多余实例（当前 %d，期望 %d）", current, d.count)})
+		}
+	case current > d.count:
+		p.warn("当前实例数 %d 超过期望 %d，未开启 auto_remove，不会删除", current, d.count)
+	}
+}
+
+// diffDetails 按当前实例计算DNS记录和初始化配置哈希标签变更，新创建实例的变更在实例就绪后计算
+func (m *InstanceManager) diffDetails(p *Plan) {
+	d, a := p.desire, p.actual
+	for i, db := range d.dns {
+		m.diffDNS(p, db, a.dns[i])
+		if db.HostnameTemplate != "" {
+			m.diffHostnames(p, db, a.dns[i])
+		}
+	}
+
+	if d.hashes != nil {
+		tagKey := m.Cfg.Other["execFlagTagKey"].(string)
+		targets := newProvisionTargets(a.instances, m.publicIpAssigned())
+		sort.Slice(targets, func(i, j int) bool { return *targets[i].Instance.InstanceId < *targets[j].Instance.InstanceId })
+		for _, target := range targets {
+			id := *target.Instance.InstanceId
+			switch a.applied[id] {
+			case d.hashes.Pipeline:
+			case "":
+				p.add(Action{Type: ActionUpdate, Resource: ResourceTag, ID: id, Detail: fmt.Sprintf("初始化实例，%s: -> %s", tagKey, d.hashes.Pipeline)})
+			case legacyExecTagValue:
+				p.add(Action{Type: ActionUpdate, Resource: ResourceTag, ID: id, Detail: fmt.Sprintf("沿用旧版本初始化结果，不重新初始化，%s: %s -> %s", tagKey, legacyExecTagValue, d.hashes.Pipeline)})
+			default:
+				p.add(Action{Type: ActionUpdate, Resource: ResourceTag, ID: id, Detail: fmt.Sprintf("重新初始化实例，%s: %s -> %s", tagKey, a.applied[id], d.hashes.Pipeline)})
+			}
+		}
+		if len(targets) < len(a.instances) {
+			p.warn("%d 个实例暂无可连接的IP，分配后再初始化", len(a.instances)-len(targets))
+		}
+	}
+}
+
+// apply 按依赖顺序执行变更：私有网络、子网、安全组及规则 -> 实例 -> 弹性公网IP -> DNS记录 -> 实例主机记录 -> 标签（初始化实例）
+// 实例数量变化后等待实例就绪，重新计算弹性公网IP变更；实例或公网IP变化后重新查询并计算DNS记录和标签变更
+func (m *InstanceManager) apply(p *Plan) error {
+	if err := m.applyNetwork(p); err != nil {
+		return err
+	}
+
+	changed, err := m.applyInstances(p)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if p.actual.instances, err = m.waitInstances(); err != nil {
+			return err
+		}
+		if p.desire.eip != nil {
+			if err := m.observeEips(p); err != nil {
+				return err
+			}
+			p.Actions = p.filter(ResourceVpc, ResourceSubnet, ResourceSecurityGroup, ResourceSecurityGroupRule, ResourceInstance)
+			m.diffEips(p)
+		}
+	}
+	if p.desire.eip != nil {
+		associated, err := m.applyEips(p)
+		if err != nil {
+			return err
+		}
+		if len(associated) > 0 {
+			if p.actual.instances, err = m.waitEips(associated); err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+	if changed {
+		if err := m.observeDetails(p); err != nil {
+			return err
+		}
+		p.Actions = p.filter(ResourceVpc, ResourceSubnet, ResourceSecurityGroup, ResourceSecurityGroupRule, ResourceInstance, ResourceEip)
+		m.diffDetails(p)
+	}
+
+	// 清理已被回收实例的主机密钥和初始化状态记录
+	m.pruneInstanceRecords(p.actual.instances)
+
+	for i, db := range p.desire.dns {
+		m.applyDNS(p, db)
+		if db.HostnameTemplate != "" {
+			m.applyHostnames(p, db, p.actual.dns[i])
+		}
+	}
+	return m.applyTags(p)
+}
+
+// applyNetwork 创建私有网络、子网和安全组，并更新创建实例使用的网络参数
+func (m *InstanceManager) applyNetwork(p *Plan) error {
+	d, a := p.desire, p.actual
+	tagKey := m.Cfg.TConfig.TagKey
+	actions := p.filter(ResourceVpc, ResourceSubnet, ResourceSecurityGroup)
+
+	for _, act := range actions {
+		var err error
+		switch {
+		case act.Resource == ResourceVpc && act.Type == ActionCreate:
+			a.vpcId, err = m.Client.CreateVpc(tagKey, d.vpc.TagVal, d.vpc.VpcName, d.vpc.CidrBlock)
+		case act.Resource == ResourceSubnet && act.Type == ActionCreate:
+			a.subnetId, err = m.Client.CreateSubnet(&tcloud.SubVpcP{
+				VpcId:      &a.vpcId,
+				TagKey:     &tagKey,
+				TagVal:     &d.subnet.TagVal,
+				SubnetName: &d.subnet.SubnetName,
+				CidrBlock:  &d.subnet.CidrBlock,
+				Zone:       &m.Zone,
+			})
+		case act.Resource == ResourceVpc && act.Type == ActionUpdate:
+			m.Log.WithField("私网ID", a.vpcId).Info("申请IPv6网段")
+			a.vpcIpv6, err = m.Client.AssignIpv6CidrBlock(a.vpcId)
+		case act.Resource == ResourceSubnet && act.Type == ActionUpdate:
+			err = m.assignSubnetIpv6(p)
+		case act.Resource == ResourceSecurityGroup && act.Type == ActionCreate:
+			a.securityGroupId, err = m.Client.CreateSecurityGroup(tagKey, d.securityGroup.TagVal, &d.securityGroup)
+		case act.Resource == ResourceSecurityGroup && act.Type == ActionUpdate:
+			m.Log.WithField("安全组ID", act.ID).Info("重置安全组规则")
+			err = m.Client.ModifySecurityGroupPolicies(act.ID, utils.StringValue(a.policies.Version), d.policies)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := m.applySecurityGroupRules(p); err != nil {
+		return err
+	}
+
+	m.InsCfg.VpcId = a.vpcId
+	m.InsCfg.SubnetId = a.subnetId
+	m.InsCfg.SecurityGroupIds = []*string{common.StringPtr(a.securityGroupId)}
+	if len(actions) > 0 {
+		m.Log.WithFields(logrus.Fields{
+			"私网ID":  a.vpcId,
+			"子网ID":  a.subnetId,
+			"安全组ID": a.securityGroupId,
+		}).Info("获取私有网络和安全组成功")
+	}
+	return nil
+}
+
+// assignSubnetIpv6 按配置的序号从私有网络IPv6网段中为子网分配 /64 网段
+func (m *InstanceManager) assignSubnetIpv6(p *Plan) error {
+	d, a := p.desire, p.actual
+	block, err := tcloud.Ipv6SubnetCidrBlock(a.vpcIpv6, d.subnet.Ipv6Index)
+	if err != nil {
+		return err
+	}
+	m.Log.WithFields(logrus.Fields{"子网ID": a.subnetId, "IPv6网段": block}).Info("为子网分配IPv6网段")
+	if err := m.Client.AssignIpv6SubnetCidrBlock(a.vpcId, a.subnetId, block); err != nil {
+		return err
+	}
+	a.subnetIpv6 = block
+	return nil
+}
+
+// applySecurityGroupRules 按方向删除配置中不存在的安全组规则，并在末尾追加新规则
+func (m *InstanceManager) applySecurityGroupRules(p *Plan) error {
+	d, a := p.desire, p.actual
+	if len(p.filter(ResourceSecurityGroupRule)) == 0 {
+		return nil
+	}
+	for _, dir := range []struct {
+		desired, actual []*vpc.SecurityGroupPolicy
+		set             func(policies []*vpc.SecurityGroupPolicy) *vpc.SecurityGroupPolicySet
+	}{
+		{d.policies.Ingress, a.policies.Ingress, func(ps []*vpc.SecurityGroupPolicy) *vpc.SecurityGroupPolicySet {
+			return &vpc.SecurityGroupPolicySet{Ingress: ps}
+		}},
+		{d.policies.Egress, a.policies.Egress, func(ps []*vpc.SecurityGroupPolicy) *vpc.SecurityGroupPolicySet {
+			return &vpc.SecurityGroupPolicySet{Egress: ps}
+		}},
+	} {
+		diff := tcloud.DiffSecurityGroupPolicies(dir.desired, dir.actual)
+		if len(diff.Remove) > 0 {
+			m.Log.WithField("安全组ID", a.securityGroupId).Infof("删除 %d 条安全组规则", len(diff.Remove))
+			if err := m.Client.DeleteSecurityGroupPolicies(a.securityGroupId, dir.set(diff.Remove)); err != nil {
+				return err
+			}
+		}
+		if len(diff.Add) > 0 {
+			m.Log.WithField("安全组ID", a.securityGroupId).Infof("添加 %d 条安全组规则", len(diff.Add))
+			if err := m.Client.CreateSecurityGroupPolicies(a.securityGroupId, dir.set(diff.Add)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyInstances 维护实例数量，先确认待确认的创建请求，按确认后的数量创建或删除实例，返回实例是否变化
+func (m *InstanceManager) applyInstances(p *Plan) (bool, error) {
+	var create int64
+	remove := make([]string, 0)
+	for _, act := range p.filter(ResourceInstance) {
+		switch act.Type {
+		case ActionCreate:
+			create += act.Count
+		case ActionDelete:
+			remove = append(remove, act.ID)
+		}
+	}
+
+	// 先确认结果未知的创建请求，计划中的待确认实例数包含这些请求
+	if _, err := m.reconcileLaunches(); err != nil {
+		return false, fmt.Errorf("确认实例创建请求失败: %v", err)
+	}
+
+	switch {
+	case create > 0:
+		// 实例不足，创建新实例
+		m.Log.WithField("count", create).Info("需要创建新实例")
+		if err := m.launch(create); err != nil {
+			return false, fmt.Errorf("创建实例失败: %v", err)
+		}
+		return true, nil
+
+	case len(remove) > 0:
+		// 实例过多，删除计划中选定的实例
+		m.Log.WithField("实例ID", remove).Info("删除多余实例")
+		deleted := m.Client.TerminateInstances(remove)
+		if err := m.HostKeys.Remove(deleted...); err != nil {
+			m.Log.Errorf("清理主机密钥记录失败: %v", err)
+		}
+		if err := m.States.Remove(deleted...); err != nil {
+			m.Log.Errorf("清理初始化状态记录失败: %v", err)
+		}
+		return len(deleted) > 0, nil
+	}
+	return false, nil
+}
+
+// waitInstances 等待实例数量达到期望数量并分配可连接的IP
+func (m *InstanceManager) waitInstances() ([]*cvm.Instance, error) {
+	eipMode := m.Ibm.Instance.Internet.EIPMode()
+	publicIpAssigned := m.publicIpAssigned() && !eipMode
+	desired := int(m.Ibm.AutoMaintenance.DesiredCount)
+	for loopNum := 1; ; loopNum++ {
+		instanceSet, err := m.Client.GetInsInfo(m.Cfg.TConfig.TagKey, m.Ibm.Name)
+		if err != nil {
+			return nil, fmt.Errorf("获取实例信息失败: %v", err)
+		}
+		ready := len(newProvisionTargets(instanceSet, publicIpAssigned))
+		if eipMode {
+			// 弹性公网IP只能绑定到运行中的实例
+			ready = countRunning(instanceSet)
+		}
+		if len(instanceSet) >= desired && ready >= desired {
+			m.Log.Debugf("已存在 %d 个腾讯云实例", len(instanceSet))
+			return instanceSet, nil
+		}
+		if loopNum >= instanceWaitRetries {
+			return nil, fmt.Errorf("等待腾讯云实例创建超时")
+		}
+		m.Log.Debugf("正在进行第 %d/%d 次等待腾讯云创建实例并分配公网完成...", loopNum, instanceWaitRetries)
+		time.Sleep(instanceWaitInterval)
+	}
+}
+
+// applyTags 初始化初始化配置哈希与标签记录不一致的实例，成功后更新标签
+func (m *InstanceManager) applyTags(p *Plan) error {
+	actions := p.filter(ResourceTag)
+	if len(actions) == 0 {
+		return nil
+	}
+	pending := make(map[string]bool, len(actions))
+	for _, act := range actions {
+		pending[act.ID] = true
+	}
+	targets := make([]*ProvisionTarget, 0, len(actions))
+	for _, target := range newProvisionTargets(p.actual.instances, m.publicIpAssigned()) {
+		if pending[*target.Instance.InstanceId] {
+			targets = append(targets, target)
+		}
+	}
+	return m.InitIns(targets, p.desire.hashes, p.actual.applied)
+}
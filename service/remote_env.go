@@ -0,0 +1,76 @@
+package service
+
+import (
+	"cvmspot/utils"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// instanceEnv 自动注入到命令环境的实例信息
+func (v TemplateVars) instanceEnv() map[string]string {
+	return map[string]string{
+		"CVMSPOT_INSTANCE_ID":   v.InstanceId,
+		"CVMSPOT_INSTANCE_NAME": v.InstanceName,
+		"CVMSPOT_IP":            v.Ip,
+		"CVMSPOT_PUBLIC_IP":     v.PublicIp,
+		"CVMSPOT_PUBLIC_IPV6":   v.PublicIpv6,
+		"CVMSPOT_PRIVATE_IP":    v.PrivateIp,
+		"CVMSPOT_ZONE":          v.Zone,
+		"CVMSPOT_REGION":        v.Region,
+		"CVMSPOT_DOMAIN":        v.Domain,
+		"CVMSPOT_DOMAINS":       strings.Join(v.Domains, ","),
+		"CVMSPOT_MANAGER":       v.Manager,
+		"CVMSPOT_INDEX":         strconv.Itoa(v.Index),
+	}
+}
+
+// stepEnv 合并实例信息和步骤配置的环境变量（KEY=VALUE，值可使用模板变量），步骤配置优先
+func stepEnv(step utils.StepConfig, vars TemplateVars) (map[string]string, error) {
+	env := vars.instanceEnv()
+	for _, item := range step.Env {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("无效的环境变量 %q，格式应为 KEY=VALUE", item)
+		}
+		rendered, err := utils.RenderTemplate(name, []byte(value), vars)
+		if err != nil {
+			return nil, err
+		}
+		env[name] = string(rendered)
+	}
+	return env, nil
+}
+
+// wrapCommand 按步骤配置为命令设置工作目录，返回最终命令和执行选项（环境变量、sudo）
+// 使用 sudo 且配置了登录密码时由执行器判断是否需要输入密码，否则要求免密 sudo
+// tat 执行器下发的命令内容以明文保存在 TAT 执行记录中，环境变量不能引用密钥
+func (p *provisioner) wrapCommand(step utils.StepConfig, command string) (string, utils.RunOptions, error) {
+	if p.m.Ibm.Feature.Executor == utils.ExecutorTAT {
+		for _, item := range step.Env {
+			if strings.Contains(item, ".Secrets") {
+				return "", utils.RunOptions{}, fmt.Errorf("tat 执行器的命令内容会明文保存在执行记录中，环境变量 %q 不能引用 .Secrets", strings.SplitN(item, "=", 2)[0])
+			}
+		}
+	}
+	env, err := stepEnv(step, p.vars)
+	if err != nil {
+		return "", utils.RunOptions{}, err
+	}
+	opts := utils.RunOptions{Env: env}
+
+	if step.Workdir != "" {
+		command = "cd " + utils.ShellQuote(step.Workdir) + " || exit 1; " + command
+	}
+
+	user := p.m.Ibm.Instance.UserConfig
+	if !step.Sudo || user.Username == "root" {
+		return command, opts, nil
+	}
+	opts.Sudo = true
+	opts.SudoPassword = user.Password
+	return command, opts, nil
+}
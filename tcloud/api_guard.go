@@ -0,0 +1,260 @@
+package tcloud
+
+import (
+	"cvmspot/utils"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	sdkerrors "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
+)
+
+// 接口调用重试默认值
+const (
+	defaultAPIMaxRetries = 5
+	defaultAPIBaseDelay  = 500 * time.Millisecond
+	defaultAPIMaxDelay   = 20 * time.Second
+	defaultAPIRateLimit  = 10 // 每个接口每秒最多调用次数
+)
+
+// 错误分类
+const (
+	errorFatal     = iota // 不可重试
+	errorThrottled        // 请求被限频，请求未被执行，任何接口都可以重试
+	errorTransient        // 内部错误或网络错误，只有幂等接口重试
+)
+
+// APIStats 单个接口的调用统计
+type APIStats struct {
+	Calls     int64 // 调用次数（不含重试）
+	Retries   int64 // 重试次数
+	Throttled int64 // 被限频次数
+	Failures  int64 // 重试后仍失败的次数
+}
+
+// APIGuard 腾讯云接口调用的重试、退避和限频，所有实例管理器和地域共用一个实例
+type APIGuard struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	interval   time.Duration // 同一接口两次调用的最小间隔
+	log        *logrus.Logger
+
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+	stats    map[string]*APIStats
+}
+
+// NewAPIGuard 按配置创建接口调用保护，未配置的项使用默认值
+func NewAPIGuard(cfg utils.APIRetryConfig, log *logrus.Logger) *APIGuard {
+	g := &APIGuard{
+		maxRetries: defaultAPIMaxRetries,
+		baseDelay:  defaultAPIBaseDelay,
+		maxDelay:   defaultAPIMaxDelay,
+		interval:   time.Second / defaultAPIRateLimit,
+		log:        log,
+		limiters:   make(map[string]*rateLimiter),
+		stats:      make(map[string]*APIStats),
+	}
+	if cfg.MaxRetries != 0 {
+		g.maxRetries = max(cfg.MaxRetries, 0)
+	}
+	if cfg.BaseDelay > 0 {
+		g.baseDelay = time.Duration(cfg.BaseDelay) * time.Millisecond
+	}
+	if cfg.MaxDelay > 0 {
+		g.maxDelay = time.Duration(cfg.MaxDelay) * time.Millisecond
+	}
+	if cfg.RateLimit > 0 {
+		g.interval = time.Second / time.Duration(cfg.RateLimit)
+	}
+	return g
+}
+
+// call 调用腾讯云接口，按错误类型退避重试，api 格式为 服务.接口名（如 cvm.DescribeInstances）
+func call[T any](g *APIGuard, api string, fn func() (T, error)) (T, error) {
+	return guardedCall(g, api, isIdempotent(api), fn)
+}
+
+// callWithToken 调用携带幂等参数（如 ClientToken）的创建类接口，重复调用不会创建重复资源，网络错误和内部错误时同样重试
+func callWithToken[T any](g *APIGuard, api string, fn func() (T, error)) (T, error) {
+	return guardedCall(g, api, true, fn)
+}
+
+func guardedCall[T any](g *APIGuard, api string, idempotent bool, fn func() (T, error)) (T, error) {
+	if g == nil {
+		return fn()
+	}
+	g.record(api, func(s *APIStats) { s.Calls++ })
+
+	for attempt := 0; ; attempt++ {
+		g.limiter(api).wait()
+		resp, err := fn()
+		if err == nil {
+			return resp, nil
+		}
+
+		kind := classifyError(err)
+		if kind == errorThrottled {
+			g.record(api, func(s *APIStats) { s.Throttled++ })
+		}
+		retryable := kind == errorThrottled || (kind == errorTransient && idempotent)
+		if !retryable || attempt >= g.maxRetries {
+			if retryable {
+				g.record(api, func(s *APIStats) { s.Failures++ })
+			}
+			return resp, err
+		}
+
+		delay := g.backoff(attempt)
+		var retries int64
+		g.record(api, func(s *APIStats) {
+			s.Retries++
+			retries = s.Retries
+		})
+		g.log.WithFields(logrus.Fields{
+			"接口":    api,
+			"重试次数":  attempt + 1,
+			"等待":    delay.String(),
+			"累计重试数": retries,
+		}).Warnf("腾讯云接口调用失败，稍后重试: %v", err)
+		time.Sleep(delay)
+	}
+}
+
+// backoff 指数退避，在 [d/2, d] 之间随机取值
+func (g *APIGuard) backoff(attempt int) time.Duration {
+	d := g.baseDelay << attempt
+	if d <= 0 || d > g.maxDelay {
+		d = g.maxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (g *APIGuard) limiter(api string) *rateLimiter {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l, ok := g.limiters[api]
+	if !ok {
+		l = &rateLimiter{interval: g.interval}
+		g.limiters[api] = l
+	}
+	return l
+}
+
+func (g *APIGuard) record(api string, update func(s *APIStats)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.stats[api]
+	if !ok {
+		s = &APIStats{}
+		g.stats[api] = s
+	}
+	update(s)
+}
+
+// Stats 返回各接口调用统计的副本
+func (g *APIGuard) Stats() map[string]APIStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stats := make(map[string]APIStats, len(g.stats))
+	for api, s := range g.stats {
+		stats[api] = *s
+	}
+	return stats
+}
+
+// LogStats 输出发生过重试或失败的接口统计
+func (g *APIGuard) LogStats() {
+	stats := g.Stats()
+	apis := make([]string, 0, len(stats))
+	for api, s := range stats {
+		if s.Retries > 0 || s.Failures > 0 {
+			apis = append(apis, api)
+		}
+	}
+	sort.Strings(apis)
+	for _, api := range apis {
+		s := stats[api]
+		g.log.WithFields(logrus.Fields{
+			"接口":  api,
+			"调用数": s.Calls,
+			"重试数": s.Retries,
+			"限频数": s.Throttled,
+			"失败数": s.Failures,
+		}).Info("腾讯云接口调用统计")
+	}
+}
+
+// classifyError 根据 TencentCloudSDKError 错误码判断是否可重试
+func classifyError(err error) int {
+	var sdkErr *sdkerrors.TencentCloudSDKError
+	if errors.As(err, &sdkErr) {
+		code := sdkErr.GetCode()
+		switch {
+		case strings.HasPrefix(code, "RequestLimitExceeded"):
+			return errorThrottled
+		case strings.HasPrefix(code, "InternalError"),
+			code == "ClientError.NetworkError",
+			code == "ClientError.HttpStatusCodeError",
+			code == "ClientError.IOError":
+			return errorTransient
+		}
+		return errorFatal
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return errorTransient
+	}
+	return errorFatal
+}
+
+// OutcomeUnknown 判断接口调用失败时请求是否可能已被执行（内部错误、网络错误），
+// 此时创建类接口需要使用相同的幂等参数重试确认结果
+func OutcomeUnknown(err error) bool {
+	return classifyError(err) == errorTransient
+}
+
+// isIdempotent 创建类接口重复调用可能创建重复资源，网络错误和内部错误时不重试，携带幂等参数时使用 callWithToken
+func isIdempotent(api string) bool {
+	_, action, _ := strings.Cut(api, ".")
+	for _, prefix := range []string{"Create", "Run", "Allocate", "Add"} {
+		if strings.HasPrefix(action, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// rateLimiter 按固定间隔放行请求
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// apiName 返回统计和限频使用的接口名
+func apiName(service, action string) string {
+	return fmt.Sprintf("%s.%s", service, action)
+}
@@ -0,0 +1,110 @@
+package tcloud
+
+import (
+	"cvmspot/utils"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	sdkerrors "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "限频", err: sdkerrors.NewTencentCloudSDKError("RequestLimitExceeded", "", ""), want: errorThrottled},
+		{name: "账号限频", err: sdkerrors.NewTencentCloudSDKError("RequestLimitExceeded.UinLimitExceeded", "", ""), want: errorThrottled},
+		{name: "内部错误", err: sdkerrors.NewTencentCloudSDKError("InternalError", "", ""), want: errorTransient},
+		{name: "内部错误子码", err: sdkerrors.NewTencentCloudSDKError("InternalError.TradeUnknownError", "", ""), want: errorTransient},
+		{name: "SDK网络错误", err: sdkerrors.NewTencentCloudSDKError("ClientError.NetworkError", "", ""), want: errorTransient},
+		{name: "HTTP状态码错误", err: sdkerrors.NewTencentCloudSDKError("ClientError.HttpStatusCodeError", "", ""), want: errorTransient},
+		{name: "参数错误", err: sdkerrors.NewTencentCloudSDKError("InvalidParameterValue", "", ""), want: errorFatal},
+		{name: "库存不足", err: sdkerrors.NewTencentCloudSDKError("ResourceInsufficient.SpecifiedInstanceType", "", ""), want: errorFatal},
+		{name: "包装的SDK错误", err: fmt.Errorf("实例创建失败: %w", sdkerrors.NewTencentCloudSDKError("InternalError", "", "")), want: errorTransient},
+		{name: "网络错误", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection reset")}, want: errorTransient},
+		{name: "普通错误", err: errors.New("unknown"), want: errorFatal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsIdempotent(t *testing.T) {
+	tests := []struct {
+		api  string
+		want bool
+	}{
+		{api: "cvm.DescribeInstances", want: true},
+		{api: "cvm.TerminateInstances", want: true},
+		{api: "dnspod.ModifyRecord", want: true},
+		{api: "cvm.RunInstances", want: false},
+		{api: "vpc.CreateVpc", want: false},
+		{api: "vpc.AllocateAddresses", want: false},
+		{api: "tag.AddResourceTag", want: false},
+		{api: "tat.RunCommand", want: false},
+	}
+	for _, tt := range tests {
+		if got := isIdempotent(tt.api); got != tt.want {
+			t.Errorf("isIdempotent(%s) = %v, want %v", tt.api, got, tt.want)
+		}
+	}
+}
+
+func TestCallRetry(t *testing.T) {
+	transient := sdkerrors.NewTencentCloudSDKError("InternalError", "", "")
+	throttled := sdkerrors.NewTencentCloudSDKError("RequestLimitExceeded", "", "")
+	fatal := sdkerrors.NewTencentCloudSDKError("InvalidParameter", "", "")
+	tests := []struct {
+		name      string
+		api       string
+		withToken bool
+		errs      []error // 依次返回的错误，之后调用成功
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "查询接口内部错误重试", api: "cvm.DescribeInstances", errs: []error{transient, transient}, wantCalls: 3},
+		{name: "创建接口内部错误不重试", api: "cvm.RunInstances", errs: []error{transient}, wantCalls: 1, wantErr: true},
+		{name: "携带ClientToken的创建接口内部错误重试", api: "cvm.RunInstances", withToken: true, errs: []error{transient}, wantCalls: 2},
+		{name: "创建接口限频重试", api: "vpc.CreateVpc", errs: []error{throttled}, wantCalls: 2},
+		{name: "不可重试错误", api: "cvm.DescribeInstances", errs: []error{fatal}, wantCalls: 1, wantErr: true},
+		{name: "超过最大重试次数", api: "cvm.DescribeInstances", errs: []error{transient, transient, transient, transient}, wantCalls: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := logrus.New()
+			log.SetOutput(io.Discard)
+			g := NewAPIGuard(utils.APIRetryConfig{MaxRetries: 2, BaseDelay: 1, MaxDelay: 1, RateLimit: 1000}, log)
+
+			calls := 0
+			fn := func() (int, error) {
+				calls++
+				if calls <= len(tt.errs) {
+					return 0, tt.errs[calls-1]
+				}
+				return calls, nil
+			}
+			var err error
+			if tt.withToken {
+				_, err = callWithToken(g, tt.api, fn)
+			} else {
+				_, err = call(g, tt.api, fn)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("call() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("call() 调用 %d 次, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package tcloud
+
+import (
+	"fmt"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	vpc "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vpc/v20170312"
+)
+
+// 弹性公网IP状态
+const (
+	AddressCreating = "CREATING"
+	AddressBind     = "BIND"
+	AddressUnbind   = "UNBIND"
+)
+
+// addressPageSize DescribeAddresses 单次查询的最大数量
+const addressPageSize = 100
+
+// AllocateEipP 申请弹性公网IP的参数
+type AllocateEipP struct {
+	Count        int64
+	Name         string
+	TagKey       string
+	TagVal       string
+	ChargeType   string // 为空时不传递，传统账户类型不能传递
+	BandwidthOut int64  // 为0时不传递
+	ISP          string
+}
+
+// FindAddresses 查询带指定标签的弹性公网IP
+func (a *AClient) FindAddresses(tagKey, tagVal string) ([]*vpc.Address, error) {
+	filters := []*vpc.Filter{
+		{
+			Name:   common.StringPtr("tag:" + tagKey),
+			Values: common.StringPtrs([]string{tagVal}),
+		},
+	}
+	addresses, err := a.describeAddresses(nil, filters)
+	if err != nil {
+		return nil, fmt.Errorf("查询弹性公网IP失败: %v", err)
+	}
+	return addresses, nil
+}
+
+// DescribeAddresses 按ID查询弹性公网IP，不存在的ID不返回
+func (a *AClient) DescribeAddresses(addressIds []string) ([]*vpc.Address, error) {
+	if len(addressIds) == 0 {
+		return nil, nil
+	}
+	addresses, err := a.describeAddresses(addressIds, nil)
+	if err != nil {
+		return nil, fmt.Errorf("查询弹性公网IP %v 失败: %v", addressIds, err)
+	}
+	return addresses, nil
+}
+
+func (a *AClient) describeAddresses(addressIds []string, filters []*vpc.Filter) ([]*vpc.Address, error) {
+	addresses := make([]*vpc.Address, 0)
+	for offset := int64(0); ; offset += addressPageSize {
+		req := vpc.NewDescribeAddressesRequest()
+		if len(addressIds) > 0 {
+			req.AddressIds = common.StringPtrs(addressIds)
+		}
+		req.Filters = filters
+		req.Offset = common.Int64Ptr(offset)
+		req.Limit = common.Int64Ptr(addressPageSize)
+		resp, err := call(a.guard, "vpc.DescribeAddresses", func() (*vpc.DescribeAddressesResponse, error) {
+			return a.VpcClient.DescribeAddresses(req)
+		})
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, resp.Response.AddressSet...)
+		if len(resp.Response.AddressSet) < addressPageSize {
+			return addresses, nil
+		}
+	}
+}
+
+// AllocateAddresses 申请带标签的弹性公网IP，返回弹性公网IP的ID
+func (a *AClient) AllocateAddresses(p *AllocateEipP) ([]string, error) {
+	req := vpc.NewAllocateAddressesRequest()
+	req.AddressCount = common.Int64Ptr(p.Count)
+	req.AddressName = common.StringPtr(p.Name)
+	req.Tags = []*vpc.Tag{
+		{
+			Key:   common.StringPtr(p.TagKey),
+			Value: common.StringPtr(p.TagVal),
+		},
+	}
+	if p.ChargeType != "" {
+		req.InternetChargeType = common.StringPtr(p.ChargeType)
+	}
+	if p.BandwidthOut > 0 {
+		req.InternetMaxBandwidthOut = common.Int64Ptr(p.BandwidthOut)
+	}
+	if p.ISP != "" {
+		req.InternetServiceProvider = common.StringPtr(p.ISP)
+	}
+
+	resp, err := call(a.guard, "vpc.AllocateAddresses", func() (*vpc.AllocateAddressesResponse, error) {
+		return a.VpcClient.AllocateAddresses(req)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("申请弹性公网IP失败: %v", err)
+	}
+	ids := make([]string, 0, len(resp.Response.AddressSet))
+	for _, id := range resp.Response.AddressSet {
+		if id != nil {
+			ids = append(ids, *id)
+		}
+	}
+	return ids, nil
+}
+
+// AssociateAddress 将弹性公网IP绑定到实例的主网卡，实例已有的普通公网IP会被解绑并释放，绑定为异步操作
+func (a *AClient) AssociateAddress(addressId, instanceId string) error {
+	req := vpc.NewAssociateAddressRequest()
+	req.AddressId = common.StringPtr(addressId)
+	req.InstanceId = common.StringPtr(instanceId)
+	_, err := call(a.guard, "vpc.AssociateAddress", func() (*vpc.AssociateAddressResponse, error) {
+		return a.VpcClient.AssociateAddress(req)
+	})
+	if err != nil {
+		return fmt.Errorf("绑定弹性公网IP %s 到实例 %s 失败: %v", addressId, instanceId, err)
+	}
+	return nil
+}
+
+// ReleaseAddresses 释放未绑定的弹性公网IP
+func (a *AClient) ReleaseAddresses(addressIds []string) error {
+	req := vpc.NewReleaseAddressesRequest()
+	req.AddressIds = common.StringPtrs(addressIds)
+	_, err := call(a.guard, "vpc.ReleaseAddresses", func() (*vpc.ReleaseAddressesResponse, error) {
+		return a.VpcClient.ReleaseAddresses(req)
+	})
+	if err != nil {
+		return fmt.Errorf("释放弹性公网IP %v 失败: %v", addressIds, err)
+	}
+	return nil
+}
@@ -2,11 +2,15 @@ package tcloud
 
 import (
 	"cvmspot/utils"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"math"
-	"math/rand"
+	"net"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/olekukonko/tablewriter"
@@ -15,6 +19,7 @@ import (
 	"github.com/sirupsen/logrus"
 	cam "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cam/v20190116"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	sdkerrors "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
 	cvm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/cvm/v20170312"
 	dnspod "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/dnspod/v20210323"
@@ -26,6 +31,7 @@ type Client struct {
 	RegionClients map[string]*AClient
 	Cfg           *utils.Config
 	Log           *logrus.Logger
+	Guard         *APIGuard // 所有地域共用的接口重试和限频
 }
 
 // AClient 组合多个客户端
@@ -35,8 +41,10 @@ type AClient struct {
 	TagClient    *tag.Client
 	VpcClient    *vpc.Client
 	CamClient    *cam.Client
+	TatClient    *common.Client
 	Region       string
 	Log          *logrus.Logger
+	guard        *APIGuard
 }
 
 // SecurityGroupRule 定义安全组规则
@@ -61,6 +69,8 @@ type CreateIns struct {
 	InternetChargeType      string            // 网络计费模式 BANDWIDTH_PREPAID：预付费按带宽结算、TRAFFIC_POSTPAID_BY_HOUR：流量按小时后付费、BANDWIDTH_POSTPAID_BY_HOUR：带宽按小时后付费、BANDWIDTH_PACKAGE：带宽包用户
 	InternetMaxBandwidthOut int64             // 公网出宽带上限 单位：Mbps
 	PublicIpAssigned        bool              // 是否分配公网IP
+	Ipv6AddressCount        uint64            // 分配的IPv6地址数量，子网需已分配IPv6网段
+	IPv6AddressType         string            // 公网IPv6类型 EIPv6：弹性公网IPv6、HighQualityEIPv6：精品IPv6，为空时不分配公网IPv6
 	InternetServiceProvider string            // 线路类型 CMCC：中国移动、CTCC：中国电信、CUCC：中国联通 BGP 三网
 	IPv4AddressType         string            // 公网IP 类型 WanIP：普通公网IP、HighQualityEIP：精品 IP、AntiDDoSEIP：高防 IP
 	InstanceCount           int64             // 购买实例数量
@@ -82,6 +92,7 @@ type CreateIns struct {
 	ThreadPerCore           int64             // 每核心线程数。该参数决定是否开启或关闭超线程。 1 表示关闭超线程 2 表示开启超线程
 	LaunchTemplateId        string            // 实例启动模板ID，通过该参数可使用实例模板中的预设参数创建实例。
 	LaunchTemplateVersion   int64             // 实例启动模板版本号，若给定，新实例启动模板将基于给定的版本号创建
+	UserData                string            // 提供给实例使用的用户数据（已 base64 编码），实例启动时由 cloud-init 执行
 	DisableApiTermination   bool              // 实例销毁保护标志，表示是否允许通过api接口删除实例。取值范围： true：表示开启实例保护，不允许通过api接口删除实例  false：表示关闭实例保护，允许通过api接口删除实例
 }
 
@@ -108,6 +119,20 @@ type Instance struct {
 	Password           string              // 密码
 }
 
+// 用户数据原始内容最大 16KB
+const MaxUserDataSize = 16 * 1024
+
+// EncodeUserData 校验用户数据大小并进行 base64 编码
+func EncodeUserData(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", fmt.Errorf("用户数据为空")
+	}
+	if len(data) > MaxUserDataSize {
+		return "", fmt.Errorf("用户数据大小 %d 字节超过限制 %d 字节", len(data), MaxUserDataSize)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
 type SubVpcP struct {
 	TagKey     *string
 	TagVal     *string
@@ -124,11 +149,45 @@ type DnsRecordP struct {
 	RecordLine *string
 	Value      *string
 	TTL        *uint64
+	Remark     *string // 备注，用于标记 cvmspot 维护的记录
+	RecordId   *uint64 // 修改记录时使用
+	Weight     *uint64 // 权重 1-100，为空时不设置权重
 }
 
 type DnsRcordR struct {
-	PublicIp *string
-	RecordId *uint64
+	SubDomain  *string // 主机记录
+	Value      *string // 记录值，A/AAAA 记录为IP
+	RecordId   *uint64
+	RecordType *string
+	RecordLine *string
+	TTL        *uint64
+	Remark     *string
+	Weight     *uint64
+}
+
+// DNS记录类型
+const (
+	RecordA     = "A"
+	RecordAAAA  = "AAAA"
+	RecordCNAME = "CNAME"
+	RecordTXT   = "TXT"
+)
+
+// ConflictsWithAddress 同一主机记录下与 A/AAAA 记录冲突的记录类型（CNAME 和 URL 转发）
+func ConflictsWithAddress(recordType string) bool {
+	switch recordType {
+	case RecordCNAME, "显性URL", "隐性URL":
+		return true
+	}
+	return false
+}
+
+// DNSRecordType 返回IP对应的记录类型，IPv6地址为 AAAA
+func DNSRecordType(ip string) string {
+	if strings.Contains(ip, ":") {
+		return RecordAAAA
+	}
+	return RecordA
 }
 
 // NewClientWithLogger 为每个地域创建腾讯云客户端(带日志记录器)
@@ -141,6 +200,7 @@ func NewClientWithLogger(cfg utils.Config, log *logrus.Logger) (*Client, error)
 		RegionClients: make(map[string]*AClient),
 		Cfg:           &cfg,
 		Log:           log,
+		Guard:         NewAPIGuard(cfg.TConfig.APIRetry, log),
 	}
 
 	for _, mgr := range cfg.IBManager {
@@ -187,14 +247,21 @@ func NewClientWithLogger(cfg utils.Config, log *logrus.Logger) (*Client, error)
 				return nil, fmt.Errorf("创建Cam客户端失败: %v", err)
 			}
 
+			// 创建 TAT 客户端（SDK 未包含 TAT 模块，使用通用请求调用）
+			tatCpf := profile.NewClientProfile()
+			tatCpf.HttpProfile.Endpoint = "tat.tencentcloudapi.com"
+			tatClient := common.NewCommonClient(credential, region, tatCpf)
+
 			client.RegionClients[region] = &AClient{
 				CvmClient:    cvmClient,
 				DnspodClient: dnspodClient,
 				TagClient:    tagClient,
 				VpcClient:    vpcClient,
 				CamClient:    camClient,
+				TatClient:    tatClient,
 				Region:       region,
 				Log:          log,
+				guard:        client.Guard,
 			}
 
 			if cfg.Uin == "" {
@@ -260,7 +327,9 @@ func (c *Client) GetSpotPrice(regions []string, imageId string) (float64, string
 // 查询可用区
 func (a *AClient) getDescribeZones() ([]*cvm.ZoneInfo, error) {
 	request := cvm.NewDescribeZonesRequest()
-	response, err := a.CvmClient.DescribeZones(request)
+	response, err := call(a.guard, "cvm.DescribeZones", func() (*cvm.DescribeZonesResponse, error) {
+		return a.CvmClient.DescribeZones(request)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("查询可用区失败，错误：%v", err)
 	}
@@ -275,7 +344,9 @@ func (a *AClient) getInstancePrice(zone, imageId, instanceChargeType string, pri
 	}
 	request.ImageId = common.StringPtr(imageId)
 	request.InstanceChargeType = common.StringPtr(instanceChargeType)
-	response, err := a.CvmClient.InquiryPriceRunInstances(request)
+	response, err := call(a.guard, "cvm.InquiryPriceRunInstances", func() (*cvm.InquiryPriceRunInstancesResponse, error) {
+		return a.CvmClient.InquiryPriceRunInstances(request)
+	})
 	if err != nil || response.Response.Price.InstancePrice.UnitPriceDiscount == nil {
 		// err.(*errors.TencentCloudSDKError)
 		return fmt.Errorf("查询实例价格失败，错误 %v", err)
@@ -284,8 +355,8 @@ func (a *AClient) getInstancePrice(zone, imageId, instanceChargeType string, pri
 	return nil
 }
 
-// GetOrCreateSecurityGroup 存在则删除重新创建安全组
-func (a *AClient) GetOrCreateSecurityGroup(tagKey, tagVal string, sc *utils.SecurityGroupConfig) (string, error) {
+// FindSecurityGroups 查询带指定标签的安全组
+func (a *AClient) FindSecurityGroups(tagKey, tagVal string) ([]*vpc.SecurityGroup, error) {
 	req := vpc.NewDescribeSecurityGroupsRequest()
 
 	req.Filters = []*vpc.Filter{
@@ -296,43 +367,17 @@ func (a *AClient) GetOrCreateSecurityGroup(tagKey, tagVal string, sc *utils.Secu
 	}
 
 	// 返回的resp是一个DescribeSecurityGroupsResponse的实例，与请求对象对应
-	resp, err := a.VpcClient.DescribeSecurityGroups(req)
-
+	resp, err := call(a.guard, "vpc.DescribeSecurityGroups", func() (*vpc.DescribeSecurityGroupsResponse, error) {
+		return a.VpcClient.DescribeSecurityGroups(req)
+	})
 	if err != nil {
-		return "", fmt.Errorf("查询安全组失败: %v", err)
-	}
-
-	if *resp.Response.TotalCount > 0 {
-		//return *resp.Response.SecurityGroupSet[0].SecurityGroupId, nil
-		// 存在则先删除
-		for _, sec := range resp.Response.SecurityGroupSet {
-			a.delSec(sec.SecurityGroupId)
-		}
+		return nil, fmt.Errorf("查询安全组失败: %v", err)
 	}
+	return resp.Response.SecurityGroupSet, nil
+}
 
-	egress := make([]*vpc.SecurityGroupPolicy, 0)
-	ingress := make([]*vpc.SecurityGroupPolicy, 0)
-
-	for _, rule := range sc.Rules {
-		if rule.Type == "I" {
-			ingress = append(ingress, &vpc.SecurityGroupPolicy{
-				Protocol:          common.StringPtr(rule.Protocol),
-				Port:              common.StringPtr(rule.Port),
-				CidrBlock:         common.StringPtr(rule.CidrIp),
-				Action:            common.StringPtr(rule.Action),
-				PolicyDescription: common.StringPtr(rule.Description),
-			})
-		}
-		if rule.Type == "E" {
-			egress = append(egress, &vpc.SecurityGroupPolicy{
-				Protocol:          common.StringPtr(rule.Protocol),
-				Port:              common.StringPtr(rule.Port),
-				CidrBlock:         common.StringPtr(rule.CidrIp),
-				Action:            common.StringPtr(rule.Action),
-				PolicyDescription: common.StringPtr(rule.Description),
-			})
-		}
-	}
+// CreateSecurityGroup 按配置的规则创建带标签的安全组
+func (a *AClient) CreateSecurityGroup(tagKey, tagVal string, sc *utils.SecurityGroupConfig) (string, error) {
 	tags := make([]*vpc.Tag, 0)
 	tags = append(tags, &vpc.Tag{
 		Key:   common.StringPtr(tagKey),
@@ -343,13 +388,12 @@ func (a *AClient) GetOrCreateSecurityGroup(tagKey, tagVal string, sc *utils.Secu
 	creReq.GroupName = common.StringPtr(sc.SecurityName)
 	creReq.GroupDescription = common.StringPtr(sc.GroupDescription)
 	creReq.Tags = tags
-	creReq.SecurityGroupPolicySet = &vpc.SecurityGroupPolicySet{
-		Egress:  egress,
-		Ingress: ingress,
-	}
+	creReq.SecurityGroupPolicySet = SecurityGroupPolicies(sc.Rules)
 
 	// 返回的resp是一个CreateSecurityGroupWithPoliciesResponse的实例，与请求对象对应
-	response, err := a.VpcClient.CreateSecurityGroupWithPolicies(creReq)
+	response, err := call(a.guard, "vpc.CreateSecurityGroupWithPolicies", func() (*vpc.CreateSecurityGroupWithPoliciesResponse, error) {
+		return a.VpcClient.CreateSecurityGroupWithPolicies(creReq)
+	})
 	if err != nil {
 		return "", fmt.Errorf("创建安全组失败: %v", err)
 	}
@@ -357,48 +401,43 @@ func (a *AClient) GetOrCreateSecurityGroup(tagKey, tagVal string, sc *utils.Secu
 	return *response.Response.SecurityGroup.SecurityGroupId, nil
 }
 
-// 删除安全组
-func (a *AClient) delSec(SecurityGroupId *string) error {
-	request := vpc.NewDeleteSecurityGroupRequest()
-
-	request.SecurityGroupId = SecurityGroupId
-	_, err := a.VpcClient.DeleteSecurityGroup(request)
-
-	if err != nil {
-		return fmt.Errorf("删除安全组失败: %v", err)
-	}
-	return nil
-}
-
-func (a *AClient) FindOrCreateVpc(tagKey, tagVal, vpcName, cidrBlock *string) (string, error) {
-	// 查询带标签的VPC
+// FindVpc 查询带指定标签的VPC，不存在时返回空字符串
+func (a *AClient) FindVpc(tagKey, tagVal string) (string, error) {
 	req := vpc.NewDescribeVpcsRequest()
 	req.Filters = []*vpc.Filter{
 		{
-			Name:   common.StringPtr("tag:" + *tagKey),
-			Values: []*string{tagVal},
+			Name:   common.StringPtr("tag:" + tagKey),
+			Values: common.StringPtrs([]string{tagVal}),
 		},
 	}
 
-	resp, err := a.VpcClient.DescribeVpcs(req)
+	resp, err := call(a.guard, "vpc.DescribeVpcs", func() (*vpc.DescribeVpcsResponse, error) {
+		return a.VpcClient.DescribeVpcs(req)
+	})
 	if err != nil {
-		a.Log.Debugf("查询VPC失败: %v", err)
-	} else if *resp.Response.TotalCount > 0 {
+		return "", fmt.Errorf("查询VPC失败: %v", err)
+	}
+	if len(resp.Response.VpcSet) > 0 {
 		return *resp.Response.VpcSet[0].VpcId, nil
 	}
+	return "", nil
+}
 
-	// 创建新VPC
+// CreateVpc 创建带标签的VPC
+func (a *AClient) CreateVpc(tagKey, tagVal, vpcName, cidrBlock string) (string, error) {
 	createReq := vpc.NewCreateVpcRequest()
-	createReq.VpcName = vpcName
-	createReq.CidrBlock = cidrBlock
+	createReq.VpcName = common.StringPtr(vpcName)
+	createReq.CidrBlock = common.StringPtr(cidrBlock)
 	createReq.Tags = []*vpc.Tag{
 		{
-			Key:   tagKey,
-			Value: tagVal,
+			Key:   common.StringPtr(tagKey),
+			Value: common.StringPtr(tagVal),
 		},
 	}
 
-	createResp, err := a.VpcClient.CreateVpc(createReq)
+	createResp, err := call(a.guard, "vpc.CreateVpc", func() (*vpc.CreateVpcResponse, error) {
+		return a.VpcClient.CreateVpc(createReq)
+	})
 	if err != nil {
 		return "", fmt.Errorf("创建VPC失败: %v", err)
 	}
@@ -406,32 +445,38 @@ func (a *AClient) FindOrCreateVpc(tagKey, tagVal, vpcName, cidrBlock *string) (s
 	return *createResp.Response.Vpc.VpcId, nil
 }
 
-func (a *AClient) FindOrCreateSubnet(subVpcP *SubVpcP) (string, error) {
-	// 查询带标签的子网
+// FindSubnet 查询VPC内指定可用区带指定标签的子网，不存在时返回空字符串
+func (a *AClient) FindSubnet(vpcId, zone, tagKey, tagVal string) (string, error) {
 	req := vpc.NewDescribeSubnetsRequest()
 	req.Filters = []*vpc.Filter{
 		{
 			Name:   common.StringPtr("vpc-id"),
-			Values: []*string{subVpcP.VpcId},
+			Values: common.StringPtrs([]string{vpcId}),
 		},
 		{
 			Name:   common.StringPtr("zone"),
-			Values: []*string{subVpcP.Zone},
+			Values: common.StringPtrs([]string{zone}),
 		},
 		{
-			Name:   common.StringPtr("tag:" + *subVpcP.TagKey),
-			Values: []*string{subVpcP.TagVal},
+			Name:   common.StringPtr("tag:" + tagKey),
+			Values: common.StringPtrs([]string{tagVal}),
 		},
 	}
 
-	resp, err := a.VpcClient.DescribeSubnets(req)
+	resp, err := call(a.guard, "vpc.DescribeSubnets", func() (*vpc.DescribeSubnetsResponse, error) {
+		return a.VpcClient.DescribeSubnets(req)
+	})
 	if err != nil {
-		a.Log.Debugf("查询子网失败: %v", err)
-	} else if *resp.Response.TotalCount > 0 {
+		return "", fmt.Errorf("查询子网失败: %v", err)
+	}
+	if len(resp.Response.SubnetSet) > 0 {
 		return *resp.Response.SubnetSet[0].SubnetId, nil
 	}
+	return "", nil
+}
 
-	// 创建新子网
+// CreateSubnet 在VPC的指定可用区内创建带标签的子网
+func (a *AClient) CreateSubnet(subVpcP *SubVpcP) (string, error) {
 	createReq := vpc.NewCreateSubnetRequest()
 	createReq.VpcId = subVpcP.VpcId
 	createReq.SubnetName = subVpcP.SubnetName
@@ -444,7 +489,9 @@ func (a *AClient) FindOrCreateSubnet(subVpcP *SubVpcP) (string, error) {
 		},
 	}
 
-	createResp, err := a.VpcClient.CreateSubnet(createReq)
+	createResp, err := call(a.guard, "vpc.CreateSubnet", func() (*vpc.CreateSubnetResponse, error) {
+		return a.VpcClient.CreateSubnet(createReq)
+	})
 	if err != nil {
 		return "", fmt.Errorf("创建子网失败: %v", err)
 	}
@@ -452,47 +499,98 @@ func (a *AClient) FindOrCreateSubnet(subVpcP *SubVpcP) (string, error) {
 	return *createResp.Response.Subnet.SubnetId, nil
 }
 
-// 获取安全组和子网
-func (a *AClient) GetOrCreateVpcAndSg(ibm *utils.InstanceBindingManager, zone, tagKey string) (string, string, string, error) {
-	vpcId := ibm.Instance.VpcConfig.VpcId
-	subnetId := ibm.Instance.SubnetConfig.SubnetId
-	securityGroupId := ibm.Instance.SecurityGroups.SecurityGroupId
-	var err error
+// GetVpcIpv6CidrBlock 查询VPC的IPv6网段，未分配时返回空字符串
+func (a *AClient) GetVpcIpv6CidrBlock(vpcId string) (string, error) {
+	req := vpc.NewDescribeVpcsRequest()
+	req.VpcIds = common.StringPtrs([]string{vpcId})
+	resp, err := call(a.guard, "vpc.DescribeVpcs", func() (*vpc.DescribeVpcsResponse, error) {
+		return a.VpcClient.DescribeVpcs(req)
+	})
+	if err != nil {
+		return "", fmt.Errorf("查询VPC %s 失败: %v", vpcId, err)
+	}
+	if len(resp.Response.VpcSet) == 0 {
+		return "", fmt.Errorf("VPC %s 不存在", vpcId)
+	}
+	return utils.StringValue(resp.Response.VpcSet[0].Ipv6CidrBlock), nil
+}
 
-	if vpcId == "" {
-		vpcId, err = a.FindOrCreateVpc(&tagKey, &ibm.Instance.VpcConfig.TagVal, &ibm.Instance.VpcConfig.VpcName, &ibm.Instance.VpcConfig.CidrBlock)
-		if err != nil {
-			a.Log.Fatalf("创建VPC失败 %v", err)
-		}
+// GetSubnetIpv6CidrBlock 查询子网的IPv6网段，未分配时返回空字符串
+func (a *AClient) GetSubnetIpv6CidrBlock(subnetId string) (string, error) {
+	req := vpc.NewDescribeSubnetsRequest()
+	req.SubnetIds = common.StringPtrs([]string{subnetId})
+	resp, err := call(a.guard, "vpc.DescribeSubnets", func() (*vpc.DescribeSubnetsResponse, error) {
+		return a.VpcClient.DescribeSubnets(req)
+	})
+	if err != nil {
+		return "", fmt.Errorf("查询子网 %s 失败: %v", subnetId, err)
 	}
+	if len(resp.Response.SubnetSet) == 0 {
+		return "", fmt.Errorf("子网 %s 不存在", subnetId)
+	}
+	return utils.StringValue(resp.Response.SubnetSet[0].Ipv6CidrBlock), nil
+}
 
-	if subnetId == "" && vpcId != "" {
-		subnetId, err = a.FindOrCreateSubnet(&SubVpcP{
-			VpcId:      &vpcId,
-			TagKey:     &tagKey,
-			TagVal:     &ibm.Instance.SubnetConfig.TagVal,
-			SubnetName: &ibm.Instance.SubnetConfig.SubnetName,
-			CidrBlock:  &ibm.Instance.SubnetConfig.CidrBlock,
-			Zone:       &zone,
-		})
-		if err != nil {
-			a.Log.Fatalf("创建子网失败 %v", err)
-		}
+// AssignIpv6CidrBlock 为VPC申请IPv6网段（/56），返回分配的网段
+func (a *AClient) AssignIpv6CidrBlock(vpcId string) (string, error) {
+	req := vpc.NewAssignIpv6CidrBlockRequest()
+	req.VpcId = common.StringPtr(vpcId)
+	resp, err := call(a.guard, "vpc.AssignIpv6CidrBlock", func() (*vpc.AssignIpv6CidrBlockResponse, error) {
+		return a.VpcClient.AssignIpv6CidrBlock(req)
+	})
+	if err != nil {
+		return "", fmt.Errorf("VPC %s 申请IPv6网段失败: %v", vpcId, err)
 	}
+	return utils.StringValue(resp.Response.Ipv6CidrBlock), nil
+}
 
-	if securityGroupId == "" {
-		securityGroupId, err = a.GetOrCreateSecurityGroup(tagKey, ibm.Instance.SecurityGroups.TagVal, &ibm.Instance.SecurityGroups)
-		if err != nil {
-			a.Log.Fatalf("创建安全组失败 %v", err)
-		}
+// AssignIpv6SubnetCidrBlock 为子网分配IPv6网段（/64），网段需在VPC的IPv6网段内
+func (a *AClient) AssignIpv6SubnetCidrBlock(vpcId, subnetId, cidrBlock string) error {
+	req := vpc.NewAssignIpv6SubnetCidrBlockRequest()
+	req.VpcId = common.StringPtr(vpcId)
+	req.Ipv6SubnetCidrBlocks = []*vpc.Ipv6SubnetCidrBlock{
+		{
+			SubnetId:      common.StringPtr(subnetId),
+			Ipv6CidrBlock: common.StringPtr(cidrBlock),
+		},
+	}
+	_, err := call(a.guard, "vpc.AssignIpv6SubnetCidrBlock", func() (*vpc.AssignIpv6SubnetCidrBlockResponse, error) {
+		return a.VpcClient.AssignIpv6SubnetCidrBlock(req)
+	})
+	if err != nil {
+		return fmt.Errorf("子网 %s 分配IPv6网段 %s 失败: %v", subnetId, cidrBlock, err)
 	}
+	return nil
+}
 
-	return vpcId, subnetId, securityGroupId, nil
+// Ipv6SubnetCidrBlock 按序号（两位十六进制 00-ff，为空时为 00）从VPC的 /56 网段中划分子网的 /64 网段
+func Ipv6SubnetCidrBlock(vpcCidrBlock, index string) (string, error) {
+	ip, network, err := net.ParseCIDR(vpcCidrBlock)
+	if err != nil || ip.To4() != nil {
+		return "", fmt.Errorf("VPC的IPv6网段 %s 格式错误", vpcCidrBlock)
+	}
+	if ones, _ := network.Mask.Size(); ones != 56 {
+		return "", fmt.Errorf("VPC的IPv6网段 %s 不是 /56 网段", vpcCidrBlock)
+	}
+	if index == "" {
+		index = "00"
+	}
+	n, err := strconv.ParseUint(index, 16, 8)
+	if err != nil {
+		return "", fmt.Errorf("子网IPv6序号 %s 不是 00-ff 的十六进制数", index)
+	}
+	subnet := make(net.IP, net.IPv6len)
+	copy(subnet, network.IP.To16())
+	subnet[7] = byte(n)
+	return (&net.IPNet{IP: subnet, Mask: net.CIDRMask(64, 128)}).String(), nil
 }
 
 func (a *AClient) RunInstances(ins *CreateIns) ([]*string, error) {
 
 	req := cvm.NewRunInstancesRequest()
+	if ins.ClientToken != "" {
+		req.ClientToken = common.StringPtr(ins.ClientToken)
+	}
 	req.InstanceType = common.StringPtr(ins.InstanceType)
 	req.ImageId = common.StringPtr(ins.ImageId)
 	req.InstanceChargeType = common.StringPtr(ins.InstanceChargeType)
@@ -504,15 +602,23 @@ func (a *AClient) RunInstances(ins *CreateIns) ([]*string, error) {
 		VpcId:    common.StringPtr(ins.VpcId),
 		SubnetId: common.StringPtr(ins.SubnetId),
 	}
+	if ins.Ipv6AddressCount > 0 {
+		req.VirtualPrivateCloud.Ipv6AddressCount = common.Uint64Ptr(ins.Ipv6AddressCount)
+	}
 	// 设置SystemDisk
 	req.SystemDisk = &cvm.SystemDisk{
 		DiskType: common.StringPtr(ins.DiskType),
 		DiskSize: common.Int64Ptr(ins.DiskSize),
 	}
 	// 设置InternetAccessible
+	// 公网带宽为0时不分配公网IP（仅私网访问，需经跳板机连接），弹性公网IP模式下同样不分配普通公网IP
 	req.InternetAccessible = &cvm.InternetAccessible{
 		InternetChargeType:      common.StringPtr(ins.InternetChargeType),
 		InternetMaxBandwidthOut: common.Int64Ptr(ins.InternetMaxBandwidthOut),
+		PublicIpAssigned:        common.BoolPtr(ins.PublicIpAssigned),
+	}
+	if ins.IPv6AddressType != "" {
+		req.InternetAccessible.IPv6AddressType = common.StringPtr(ins.IPv6AddressType)
 	}
 
 	// 设置默认InstanceChargeType
@@ -537,6 +643,19 @@ func (a *AClient) RunInstances(ins *CreateIns) ([]*string, error) {
 	req.LoginSettings = &cvm.LoginSettings{
 		Password: common.StringPtr(ins.Password),
 	}
+	if ins.UserData != "" {
+		req.UserData = common.StringPtr(ins.UserData)
+	}
+	if ins.DryRun {
+		req.DryRun = common.BoolPtr(true)
+	}
+	if ins.AutomationService {
+		req.EnhancedService = &cvm.EnhancedService{
+			AutomationService: &cvm.RunAutomationServiceEnabled{
+				Enabled: common.BoolPtr(true),
+			},
+		}
+	}
 
 	// 详细日志记录
 	a.Log.WithFields(logrus.Fields{
@@ -550,20 +669,41 @@ func (a *AClient) RunInstances(ins *CreateIns) ([]*string, error) {
 		"磁盘类型":  req.SystemDisk.DiskType,
 		"磁盘容量":  req.SystemDisk.DiskSize,
 		"公网带宽":  req.InternetAccessible.InternetMaxBandwidthOut,
+		"IPv6":  req.VirtualPrivateCloud.Ipv6AddressCount,
 		"计费类型":  req.InstanceChargeType,
 		"实例数量":  req.InstanceCount,
 		"标签":    req.TagSpecification,
 	}).Debug("创建实例请求参数")
 
 	// 调用API创建
-	resp, err := a.CvmClient.RunInstances(req)
+	run := call[*cvm.RunInstancesResponse]
+	if ins.ClientToken != "" {
+		// 相同 ClientToken 的请求不会重复创建实例，可以安全重试
+		run = callWithToken[*cvm.RunInstancesResponse]
+	}
+	resp, err := run(a.guard, "cvm.RunInstances", func() (*cvm.RunInstancesResponse, error) {
+		return a.CvmClient.RunInstances(req)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("实例创建失败: %v", err)
+		return nil, fmt.Errorf("实例创建失败: %w", err)
 	}
 
 	return resp.Response.InstanceIdSet, nil
 }
 
+// DryRunInstances 预检创建实例请求（必填参数、业务限制和库存），不会创建实例，预检通过时返回 nil
+func (a *AClient) DryRunInstances(ins *CreateIns) error {
+	check := *ins
+	check.DryRun = true
+	check.ClientToken = ""
+	_, err := a.RunInstances(&check)
+	var sdkErr *sdkerrors.TencentCloudSDKError
+	if errors.As(err, &sdkErr) && sdkErr.GetCode() == "DryRunOperation" {
+		return nil
+	}
+	return err
+}
+
 // AddDNSRecord 添加DNS记录
 func (a *AClient) AddDNSRecord(dp *DnsRecordP) error {
 	req := dnspod.NewCreateRecordRequest()
@@ -573,8 +713,12 @@ func (a *AClient) AddDNSRecord(dp *DnsRecordP) error {
 	req.RecordLine = dp.RecordLine
 	req.Value = dp.Value
 	req.TTL = dp.TTL
+	req.Remark = dp.Remark
+	req.Weight = dp.Weight
 
-	_, err := a.DnspodClient.CreateRecord(req)
+	_, err := call(a.guard, "dnspod.CreateRecord", func() (*dnspod.CreateRecordResponse, error) {
+		return a.DnspodClient.CreateRecord(req)
+	})
 	if err != nil {
 		return fmt.Errorf("添加DNS记录失败: %v", err)
 
@@ -582,6 +726,28 @@ func (a *AClient) AddDNSRecord(dp *DnsRecordP) error {
 	return nil
 }
 
+// ModifyDNSRecord 修改DNS记录的值、线路、TTL和备注，保留记录ID
+func (a *AClient) ModifyDNSRecord(dp *DnsRecordP) error {
+	req := dnspod.NewModifyRecordRequest()
+	req.Domain = dp.Domain
+	req.RecordId = dp.RecordId
+	req.SubDomain = dp.SubDomain
+	req.RecordType = dp.RecordType
+	req.RecordLine = dp.RecordLine
+	req.Value = dp.Value
+	req.TTL = dp.TTL
+	req.Remark = dp.Remark
+	req.Weight = dp.Weight
+
+	_, err := call(a.guard, "dnspod.ModifyRecord", func() (*dnspod.ModifyRecordResponse, error) {
+		return a.DnspodClient.ModifyRecord(req)
+	})
+	if err != nil {
+		return fmt.Errorf("修改DNS记录失败: %v", err)
+	}
+	return nil
+}
+
 // getInstanceCount 获取实例数
 // 参数说明（可选）
 // 返回值说明（可选）
@@ -595,7 +761,9 @@ func (a *AClient) GetInstanceCount(tagKey, tagVal string) (int64, error) {
 		},
 	}
 
-	resp, err := a.CvmClient.DescribeInstances(req)
+	resp, err := call(a.guard, "cvm.DescribeInstances", func() (*cvm.DescribeInstancesResponse, error) {
+		return a.CvmClient.DescribeInstances(req)
+	})
 	if err != nil {
 		return 0, fmt.Errorf("failed to describe instances: %v", err)
 	}
@@ -612,7 +780,37 @@ func (a *AClient) GetInsInfo(tagKey, tagVal string) ([]*cvm.Instance, error) {
 		},
 	}
 
-	resp, err := a.CvmClient.DescribeInstances(req)
+	// 分页查询全部实例，默认每页只返回20条
+	const limit = 100
+	req.Limit = common.Int64Ptr(limit)
+	instances := make([]*cvm.Instance, 0)
+	for offset := int64(0); ; offset += limit {
+		req.Offset = common.Int64Ptr(offset)
+		resp, err := call(a.guard, "cvm.DescribeInstances", func() (*cvm.DescribeInstancesResponse, error) {
+			return a.CvmClient.DescribeInstances(req)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("获取实例列表错误: %v", err)
+		}
+		instances = append(instances, resp.Response.InstanceSet...)
+		if len(resp.Response.InstanceSet) < limit {
+			return instances, nil
+		}
+	}
+}
+
+// GetInstancesByIds 按实例ID查询实例，不存在的实例不会返回
+func (a *AClient) GetInstancesByIds(instanceIds []string) ([]*cvm.Instance, error) {
+	if len(instanceIds) == 0 {
+		return nil, nil
+	}
+	req := cvm.NewDescribeInstancesRequest()
+	req.InstanceIds = common.StringPtrs(instanceIds)
+	req.Limit = common.Int64Ptr(100)
+
+	resp, err := call(a.guard, "cvm.DescribeInstances", func() (*cvm.DescribeInstancesResponse, error) {
+		return a.CvmClient.DescribeInstances(req)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("获取实例列表错误: %v", err)
 	}
@@ -647,48 +845,23 @@ func (c *Client) ExecuteCommands(instanceId string, commands []string, logPath s
 	return string(output), nil
 }
 
-// RandomDelete 随机删除指定数量的实例
-func (a *AClient) RandomDelete(count int64) error {
-	if count <= 0 {
-		return nil
-	}
-
-	// 获取所有实例
-	req := cvm.NewDescribeInstancesRequest()
-	resp, err := a.CvmClient.DescribeInstances(req)
-	if err != nil {
-		return fmt.Errorf("获取实例列表失败: %v", err)
-	}
-
-	instances := resp.Response.InstanceSet
-	if len(instances) == 0 {
-		return nil
-	}
-
-	// 随机选择实例
-	rand.Shuffle(len(instances), func(i, j int) {
-		instances[i], instances[j] = instances[j], instances[i]
-	})
-
-	// 限制删除数量不超过实例总数
-	if count > int64(len(instances)) {
-		count = int64(len(instances))
-	}
-
-	// 删除选中的实例
-	for i := int64(0); i < count; i++ {
-		instanceId := instances[i].InstanceId
+// TerminateInstances 逐个删除指定的实例，返回删除成功的实例ID
+func (a *AClient) TerminateInstances(instanceIds []string) []string {
+	deleted := make([]string, 0, len(instanceIds))
+	for _, instanceId := range instanceIds {
 		delReq := cvm.NewTerminateInstancesRequest()
-		delReq.InstanceIds = []*string{instanceId}
-		_, err := a.CvmClient.TerminateInstances(delReq)
+		delReq.InstanceIds = common.StringPtrs([]string{instanceId})
+		_, err := call(a.guard, "cvm.TerminateInstances", func() (*cvm.TerminateInstancesResponse, error) {
+			return a.CvmClient.TerminateInstances(delReq)
+		})
 		if err != nil {
-			a.Log.Errorf("删除实例 %s 失败: %v", *instanceId, err)
+			a.Log.Errorf("删除实例 %s 失败: %v", instanceId, err)
 			continue
 		}
-		a.Log.Infof("成功删除实例 %s", *instanceId)
+		a.Log.Infof("成功删除实例 %s", instanceId)
+		deleted = append(deleted, instanceId)
 	}
-
-	return nil
+	return deleted
 }
 
 func (a *AClient) RemoveDNSRecord(domain *string, recordId *uint64) error {
@@ -697,7 +870,9 @@ func (a *AClient) RemoveDNSRecord(domain *string, recordId *uint64) error {
 	request.Domain = domain
 	request.RecordId = recordId
 	// 返回的resp是一个DeleteRecordResponse的实例，与请求对象对应
-	_, err := a.DnspodClient.DeleteRecord(request)
+	_, err := call(a.guard, "dnspod.DeleteRecord", func() (*dnspod.DeleteRecordResponse, error) {
+		return a.DnspodClient.DeleteRecord(request)
+	})
 
 	if err != nil {
 		return fmt.Errorf("记录删除失败 %v", err)
@@ -705,6 +880,7 @@ func (a *AClient) RemoveDNSRecord(domain *string, recordId *uint64) error {
 	return nil
 }
 
+// GetDnsRecordList 查询子域名下的全部记录，子域名下没有记录时返回空列表
 func (c *AClient) GetDnsRecordList(Domain, Subdomain *string) ([]*DnsRcordR, error) {
 	// 实例化一个请求对象,每个接口都会对应一个request对象
 	request := dnspod.NewDescribeRecordListRequest()
@@ -712,22 +888,66 @@ func (c *AClient) GetDnsRecordList(Domain, Subdomain *string) ([]*DnsRcordR, err
 	request.Domain = Domain
 	request.Subdomain = Subdomain
 	// 返回的resp是一个DescribeRecordListResponse的实例，与请求对象对应
-	response, err := c.DnspodClient.DescribeRecordList(request)
+	response, err := call(c.guard, "dnspod.DescribeRecordList", func() (*dnspod.DescribeRecordListResponse, error) {
+		return c.DnspodClient.DescribeRecordList(request)
+	})
+	var sdkErr *sdkerrors.TencentCloudSDKError
+	if errors.As(err, &sdkErr) && sdkErr.GetCode() == "ResourceNotFound.NoDataOfRecord" {
+		return []*DnsRcordR{}, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("获取域名 %s.%s 解析信息失败 %v", *Subdomain, *Domain, err)
 	}
 	drList := make([]*DnsRcordR, 0)
 
 	for _, record := range response.Response.RecordList {
-		if *record.Type == "A" {
+		drList = append(drList, &DnsRcordR{
+			SubDomain:  record.Name,
+			RecordId:   record.RecordId,
+			Value:      record.Value,
+			RecordType: record.Type,
+			RecordLine: record.Line,
+			TTL:        record.TTL,
+			Remark:     record.Remark,
+			Weight:     record.Weight,
+		})
+	}
+	return drList, nil
+
+}
+
+// GetDomainRecordList 分页查询域名下的全部记录
+func (c *AClient) GetDomainRecordList(domain string) ([]*DnsRcordR, error) {
+	request := dnspod.NewDescribeRecordListRequest()
+	request.Domain = common.StringPtr(domain)
+
+	const limit = 3000
+	request.Limit = common.Uint64Ptr(limit)
+	drList := make([]*DnsRcordR, 0)
+	for offset := uint64(0); ; offset += limit {
+		request.Offset = common.Uint64Ptr(offset)
+		response, err := call(c.guard, "dnspod.DescribeRecordList", func() (*dnspod.DescribeRecordListResponse, error) {
+			return c.DnspodClient.DescribeRecordList(request)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("获取域名 %s 解析记录失败 %v", domain, err)
+		}
+		for _, record := range response.Response.RecordList {
 			drList = append(drList, &DnsRcordR{
-				RecordId: record.RecordId,
-				PublicIp: record.Value,
+				SubDomain:  record.Name,
+				RecordId:   record.RecordId,
+				Value:      record.Value,
+				RecordType: record.Type,
+				RecordLine: record.Line,
+				TTL:        record.TTL,
+				Remark:     record.Remark,
+				Weight:     record.Weight,
 			})
 		}
+		if len(response.Response.RecordList) < limit {
+			return drList, nil
+		}
 	}
-	return drList, nil
-
 }
 
 func (c *Client) GetInsMap(insMap *map[string]*Instance) {
@@ -742,6 +962,9 @@ func (c *Client) GetInsMap(insMap *map[string]*Instance) {
 				for _, ipPtr := range instance.PublicIpAddresses {
 					ips = append(ips, *ipPtr) // 解引用
 				}
+				for _, ipPtr := range instance.IPv6Addresses {
+					ips = append(ips, *ipPtr)
+				}
 
 				ipStr := strings.Join(ips, ",")
 				resIpStr := "N/A"
@@ -769,24 +992,37 @@ func (c *Client) GetInsMap(insMap *map[string]*Instance) {
 				}
 			}
 
-			// 查询实例标签
-			rows, err := c.RegionClients[region].GetTag(mgr.DomainBinding.TagKey, "")
-			if err != nil {
-				c.Log.Errorln(err)
-			} else {
-				if len(*insMap) > 0 {
-					for _, res := range rows {
-						if *res.ServiceType == "cvm" && *res.ResourcePrefix == "instance" && *res.ResourceRegion == region {
-							for _, tag := range res.Tags {
-								if *tag.TagKey == mgr.DomainBinding.TagKey {
-									(*insMap)[*res.ResourceId].DomainName = *tag.TagValue
-								}
+			// 查询实例标签，多个域名绑定的域名以逗号分隔
+			tagKeys := make([]string, 0)
+			for _, db := range mgr.Bindings() {
+				if db.TagKey != "" && !slices.Contains(tagKeys, db.TagKey) {
+					tagKeys = append(tagKeys, db.TagKey)
+				}
+			}
+			for _, tagKey := range tagKeys {
+				rows, err := c.RegionClients[region].GetTag(tagKey, "")
+				if err != nil {
+					c.Log.Errorln(err)
+					continue
+				}
+				for _, res := range rows {
+					if *res.ServiceType == "cvm" && *res.ResourcePrefix == "instance" && *res.ResourceRegion == region {
+						instance, ok := (*insMap)[*res.ResourceId]
+						if !ok {
+							continue
+						}
+						for _, tag := range res.Tags {
+							if *tag.TagKey != tagKey {
+								continue
+							}
+							if instance.DomainName == "N/A" {
+								instance.DomainName = *tag.TagValue
+							} else {
+								instance.DomainName += ", " + *tag.TagValue
 							}
 						}
-
 					}
 				}
-
 			}
 
 		}
@@ -875,36 +1111,68 @@ func (c *Client) DeleteInstances(instanceIDs []string) {
 		}
 	}
 
+	hostKeys, err := utils.NewHostKeyStore(c.Cfg.SshConfig.KnownHostsPath)
+	if err != nil {
+		fmt.Printf("加载主机密钥记录失败: %v \n", err)
+	}
+	states, err := utils.NewProvisionStore(c.Cfg.Provision.StatePath)
+	if err != nil {
+		fmt.Printf("加载实例初始化状态失败: %v \n", err)
+	}
+
 	for region, instanceIds := range insIdToReg {
 		req := cvm.NewTerminateInstancesRequest()
 		req.InstanceIds = instanceIds
-		_, err := c.RegionClients[region].CvmClient.TerminateInstances(req)
+		_, err := call(c.RegionClients[region].guard, "cvm.TerminateInstances", func() (*cvm.TerminateInstancesResponse, error) {
+			return c.RegionClients[region].CvmClient.TerminateInstances(req)
+		})
 		if err != nil {
 			fmt.Printf("删除实例错误: %v \n", err)
+			continue
+		}
+		fmt.Printf("成功删除实例: %v \n", common.StringValues(instanceIds))
+
+		// 清理已删除实例的主机密钥和初始化状态记录
+		if hostKeys != nil {
+			if err := hostKeys.Remove(common.StringValues(instanceIds)...); err != nil {
+				fmt.Printf("清理主机密钥记录失败: %v \n", err)
+			}
+		}
+		if states != nil {
+			if err := states.Remove(common.StringValues(instanceIds)...); err != nil {
+				fmt.Printf("清理初始化状态记录失败: %v \n", err)
+			}
 		}
-		fmt.Printf("成功删除实例: %v \n", instanceIDs)
 	}
 }
 
 // 获取用户UIN
 func (a *AClient) GetUserUin() (string, error) {
 	request := cam.NewGetUserAppIdRequest()
-	response, err := a.CamClient.GetUserAppId(request)
+	response, err := call(a.guard, "cam.GetUserAppId", func() (*cam.GetUserAppIdResponse, error) {
+		return a.CamClient.GetUserAppId(request)
+	})
 	if err != nil {
 		return "", fmt.Errorf("获取用户Uin失败: %v", err)
 	}
 	return *response.Response.Uin, nil
 }
 
-// 添加标签
+// 添加标签，实例已有该标签键时修改标签值
 func (c *AClient) AddTag(tagKey, tagVal, region, Uin, insId string) error {
-	request := tag.NewAddResourceTagRequest()
+	request := tag.NewModifyResourceTagsRequest()
 
-	request.TagKey = &tagKey
-	request.TagValue = &tagVal
 	request.Resource = common.StringPtr("qcs::cvm:" + region + ":uin/" + Uin + ":instance/" + insId)
-	// 返回的resp是一个AddResourceTagResponse的实例，与请求对象对应
-	_, err := c.TagClient.AddResourceTag(request)
+	request.ReplaceTags = []*tag.Tag{
+		{
+			TagKey:   common.StringPtr(tagKey),
+			TagValue: common.StringPtr(tagVal),
+		},
+	}
+	// 返回的resp是一个ModifyResourceTagsResponse的实例，与请求对象对应
+	_, err := call(c.guard, "tag.ModifyResourceTags", func() (*tag.ModifyResourceTagsResponse, error) {
+		return c.TagClient.ModifyResourceTags(request)
+	})
 	if err != nil {
 		return fmt.Errorf("添加标签失败: %v", err)
 	}
@@ -930,10 +1198,22 @@ func (c *AClient) GetTag(tagKey, tagVal string) ([]*tag.ResourceTag, error) {
 		}
 	}
 
-	// 返回的resp是一个DescribeResourcesByTagsResponse的实例，与请求对象对应
-	response, err := c.TagClient.DescribeResourcesByTags(request)
-	if err != nil {
-		return nil, fmt.Errorf("查询标签失败: %v", err)
+	// 分页查询全部资源，默认每页只返回15条
+	const limit = 100
+	request.Limit = common.Uint64Ptr(limit)
+	rows := make([]*tag.ResourceTag, 0)
+	for offset := uint64(0); ; offset += limit {
+		request.Offset = common.Uint64Ptr(offset)
+		// 返回的resp是一个DescribeResourcesByTagsResponse的实例，与请求对象对应
+		response, err := call(c.guard, "tag.DescribeResourcesByTags", func() (*tag.DescribeResourcesByTagsResponse, error) {
+			return c.TagClient.DescribeResourcesByTags(request)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("查询标签失败: %v", err)
+		}
+		rows = append(rows, response.Response.Rows...)
+		if len(response.Response.Rows) < limit {
+			return rows, nil
+		}
 	}
-	return response.Response.Rows, nil
 }
@@ -0,0 +1,35 @@
+package tcloud
+
+import "testing"
+
+func TestIpv6SubnetCidrBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		vpc     string
+		index   string
+		want    string
+		wantErr bool
+	}{
+		{name: "默认序号", vpc: "2402:4e00:1013:e500::/56", want: "2402:4e00:1013:e500::/64"},
+		{name: "序号01", vpc: "2402:4e00:1013:e500::/56", index: "01", want: "2402:4e00:1013:e501::/64"},
+		{name: "序号ff", vpc: "2402:4e00:1013:e500::/56", index: "ff", want: "2402:4e00:1013:e5ff::/64"},
+		{name: "大写序号", vpc: "2402:4e00:1013:e500::/56", index: "A0", want: "2402:4e00:1013:e5a0::/64"},
+		{name: "网段带主机位", vpc: "2402:4e00:1013:e5ab::1/56", index: "02", want: "2402:4e00:1013:e502::/64"},
+		{name: "序号超出范围", vpc: "2402:4e00:1013:e500::/56", index: "100", wantErr: true},
+		{name: "序号不是十六进制", vpc: "2402:4e00:1013:e500::/56", index: "zz", wantErr: true},
+		{name: "不是 /56 网段", vpc: "2402:4e00:1013:e500::/64", wantErr: true},
+		{name: "IPv4 网段", vpc: "10.0.0.0/16", wantErr: true},
+		{name: "格式错误", vpc: "2402:4e00::", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Ipv6SubnetCidrBlock(tt.vpc, tt.index)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Ipv6SubnetCidrBlock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Ipv6SubnetCidrBlock() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
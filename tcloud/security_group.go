@@ -0,0 +1,202 @@
+package tcloud
+
+import (
+	"cvmspot/utils"
+	"fmt"
+	"strings"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	vpc "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vpc/v20170312"
+)
+
+// 安全组规则类型
+const (
+	RuleIngress = "I"  // 入站
+	RuleEgress  = "E"  // 出站
+	RuleBoth    = "IE" // 入站和出站
+)
+
+// SecurityGroupPolicies 将配置的规则转换为安全组规则集合，IE 类型同时生成入站和出站规则
+func SecurityGroupPolicies(rules []utils.RuleConfig) *vpc.SecurityGroupPolicySet {
+	set := &vpc.SecurityGroupPolicySet{
+		Ingress: make([]*vpc.SecurityGroupPolicy, 0),
+		Egress:  make([]*vpc.SecurityGroupPolicy, 0),
+	}
+	for _, rule := range rules {
+		switch strings.ToUpper(rule.Type) {
+		case RuleIngress:
+			set.Ingress = append(set.Ingress, newPolicy(rule))
+		case RuleEgress:
+			set.Egress = append(set.Egress, newPolicy(rule))
+		case RuleBoth:
+			set.Ingress = append(set.Ingress, newPolicy(rule))
+			set.Egress = append(set.Egress, newPolicy(rule))
+		}
+	}
+	return set
+}
+
+// newPolicy 生成单条安全组规则，包含 : 的网段为 IPv6 网段
+func newPolicy(rule utils.RuleConfig) *vpc.SecurityGroupPolicy {
+	policy := &vpc.SecurityGroupPolicy{
+		Protocol:          common.StringPtr(rule.Protocol),
+		Port:              common.StringPtr(rule.Port),
+		Action:            common.StringPtr(rule.Action),
+		PolicyDescription: common.StringPtr(rule.Description),
+	}
+	if strings.Contains(rule.CidrIp, ":") {
+		policy.Ipv6CidrBlock = common.StringPtr(rule.CidrIp)
+	} else {
+		policy.CidrBlock = common.StringPtr(rule.CidrIp)
+	}
+	return policy
+}
+
+// DescribeSecurityGroupPolicies 查询安全组的入站和出站规则
+func (a *AClient) DescribeSecurityGroupPolicies(securityGroupId string) (*vpc.SecurityGroupPolicySet, error) {
+	req := vpc.NewDescribeSecurityGroupPoliciesRequest()
+	req.SecurityGroupId = common.StringPtr(securityGroupId)
+	resp, err := call(a.guard, "vpc.DescribeSecurityGroupPolicies", func() (*vpc.DescribeSecurityGroupPoliciesResponse, error) {
+		return a.VpcClient.DescribeSecurityGroupPolicies(req)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询安全组 %s 规则失败: %v", securityGroupId, err)
+	}
+	return resp.Response.SecurityGroupPolicySet, nil
+}
+
+// CreateSecurityGroupPolicies 在安全组规则末尾追加规则，一次只能追加一个方向的规则
+func (a *AClient) CreateSecurityGroupPolicies(securityGroupId string, set *vpc.SecurityGroupPolicySet) error {
+	req := vpc.NewCreateSecurityGroupPoliciesRequest()
+	req.SecurityGroupId = common.StringPtr(securityGroupId)
+	req.SecurityGroupPolicySet = set
+	_, err := call(a.guard, "vpc.CreateSecurityGroupPolicies", func() (*vpc.CreateSecurityGroupPoliciesResponse, error) {
+		return a.VpcClient.CreateSecurityGroupPolicies(req)
+	})
+	if err != nil {
+		return fmt.Errorf("添加安全组 %s 规则失败: %v", securityGroupId, err)
+	}
+	return nil
+}
+
+// DeleteSecurityGroupPolicies 按规则内容删除安全组规则，一次只能删除一个方向的规则
+func (a *AClient) DeleteSecurityGroupPolicies(securityGroupId string, set *vpc.SecurityGroupPolicySet) error {
+	req := vpc.NewDeleteSecurityGroupPoliciesRequest()
+	req.SecurityGroupId = common.StringPtr(securityGroupId)
+	req.SecurityGroupPolicySet = set
+	_, err := call(a.guard, "vpc.DeleteSecurityGroupPolicies", func() (*vpc.DeleteSecurityGroupPoliciesResponse, error) {
+		return a.VpcClient.DeleteSecurityGroupPolicies(req)
+	})
+	if err != nil {
+		return fmt.Errorf("删除安全组 %s 规则失败: %v", securityGroupId, err)
+	}
+	return nil
+}
+
+// ModifySecurityGroupPolicies 重置安全组的全部入站和出站规则，version 为查询规则时返回的版本号
+func (a *AClient) ModifySecurityGroupPolicies(securityGroupId, version string, set *vpc.SecurityGroupPolicySet) error {
+	req := vpc.NewModifySecurityGroupPoliciesRequest()
+	req.SecurityGroupId = common.StringPtr(securityGroupId)
+	req.SecurityGroupPolicySet = &vpc.SecurityGroupPolicySet{
+		Version: common.StringPtr(version),
+		Ingress: set.Ingress,
+		Egress:  set.Egress,
+	}
+	_, err := call(a.guard, "vpc.ModifySecurityGroupPolicies", func() (*vpc.ModifySecurityGroupPoliciesResponse, error) {
+		return a.VpcClient.ModifySecurityGroupPolicies(req)
+	})
+	if err != nil {
+		return fmt.Errorf("重置安全组 %s 规则失败: %v", securityGroupId, err)
+	}
+	return nil
+}
+
+// PolicyDiff 单个方向的安全组规则差异
+type PolicyDiff struct {
+	Remove []*vpc.SecurityGroupPolicy // 需要删除的现有规则
+	Add    []*vpc.SecurityGroupPolicy // 需要追加到末尾的规则
+	Reset  bool                       // 保留规则的顺序或描述与配置不一致，需要重置全部规则
+}
+
+// Changed 是否存在差异
+func (d PolicyDiff) Changed() bool {
+	return d.Reset || len(d.Remove) > 0 || len(d.Add) > 0
+}
+
+// DiffSecurityGroupPolicies 对比单个方向的配置规则和现有规则
+// 删除配置中不存在的规则后，剩余规则需与配置规则的前缀一致，配置中多出的规则追加到末尾；否则需要重置全部规则
+func DiffSecurityGroupPolicies(desired, actual []*vpc.SecurityGroupPolicy) PolicyDiff {
+	want := make(map[string]int, len(desired))
+	for _, p := range desired {
+		want[PolicyKey(p)]++
+	}
+
+	var diff PolicyDiff
+	kept := make([]*vpc.SecurityGroupPolicy, 0, len(actual))
+	for _, p := range actual {
+		key := PolicyKey(p)
+		if want[key] > 0 {
+			want[key]--
+			kept = append(kept, p)
+			continue
+		}
+		diff.Remove = append(diff.Remove, matchPolicy(p))
+	}
+
+	for i, p := range kept {
+		if PolicyKey(desired[i]) != PolicyKey(p) || utils.StringValue(desired[i].PolicyDescription) != utils.StringValue(p.PolicyDescription) {
+			return PolicyDiff{Reset: true}
+		}
+	}
+	diff.Add = desired[len(kept):]
+	return diff
+}
+
+// PolicyKey 返回规则的比较键（协议、端口、网段、动作），协议、端口和动作不区分大小写
+func PolicyKey(p *vpc.SecurityGroupPolicy) string {
+	port := strings.ToUpper(utils.StringValue(p.Port))
+	if port == "" {
+		port = "ALL"
+	}
+	target := utils.StringValue(p.CidrBlock)
+	switch {
+	case target != "":
+	case utils.StringValue(p.Ipv6CidrBlock) != "":
+		target = strings.ToLower(utils.StringValue(p.Ipv6CidrBlock))
+	case utils.StringValue(p.SecurityGroupId) != "":
+		target = "sg:" + utils.StringValue(p.SecurityGroupId)
+	case p.AddressTemplate != nil:
+		target = "template:" + utils.StringValue(p.AddressTemplate.AddressId) + utils.StringValue(p.AddressTemplate.AddressGroupId)
+	}
+	return fmt.Sprintf("%s %s %s %s", strings.ToUpper(utils.StringValue(p.Protocol)), port, target, strings.ToUpper(utils.StringValue(p.Action)))
+}
+
+// DescribePolicy 返回规则的可读描述
+func DescribePolicy(p *vpc.SecurityGroupPolicy) string {
+	if desc := utils.StringValue(p.PolicyDescription); desc != "" {
+		return fmt.Sprintf("%s（%s）", PolicyKey(p), desc)
+	}
+	return PolicyKey(p)
+}
+
+// matchPolicy 复制规则内容用于按内容匹配删除，不含随规则变更变化的 PolicyIndex，空字段不传
+func matchPolicy(p *vpc.SecurityGroupPolicy) *vpc.SecurityGroupPolicy {
+	return &vpc.SecurityGroupPolicy{
+		Protocol:          nonEmpty(p.Protocol),
+		Port:              nonEmpty(p.Port),
+		ServiceTemplate:   p.ServiceTemplate,
+		CidrBlock:         nonEmpty(p.CidrBlock),
+		Ipv6CidrBlock:     nonEmpty(p.Ipv6CidrBlock),
+		SecurityGroupId:   nonEmpty(p.SecurityGroupId),
+		AddressTemplate:   p.AddressTemplate,
+		Action:            nonEmpty(p.Action),
+		PolicyDescription: p.PolicyDescription,
+	}
+}
+
+func nonEmpty(s *string) *string {
+	if s == nil || *s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,144 @@
+package tcloud
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	vpc "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vpc/v20170312"
+)
+
+// testPolicy 生成规则，cidr 包含 ":" 时为IPv6网段
+func testPolicy(protocol, port, cidr, action string) *vpc.SecurityGroupPolicy {
+	p := &vpc.SecurityGroupPolicy{
+		Protocol: common.StringPtr(protocol),
+		Port:     common.StringPtr(port),
+		Action:   common.StringPtr(action),
+	}
+	if strings.Contains(cidr, ":") {
+		p.Ipv6CidrBlock = common.StringPtr(cidr)
+	} else {
+		p.CidrBlock = common.StringPtr(cidr)
+	}
+	return p
+}
+
+// describedPolicy 生成带描述的规则
+func describedPolicy(protocol, port, cidr, action, description string) *vpc.SecurityGroupPolicy {
+	p := testPolicy(protocol, port, cidr, action)
+	p.PolicyDescription = common.StringPtr(description)
+	return p
+}
+
+func policyKeys(policies []*vpc.SecurityGroupPolicy) []string {
+	keys := make([]string, 0, len(policies))
+	for _, p := range policies {
+		keys = append(keys, PolicyKey(p))
+	}
+	return keys
+}
+
+func TestDiffSecurityGroupPolicies(t *testing.T) {
+	type policies = []*vpc.SecurityGroupPolicy
+	tests := []struct {
+		name    string
+		desired policies
+		actual  policies
+		remove  policies
+		add     policies
+		reset   bool
+	}{
+		{
+			name:    "无变化",
+			desired: policies{describedPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT", "ssh"), testPolicy("TCP", "80", "0.0.0.0/0", "ACCEPT")},
+			actual:  policies{describedPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT", "ssh"), testPolicy("TCP", "80", "0.0.0.0/0", "ACCEPT")},
+		},
+		{
+			name:    "协议、端口和动作不区分大小写",
+			desired: policies{testPolicy("tcp", "all", "0.0.0.0/0", "accept"), testPolicy("ALL", "ALL", "::/0", "ACCEPT")},
+			actual:  policies{testPolicy("TCP", "ALL", "0.0.0.0/0", "ACCEPT"), testPolicy("all", "all", "::/0", "accept")},
+		},
+		{
+			name:    "删除配置中不存在的规则",
+			desired: policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+			actual:  policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT"), testPolicy("TCP", "3306", "0.0.0.0/0", "ACCEPT")},
+			remove:  policies{testPolicy("TCP", "3306", "0.0.0.0/0", "ACCEPT")},
+		},
+		{
+			name:    "追加新规则",
+			desired: policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT"), testPolicy("TCP", "443", "0.0.0.0/0", "ACCEPT")},
+			actual:  policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+			add:     policies{testPolicy("TCP", "443", "0.0.0.0/0", "ACCEPT")},
+		},
+		{
+			name:    "替换规则",
+			desired: policies{testPolicy("TCP", "22", "10.0.0.0/8", "ACCEPT"), testPolicy("ALL", "ALL", "0.0.0.0/0", "DROP")},
+			actual:  policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+			remove:  policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+			add:     policies{testPolicy("TCP", "22", "10.0.0.0/8", "ACCEPT"), testPolicy("ALL", "ALL", "0.0.0.0/0", "DROP")},
+		},
+		{
+			name:    "重复规则只保留配置数量",
+			desired: policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+			actual:  policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT"), testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+			remove:  policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+		},
+		{
+			name:    "顺序变化需要重置",
+			desired: policies{testPolicy("TCP", "80", "0.0.0.0/0", "ACCEPT"), testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+			actual:  policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT"), testPolicy("TCP", "80", "0.0.0.0/0", "ACCEPT")},
+			reset:   true,
+		},
+		{
+			name:    "新规则需要插入已有规则之前时重置",
+			desired: policies{testPolicy("TCP", "22", "10.0.0.0/8", "ACCEPT"), testPolicy("ALL", "ALL", "0.0.0.0/0", "DROP")},
+			actual:  policies{testPolicy("ALL", "ALL", "0.0.0.0/0", "DROP")},
+			reset:   true,
+		},
+		{
+			name:    "描述变化需要重置",
+			desired: policies{describedPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT", "ssh")},
+			actual:  policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+			reset:   true,
+		},
+		{
+			name:   "清空规则",
+			actual: policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+			remove: policies{testPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := DiffSecurityGroupPolicies(tt.desired, tt.actual)
+			if diff.Reset != tt.reset {
+				t.Fatalf("Reset = %v, want %v", diff.Reset, tt.reset)
+			}
+			if diff.Changed() != (tt.reset || len(tt.remove) > 0 || len(tt.add) > 0) {
+				t.Errorf("Changed() = %v", diff.Changed())
+			}
+			if tt.reset {
+				return
+			}
+			if got, want := policyKeys(diff.Remove), policyKeys(tt.remove); !reflect.DeepEqual(got, want) {
+				t.Errorf("Remove = %v, want %v", got, want)
+			}
+			if got, want := policyKeys(diff.Add), policyKeys(tt.add); !reflect.DeepEqual(got, want) {
+				t.Errorf("Add = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMatchPolicyOmitsIndex(t *testing.T) {
+	p := describedPolicy("TCP", "22", "0.0.0.0/0", "ACCEPT", "ssh")
+	p.PolicyIndex = common.Int64Ptr(3)
+	p.ModifyTime = common.StringPtr("2024-01-01 00:00:00")
+	m := matchPolicy(p)
+	if m.PolicyIndex != nil || m.ModifyTime != nil {
+		t.Errorf("matchPolicy() 不应包含 PolicyIndex 和 ModifyTime: %+v", m)
+	}
+	if PolicyKey(m) != PolicyKey(p) {
+		t.Errorf("PolicyKey(matchPolicy()) = %s, want %s", PolicyKey(m), PolicyKey(p))
+	}
+}
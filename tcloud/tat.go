@@ -0,0 +1,397 @@
+package tcloud
+
+import (
+	"bufio"
+	"cvmspot/utils"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	tchttp "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/http"
+)
+
+const (
+	tatService          = "tat"
+	tatVersion          = "2020-10-28"
+	tatCommandTimeout   = 3600      // TAT 命令执行超时时间，单位秒
+	tatMaxUploadSize    = 32 * 1024 // TAT 命令内容最大 64KB，base64 编码后单个文件原始内容不超过 32KB
+	tatStatusSuccess    = "SUCCESS"
+	tatStatusFailed     = "FAILED"
+	tatStatusNotStarted = "PENDING"
+	tatHeredocEnd       = "CVMSPOT_EOF" // sudo 执行时 here-document 的结束标记
+)
+
+// tatPollInterval 默认查询命令执行结果的间隔
+const tatPollInterval = 3 * time.Second
+
+// TAT 命令执行结束的状态
+var tatFinalStatus = map[string]bool{
+	"SUCCESS":        true,
+	"FAILED":         true,
+	"TIMEOUT":        true,
+	"TASK_TIMEOUT":   true,
+	"START_FAILED":   true,
+	"DELIVER_FAILED": true,
+	"CANCELLED":      true,
+	"TERMINATED":     true,
+}
+
+// TatTask TAT 命令在单个实例上的执行结果
+type TatTask struct {
+	InstanceId string
+	Status     string
+	ExitCode   int64
+	Output     string
+	ErrorInfo  string
+}
+
+// TatAPI TAT 命令执行接口，AClient 调用腾讯云 API 实现
+type TatAPI interface {
+	RunCommand(instanceId, command, username string, timeout int64) (string, error)
+	DescribeInvocationTask(invocationId, instanceId string) (*TatTask, error)
+	CancelInvocation(invocationId, instanceId string) error
+}
+
+// RunCommand 通过 TAT 在实例上执行 shell 命令，返回执行活动ID
+func (a *AClient) RunCommand(instanceId, command, username string, timeout int64) (string, error) {
+	params := map[string]interface{}{
+		"Content":     base64.StdEncoding.EncodeToString([]byte(command)),
+		"InstanceIds": []string{instanceId},
+		"CommandType": "SHELL",
+		"Timeout":     timeout,
+	}
+	if username != "" {
+		params["Username"] = username
+	}
+
+	var resp struct {
+		Response struct {
+			InvocationId string `json:"InvocationId"`
+		} `json:"Response"`
+	}
+	if err := a.callTat("RunCommand", params, &resp); err != nil {
+		return "", fmt.Errorf("TAT 执行命令失败: %v", err)
+	}
+	return resp.Response.InvocationId, nil
+}
+
+// DescribeInvocationTask 查询执行活动在指定实例上的执行结果
+func (a *AClient) DescribeInvocationTask(invocationId, instanceId string) (*TatTask, error) {
+	params := map[string]interface{}{
+		"Filters": []map[string]interface{}{
+			{"Name": "invocation-id", "Values": []string{invocationId}},
+		},
+		"HideOutput": false,
+	}
+
+	var resp struct {
+		Response struct {
+			InvocationTaskSet []struct {
+				InstanceId string `json:"InstanceId"`
+				TaskStatus string `json:"TaskStatus"`
+				ErrorInfo  string `json:"ErrorInfo"`
+				TaskResult struct {
+					ExitCode int64  `json:"ExitCode"`
+					Output   string `json:"Output"`
+				} `json:"TaskResult"`
+			} `json:"InvocationTaskSet"`
+		} `json:"Response"`
+	}
+	if err := a.callTat("DescribeInvocationTasks", params, &resp); err != nil {
+		return nil, fmt.Errorf("TAT 查询执行结果失败: %v", err)
+	}
+
+	for _, task := range resp.Response.InvocationTaskSet {
+		if task.InstanceId != instanceId {
+			continue
+		}
+		output, err := base64.StdEncoding.DecodeString(task.TaskResult.Output)
+		if err != nil {
+			return nil, fmt.Errorf("TAT 解码命令输出失败: %v", err)
+		}
+		return &TatTask{
+			InstanceId: task.InstanceId,
+			Status:     task.TaskStatus,
+			ExitCode:   task.TaskResult.ExitCode,
+			Output:     string(output),
+			ErrorInfo:  task.ErrorInfo,
+		}, nil
+	}
+	// 执行任务尚未生成
+	return &TatTask{InstanceId: instanceId, Status: tatStatusNotStarted}, nil
+}
+
+// CancelInvocation 取消执行活动在指定实例上尚未结束的命令
+func (a *AClient) CancelInvocation(invocationId, instanceId string) error {
+	params := map[string]interface{}{
+		"InvocationId": invocationId,
+		"InstanceIds":  []string{instanceId},
+	}
+	var resp struct{}
+	if err := a.callTat("CancelInvocation", params, &resp); err != nil {
+		return fmt.Errorf("TAT 取消命令失败: %v", err)
+	}
+	return nil
+}
+
+// callTat 以通用请求方式调用 TAT 接口
+func (a *AClient) callTat(action string, params map[string]interface{}, result interface{}) error {
+	request := tchttp.NewCommonRequest(tatService, tatVersion, action)
+	if err := request.SetActionParameters(params); err != nil {
+		return err
+	}
+	response, err := call(a.guard, apiName(tatService, action), func() (*tchttp.CommonResponse, error) {
+		response := tchttp.NewCommonResponse()
+		return response, a.TatClient.Send(request, response)
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(response.GetBody(), result)
+}
+
+// TatExecutor 通过 TAT 在实例上执行初始化操作，文件以 base64 内容随命令下发
+type TatExecutor struct {
+	api          TatAPI
+	instanceId   string
+	username     string
+	pollInterval time.Duration // 查询命令执行结果的间隔
+	log          *logrus.Logger
+	stdout       io.Writer
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewTatExecutor 创建 TAT 执行器，username 为空时使用 root
+func NewTatExecutor(api TatAPI, instanceId, username string, log *logrus.Logger) *TatExecutor {
+	return &TatExecutor{
+		api:          api,
+		instanceId:   instanceId,
+		username:     username,
+		pollInterval: tatPollInterval,
+		log:          log,
+		done:         make(chan struct{}),
+	}
+}
+
+// SetOutput 设置命令输出的额外写入目标，TAT 输出不区分标准错误
+func (t *TatExecutor) SetOutput(stdout, stderr io.Writer) {
+	t.stdout = stdout
+}
+
+// Close 停止等待正在执行的命令并取消该命令
+func (t *TatExecutor) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
+
+// ExecCommand 执行命令并等待结果，状态非 SUCCESS 或退出码非0时返回错误
+func (t *TatExecutor) ExecCommand(command string) (string, error) {
+	result, err := t.Run(command)
+	if err != nil {
+		return "", err
+	}
+	return result.Output, result.Err()
+}
+
+// Run 执行命令并等待结果，TAT 不区分标准输出和标准错误，全部记为标准输出
+// 命令超时等非正常结束时退出码为-1，Signal 为 TAT 任务状态
+func (t *TatExecutor) Run(command string) (*utils.ExecResult, error) {
+	return t.RunWithOptions(command, utils.RunOptions{})
+}
+
+// RunWithOptions 同 Run，日志只记录原始命令，环境变量和 sudo 拼接到下发的命令中
+// 下发的命令内容会保存在 TAT 执行记录中，环境变量的值以明文保存，不应包含密钥
+// TAT 无法向命令传入标准输入，需要 sudo 密码时返回错误
+func (t *TatExecutor) RunWithOptions(command string, opts utils.RunOptions) (*utils.ExecResult, error) {
+	if opts.SudoPassword != "" {
+		return nil, fmt.Errorf("TAT 执行器不支持输入 sudo 密码，请使用 root 用户或免密 sudo")
+	}
+	t.log.WithFields(logrus.Fields{
+		"command": command,
+		"实例ID":    t.instanceId,
+	}).Info("开始通过TAT执行命令")
+	start := time.Now()
+
+	content, err := tatContent(command, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	invocationId, err := t.api.RunCommand(t.instanceId, content, t.username, tatCommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.After(time.Duration(tatCommandTimeout)*time.Second + time.Minute)
+	for {
+		select {
+		case <-t.done:
+			t.cancel(invocationId)
+			return nil, fmt.Errorf("TAT 执行器已关闭，执行活动 %s", invocationId)
+		case <-deadline:
+			t.cancel(invocationId)
+			return nil, fmt.Errorf("等待 TAT 执行活动 %s 结果超时", invocationId)
+		case <-time.After(t.pollInterval):
+		}
+
+		task, err := t.api.DescribeInvocationTask(invocationId, t.instanceId)
+		if err != nil {
+			return nil, err
+		}
+		if !tatFinalStatus[task.Status] {
+			continue
+		}
+
+		scanner := bufio.NewScanner(strings.NewReader(task.Output))
+		for scanner.Scan() {
+			if t.stdout != nil {
+				io.WriteString(t.stdout, scanner.Text()+"\n")
+			}
+			t.log.WithField("output", scanner.Text()).Info("命令输出")
+		}
+
+		result := &utils.ExecResult{
+			Command:  command,
+			ExitCode: int(task.ExitCode),
+			Stdout:   task.Output,
+			Stderr:   task.ErrorInfo,
+			Output:   task.Output,
+			Duration: time.Since(start),
+		}
+		if task.Status != tatStatusSuccess && task.Status != tatStatusFailed {
+			result.ExitCode = -1
+			result.Signal = task.Status
+		}
+		return result, nil
+	}
+}
+
+// cancel 取消仍在执行的命令，避免停止等待（如步骤超时）后命令继续在实例上执行，重试时同一步骤并发执行
+func (t *TatExecutor) cancel(invocationId string) {
+	log := t.log.WithFields(logrus.Fields{
+		"实例ID": t.instanceId,
+		"执行活动": invocationId,
+	})
+	if err := t.api.CancelInvocation(invocationId, t.instanceId); err != nil {
+		log.Warnf("取消TAT命令失败: %v", err)
+		return
+	}
+	log.Info("已取消TAT命令")
+}
+
+// tatContent 生成下发的命令内容
+// 使用 sudo 时通过 here-document 将环境变量和命令传给 sudo -n sh -s，避免环境变量出现在远程进程的命令行中
+func tatContent(command string, opts utils.RunOptions) (string, error) {
+	assigns := utils.EnvAssigns(opts.Env)
+	if !opts.Sudo {
+		if len(assigns) == 0 {
+			return command, nil
+		}
+		return "export " + strings.Join(assigns, " ") + "; " + command, nil
+	}
+	script := "exec sh -c " + utils.ShellQuote(command) + " </dev/null\n"
+	if len(assigns) > 0 {
+		script = "export " + strings.Join(assigns, " ") + "\n" + script
+	}
+	if slices.Contains(strings.Split(script, "\n"), tatHeredocEnd) {
+		return "", fmt.Errorf("命令不能包含单独一行的 %s", tatHeredocEnd)
+	}
+	return "sudo -n sh -s <<'" + tatHeredocEnd + "'\n" + script + tatHeredocEnd + "\n", nil
+}
+
+// UploadWithOptions 上传文件或目录，每个文件单独下发一次命令并设置与本地一致的权限
+// TAT 不支持增量和 tar 上传方式，Transfer 选项被忽略
+func (t *TatExecutor) UploadWithOptions(localPath, remotePath string, opts utils.UploadOptions) error {
+	entries, err := utils.CollectUploadEntries(localPath, remotePath, opts.Excludes)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Info.IsDir() {
+			continue
+		}
+		if err := t.uploadFile(e, opts.Render); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TatExecutor) uploadFile(e *utils.UploadEntry, render utils.Renderer) error {
+	content, err := os.ReadFile(e.LocalPath)
+	if err != nil {
+		return fmt.Errorf("读取本地文件失败: %v", err)
+	}
+	if render != nil {
+		if content, err = render(e.RelPath, content); err != nil {
+			return err
+		}
+	}
+	return t.writeFile(content, e.RemotePath, fmt.Sprintf(" && chmod %o %s", e.Info.Mode().Perm(), utils.ShellQuote(e.RemotePath)))
+}
+
+// UploadBytes 将内容写入远程文件，远程目录不存在时创建
+func (t *TatExecutor) UploadBytes(data []byte, remoteFilePath string) error {
+	return t.writeFile(data, remoteFilePath, "")
+}
+
+// writeFile 下发写文件命令，suffix 追加在写入命令之后（如设置权限）
+func (t *TatExecutor) writeFile(data []byte, remoteFilePath, suffix string) error {
+	if len(data) > tatMaxUploadSize {
+		return fmt.Errorf("TAT 上传文件 %s 大小 %d 字节超过限制 %d 字节", remoteFilePath, len(data), tatMaxUploadSize)
+	}
+	command := fmt.Sprintf("mkdir -p %s && printf '%%s' %s | base64 -d > %s%s",
+		utils.ShellQuote(path.Dir(remoteFilePath)),
+		utils.ShellQuote(base64.StdEncoding.EncodeToString(data)),
+		utils.ShellQuote(remoteFilePath),
+		suffix)
+	if _, err := t.ExecCommand(command); err != nil {
+		return fmt.Errorf("TAT 上传文件 %s 失败: %v", remoteFilePath, err)
+	}
+	return nil
+}
+
+// Download 下载单个远程文件（受 TAT 输出长度限制，只适用于小文件）
+func (t *TatExecutor) Download(remotePath, localPath string) error {
+	output, err := t.ExecCommand("base64 -w0 " + utils.ShellQuote(remotePath))
+	if err != nil {
+		return fmt.Errorf("TAT 下载文件 %s 失败: %v", remotePath, err)
+	}
+	content, err := base64.StdEncoding.DecodeString(strings.TrimSpace(output))
+	if err != nil {
+		return fmt.Errorf("TAT 下载文件 %s 解码失败（文件过大或不是普通文件）: %v", remotePath, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return fmt.Errorf("创建本地目录失败: %v", err)
+	}
+	return os.WriteFile(localPath, content, 0644)
+}
+
+// RemoteExists 判断远程文件或目录是否存在
+func (t *TatExecutor) RemoteExists(remotePath string) (bool, error) {
+	output, err := t.ExecCommand("test -e " + utils.ShellQuote(remotePath) + " && echo yes || echo no")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(output) == "yes", nil
+}
+
+// CheckRemotePort 在实例内部连接 host:port，判断端口是否可连接
+func (t *TatExecutor) CheckRemotePort(host string, port int) error {
+	_, err := t.ExecCommand(fmt.Sprintf("timeout 3 bash -c %s", utils.ShellQuote(fmt.Sprintf("</dev/tcp/%s/%d", host, port))))
+	return err
+}
+
+var _ utils.Executor = (*TatExecutor)(nil)
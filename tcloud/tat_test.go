@@ -0,0 +1,234 @@
+package tcloud
+
+import (
+	"cvmspot/utils"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// localTatAPI TAT 接口的本地替身，在本机以 sh 执行命令
+type localTatAPI struct {
+	mu          sync.Mutex
+	seq         int
+	polls       int    // 每个执行活动返回结果前返回 RUNNING 的查询次数
+	status      string // 不为空时覆盖执行结果状态，如 TIMEOUT
+	commands    []string
+	cancelled   []string
+	invocations map[string]*localInvocation
+}
+
+type localInvocation struct {
+	task  *TatTask
+	polls int
+}
+
+func newLocalTatAPI() *localTatAPI {
+	return &localTatAPI{invocations: make(map[string]*localInvocation)}
+}
+
+// RunCommand 在本机同步执行命令并保存结果
+func (l *localTatAPI) RunCommand(instanceId, command, username string, timeout int64) (string, error) {
+	task := &TatTask{InstanceId: instanceId, Status: tatStatusSuccess}
+	output, err := exec.Command("sh", "-c", command).CombinedOutput()
+	task.Output = string(output)
+	if err != nil {
+		task.Status = tatStatusFailed
+		task.ExitCode = 1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			task.ExitCode = int64(exitErr.ExitCode())
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.status != "" {
+		task.Status = l.status
+	}
+	l.seq++
+	invocationId := fmt.Sprintf("inv-local%d", l.seq)
+	l.commands = append(l.commands, command)
+	l.invocations[invocationId] = &localInvocation{task: task, polls: l.polls}
+	return invocationId, nil
+}
+
+// DescribeInvocationTask 返回保存的执行结果，查询次数未达到 polls 时返回 RUNNING
+func (l *localTatAPI) DescribeInvocationTask(invocationId, instanceId string) (*TatTask, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	inv, ok := l.invocations[invocationId]
+	if !ok || inv.task.InstanceId != instanceId {
+		return nil, fmt.Errorf("执行活动 %s 不存在", invocationId)
+	}
+	if inv.polls > 0 {
+		inv.polls--
+		return &TatTask{InstanceId: instanceId, Status: "RUNNING"}, nil
+	}
+	copied := *inv.task
+	return &copied, nil
+}
+
+// CancelInvocation 记录取消的执行活动，执行结果改为 CANCELLED
+func (l *localTatAPI) CancelInvocation(invocationId, instanceId string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	inv, ok := l.invocations[invocationId]
+	if !ok || inv.task.InstanceId != instanceId {
+		return fmt.Errorf("执行活动 %s 不存在", invocationId)
+	}
+	l.cancelled = append(l.cancelled, invocationId)
+	inv.task.Status = "CANCELLED"
+	return nil
+}
+
+func newTestTatExecutor(t *testing.T, api TatAPI) *TatExecutor {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	e := NewTatExecutor(api, "ins-test", "", log)
+	e.pollInterval = time.Millisecond
+	return e
+}
+
+func TestTatExecutorRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  string
+		polls    int
+		status   string
+		exitCode int
+		signal   string
+		output   string
+	}{
+		{name: "成功", command: "echo hello", exitCode: 0, output: "hello\n"},
+		{name: "多次查询后返回结果", command: "echo done", polls: 3, exitCode: 0, output: "done\n"},
+		{name: "非0退出码", command: "echo failed; exit 3", exitCode: 3, output: "failed\n"},
+		{name: "执行超时", command: "true", status: "TIMEOUT", exitCode: -1, signal: "TIMEOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newLocalTatAPI()
+			api.polls, api.status = tt.polls, tt.status
+			e := newTestTatExecutor(t, api)
+
+			var stdout strings.Builder
+			e.SetOutput(&stdout, nil)
+			result, err := e.Run(tt.command)
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if result.ExitCode != tt.exitCode || result.Signal != tt.signal {
+				t.Errorf("Run() exit = %d/%q, want %d/%q", result.ExitCode, result.Signal, tt.exitCode, tt.signal)
+			}
+			if result.Output != tt.output || stdout.String() != tt.output {
+				t.Errorf("Run() output = %q, stdout = %q, want %q", result.Output, stdout.String(), tt.output)
+			}
+			if (result.Err() == nil) != (tt.exitCode == 0 && tt.signal == "") {
+				t.Errorf("Err() = %v", result.Err())
+			}
+			if code := utils.ExitCode(result.Err()); tt.signal == "" && code != tt.exitCode {
+				t.Errorf("ExitCode(Err()) = %d, want %d", code, tt.exitCode)
+			}
+		})
+	}
+}
+
+func TestTatExecutorRunWithOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    utils.RunOptions
+		content string
+		wantErr bool
+	}{
+		{name: "无选项", content: `echo "$A"`},
+		{name: "环境变量", opts: utils.RunOptions{Env: map[string]string{"B": "2", "A": "it's"}},
+			content: `export A='it'\''s' B='2'; echo "$A"`},
+		{name: "sudo", opts: utils.RunOptions{Sudo: true},
+			content: "sudo -n sh -s <<'CVMSPOT_EOF'\nexec sh -c 'echo \"$A\"' </dev/null\nCVMSPOT_EOF\n"},
+		{name: "sudo 环境变量不出现在命令行", opts: utils.RunOptions{Sudo: true, Env: map[string]string{"A": "1"}},
+			content: "sudo -n sh -s <<'CVMSPOT_EOF'\nexport A='1'\nexec sh -c 'echo \"$A\"' </dev/null\nCVMSPOT_EOF\n"},
+		{name: "环境变量包含结束标记", opts: utils.RunOptions{Sudo: true, Env: map[string]string{"A": "x\nCVMSPOT_EOF\nreboot"}}, wantErr: true},
+		{name: "sudo 密码", opts: utils.RunOptions{Sudo: true, SudoPassword: "password"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newLocalTatAPI()
+			e := newTestTatExecutor(t, api)
+
+			_, err := e.RunWithOptions(`echo "$A"`, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(api.commands) != 0 {
+					t.Errorf("RunWithOptions() 不应下发命令: %v", api.commands)
+				}
+				return
+			}
+			if len(api.commands) != 1 || api.commands[0] != tt.content {
+				t.Errorf("RunWithOptions() 下发命令 %q, want %q", api.commands, tt.content)
+			}
+		})
+	}
+}
+
+func TestTatExecutorClose(t *testing.T) {
+	api := newLocalTatAPI()
+	api.polls = 1 << 30
+	e := newTestTatExecutor(t, api)
+
+	time.AfterFunc(10*time.Millisecond, func() { e.Close() })
+	if _, err := e.Run("true"); err == nil {
+		t.Fatal("Run() 关闭执行器后应返回错误")
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.cancelled) != 1 || api.cancelled[0] != "inv-local1" {
+		t.Errorf("关闭执行器后取消的执行活动 = %v, want [inv-local1]", api.cancelled)
+	}
+}
+
+func TestTatExecutorFiles(t *testing.T) {
+	e := newTestTatExecutor(t, newLocalTatAPI())
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote", "a.txt")
+	data := []byte("line 1\nit's \x00 binary\n")
+
+	if err := e.UploadBytes(data, remote); err != nil {
+		t.Fatalf("UploadBytes() error = %v", err)
+	}
+	exists, err := e.RemoteExists(remote)
+	if err != nil || !exists {
+		t.Fatalf("RemoteExists() = %v, %v", exists, err)
+	}
+	local := filepath.Join(dir, "local", "a.txt")
+	if err := e.Download(remote, local); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	got, err := os.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("Download() = %q, want %q", got, data)
+	}
+
+	if exists, err := e.RemoteExists(filepath.Join(dir, "missing")); err != nil || exists {
+		t.Errorf("RemoteExists(missing) = %v, %v", exists, err)
+	}
+	if err := e.UploadBytes(make([]byte, tatMaxUploadSize+1), remote); err == nil {
+		t.Error("UploadBytes() 超过大小限制时应返回错误")
+	}
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 安全组规则动态来源
+const (
+	SourceSelf   = "self"  // 运行 cvmspot 的机器的公网出口IP
+	SourceDNS    = "dns:"  // 域名解析结果，不带前缀的域名同样按域名解析
+	SourceFile   = "file:" // 本地文件，每行一个IP或网段，# 开头为注释
+	SourceHTTP   = "http://"
+	SourceHTTPS  = "https://"
+	sourceMaxLen = 1 << 20 // 文件或URL列表最大读取字节数
+)
+
+const (
+	DefaultAllowlistRefresh = 300 // 动态来源默认刷新间隔（秒）
+	DefaultSelfIPURL        = "https://api.ipify.org"
+	allowlistFetchTimeout   = 10 * time.Second
+)
+
+type cachedSource struct {
+	cidrs     []string
+	fetchedAt time.Time
+}
+
+// AllowlistResolver 解析安全组规则的动态来源，结果按刷新间隔缓存，所有实例管理器共用
+type AllowlistResolver struct {
+	log    *logrus.Logger
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*cachedSource
+}
+
+// NewAllowlistResolver 创建动态来源解析器
+func NewAllowlistResolver(log *logrus.Logger) *AllowlistResolver {
+	return &AllowlistResolver{
+		log:    log,
+		client: &http.Client{Timeout: allowlistFetchTimeout},
+		cache:  make(map[string]*cachedSource),
+	}
+}
+
+// ExpandRules 将带动态来源的规则展开为每个IP或网段一条规则，cidr_ip 对应的规则在前
+// 来源解析失败时使用上次成功的结果，从未成功过时返回错误，避免误删现有规则
+func (r *AllowlistResolver) ExpandRules(sc *SecurityGroupConfig) ([]RuleConfig, error) {
+	refresh := time.Duration(sc.RefreshInterval) * time.Second
+	if refresh <= 0 {
+		refresh = DefaultAllowlistRefresh * time.Second
+	}
+	selfURL := sc.SelfIPURL
+	if selfURL == "" {
+		selfURL = DefaultSelfIPURL
+	}
+
+	rules := make([]RuleConfig, 0, len(sc.Rules))
+	for _, rule := range sc.Rules {
+		if len(rule.Sources) == 0 {
+			rules = append(rules, rule)
+			continue
+		}
+		seen := make(map[string]bool)
+		cidrs := make([]string, 0)
+		if rule.CidrIp != "" {
+			seen[rule.CidrIp] = true
+			cidrs = append(cidrs, rule.CidrIp)
+		}
+		for _, source := range rule.Sources {
+			resolved, err := r.resolve(source, selfURL, refresh)
+			if err != nil {
+				return nil, fmt.Errorf("规则 %s 来源 %s: %v", rule.Description, source, err)
+			}
+			for _, cidr := range resolved {
+				if !seen[cidr] {
+					seen[cidr] = true
+					cidrs = append(cidrs, cidr)
+				}
+			}
+		}
+		for _, cidr := range cidrs {
+			expanded := rule
+			expanded.CidrIp = cidr
+			expanded.Sources = nil
+			rules = append(rules, expanded)
+		}
+	}
+	return rules, nil
+}
+
+// resolve 返回来源对应的IP或网段（已排序），缓存未过期时直接使用缓存
+func (r *AllowlistResolver) resolve(source, selfURL string, refresh time.Duration) ([]string, error) {
+	if cidr, ok := normalizeCIDR(source); ok {
+		return []string{cidr}, nil
+	}
+
+	r.mu.Lock()
+	cached := r.cache[source]
+	r.mu.Unlock()
+	if cached != nil && time.Since(cached.fetchedAt) < refresh {
+		return cached.cidrs, nil
+	}
+
+	cidrs, err := r.fetch(source, selfURL)
+	if err == nil && len(cidrs) == 0 {
+		err = fmt.Errorf("未解析到IP")
+	}
+	if err != nil {
+		if cached != nil {
+			r.log.WithField("来源", source).Warnf("刷新安全组规则来源失败，使用上次结果: %v", err)
+			return cached.cidrs, nil
+		}
+		return nil, err
+	}
+	sort.Strings(cidrs)
+
+	r.mu.Lock()
+	r.cache[source] = &cachedSource{cidrs: cidrs, fetchedAt: time.Now()}
+	r.mu.Unlock()
+	if cached == nil || strings.Join(cached.cidrs, ",") != strings.Join(cidrs, ",") {
+		r.log.WithFields(logrus.Fields{"来源": source, "IP": cidrs}).Info("安全组规则来源已更新")
+	}
+	return cidrs, nil
+}
+
+func (r *AllowlistResolver) fetch(source, selfURL string) ([]string, error) {
+	switch {
+	case source == SourceSelf:
+		body, err := r.get(selfURL)
+		if err != nil {
+			return nil, fmt.Errorf("查询公网出口IP失败: %v", err)
+		}
+		cidr, ok := normalizeCIDR(strings.TrimSpace(string(body)))
+		if !ok {
+			return nil, fmt.Errorf("%s 返回的公网出口IP格式错误", selfURL)
+		}
+		return []string{cidr}, nil
+	case strings.HasPrefix(source, SourceFile):
+		data, err := os.ReadFile(strings.TrimPrefix(source, SourceFile))
+		if err != nil {
+			return nil, fmt.Errorf("读取IP列表文件失败: %v", err)
+		}
+		return parseCIDRList(string(data))
+	case strings.HasPrefix(source, SourceHTTP), strings.HasPrefix(source, SourceHTTPS):
+		body, err := r.get(source)
+		if err != nil {
+			return nil, fmt.Errorf("下载IP列表失败: %v", err)
+		}
+		return parseCIDRList(string(body))
+	default:
+		return lookupHost(strings.TrimPrefix(source, SourceDNS))
+	}
+}
+
+func (r *AllowlistResolver) get(url string) ([]byte, error) {
+	resp, err := r.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP 状态码 %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, sourceMaxLen))
+}
+
+// lookupHost 解析域名的 A 和 AAAA 记录
+func lookupHost(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), allowlistFetchTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("解析域名失败: %v", err)
+	}
+	cidrs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		cidrs = append(cidrs, addr.IP.String())
+	}
+	return cidrs, nil
+}
+
+// parseCIDRList 解析每行一个IP或网段的列表，忽略空行和 # 注释
+func parseCIDRList(data string) ([]string, error) {
+	cidrs := make([]string, 0)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		cidr, ok := normalizeCIDR(line)
+		if !ok {
+			return nil, fmt.Errorf("第 %d 行 %q 不是有效的IP或网段", lineNum, line)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, scanner.Err()
+}
+
+// normalizeCIDR 校验并规范化IP或网段，IPv6 使用小写压缩格式
+func normalizeCIDR(s string) (string, bool) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String(), true
+	}
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCIDRList(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "空列表", data: "", want: []string{}},
+		{name: "IP和网段", data: "1.2.3.4\n10.0.0.0/8\n", want: []string{"1.2.3.4", "10.0.0.0/8"}},
+		{name: "忽略空行和注释", data: "# 办公网\n\n  1.2.3.4  # 出口\n\t\n", want: []string{"1.2.3.4"}},
+		{name: "规范化网段", data: "10.1.2.3/16", want: []string{"10.1.0.0/16"}},
+		{name: "IPv6", data: "2001:DB8::1\n2001:db8:0:0::/64", want: []string{"2001:db8::1", "2001:db8::/64"}},
+		{name: "Windows 换行", data: "1.2.3.4\r\n5.6.7.8\r\n", want: []string{"1.2.3.4", "5.6.7.8"}},
+		{name: "无效IP", data: "1.2.3.4\n1.2.3.256\n", wantErr: true},
+		{name: "无效网段", data: "10.0.0.0/33", wantErr: true},
+		{name: "域名", data: "example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCIDRList(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCIDRList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCIDRList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,5 +1,11 @@
 package utils
 
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
 type InstanceConfig struct {
 	InstanceName       string              `mapstructure:"instance_name"`
 	Regions            []string            `mapstructure:"regions"`
@@ -13,6 +19,8 @@ type InstanceConfig struct {
 	SecurityGroups     SecurityGroupConfig `mapstructure:"security_groups"`
 	Tags               map[string]string   `mapstructure:"tags"`
 	UserConfig         UserConfig          `mapstructure:"user"`
+	JumpHosts          []JumpHostConfig    `mapstructure:"jump_hosts"`
+	UserData           UserDataConfig      `mapstructure:"user_data"`
 }
 
 type SystemDisk struct {
@@ -23,13 +31,51 @@ type SystemDisk struct {
 type Internet struct {
 	ChargeType   string `mapstructure:"charge_type"`
 	BandwidthOut int64  `mapstructure:"bandwidth_out"`
+	// 公网IPv6类型 EIPv6/HighQualityEIPv6，为空时实例只分配IPv6地址（需私有网络开启IPv6）
+	IPv6AddressType string `mapstructure:"ipv6_address_type"`
+	// 公网地址模式：public_ip（默认，创建实例时分配普通公网IP）或 eip（为实例绑定实例管理器维护的弹性公网IP）
+	Mode string    `mapstructure:"mode"`
+	Eip  EipConfig `mapstructure:"eip"`
+}
+
+// 公网地址模式
+const (
+	InternetModePublicIP = "public_ip"
+	InternetModeEIP      = "eip"
+)
+
+// EIPMode 是否使用弹性公网IP模式
+func (i *Internet) EIPMode() bool {
+	return i.Mode == InternetModeEIP
+}
+
+// EipConfig 弹性公网IP模式配置，实例创建时不分配普通公网IP，由实例管理器申请或接管带标签的弹性公网IP并绑定到实例，
+// 竞价实例被回收后弹性公网IP自动解绑，再绑定到新实例，公网地址保持不变
+type EipConfig struct {
+	// 接管的已有弹性公网IP，与带实例管理器标签的弹性公网IP一起使用，不会被释放
+	AddressIds []string `mapstructure:"address_ids"`
+	// 标准账户类型的计费方式和带宽上限（Mbps），为空时不传递（传统账户类型的带宽与实例一致）
+	ChargeType   string `mapstructure:"charge_type"`
+	BandwidthOut int64  `mapstructure:"bandwidth_out"`
+	// 线路类型 BGP（默认）、CMCC、CTCC、CUCC
+	ISP string `mapstructure:"isp"`
+	// 未绑定实例的弹性公网IP处理方式：retain（默认，保留）或 release（释放超出期望实例数量的部分）
+	ReleasePolicy string `mapstructure:"release_policy"`
 }
 
+// 未绑定弹性公网IP的处理方式
+const (
+	EipRetain  = "retain"
+	EipRelease = "release"
+)
+
 type VpcConfig struct {
 	TagVal    string `mapstructure:"tag_val"`
 	VpcId     string `mapstructure:"vpc_id"`
 	VpcName   string `mapstructure:"vpc_name"`
 	CidrBlock string `mapstructure:"cidr_block"`
+	// 为私有网络申请IPv6网段（/56），并为子网分配IPv6网段、为实例分配IPv6地址
+	EnableIPv6 bool `mapstructure:"enable_ipv6"`
 }
 
 type SubnetConfig struct {
@@ -37,6 +83,8 @@ type SubnetConfig struct {
 	SubnetId   string `mapstructure:"subnet_id"`
 	SubnetName string `mapstructure:"subnet_name"`
 	CidrBlock  string `mapstructure:"cidr_block"`
+	// 子网IPv6网段（/64）在私有网络IPv6网段中的序号，两位十六进制 00-ff，n 替换为可用区编号
+	Ipv6Index string `mapstructure:"ipv6_index"`
 }
 
 type SecurityGroupConfig struct {
@@ -45,6 +93,9 @@ type SecurityGroupConfig struct {
 	GroupDescription string       `mapstructure:"group_description"`
 	TagVal           string       `mapstructure:"tag_val"`
 	Rules            []RuleConfig `mapstructure:"rules"`
+	// 规则动态来源的刷新间隔（秒）和查询公网出口IP的地址
+	RefreshInterval int64  `mapstructure:"refresh_interval"`
+	SelfIPURL       string `mapstructure:"self_ip_url"`
 }
 
 type RuleConfig struct {
@@ -54,18 +105,107 @@ type RuleConfig struct {
 	CidrIp      string `mapstructure:"cidr_ip"`
 	Action      string `mapstructure:"action"`
 	Description string `mapstructure:"desc"`
+	// 动态来源：self（本机公网出口IP）、IP、网段、域名、file:本地文件、http(s)://URL，每个IP生成一条规则
+	Sources []string `mapstructure:"sources"`
 }
 
 type FeatureConfig struct {
 	FileTransfer struct {
-		LocalPath  string `mapstructure:"local_path"`
-		RemotePath string `mapstructure:"remote_path"`
-		Enabled    bool   `mapstructure:"enabled"`
+		LocalPath        string   `mapstructure:"local_path"`
+		RemotePath       string   `mapstructure:"remote_path"`
+		Enabled          bool     `mapstructure:"enabled"`
+		Template         bool     `mapstructure:"template"`
+		TemplatePatterns []string `mapstructure:"template_patterns"`
+		Transfer         string   `mapstructure:"transfer"`
+		Excludes         []string `mapstructure:"excludes"`
+		PreserveOwner    bool     `mapstructure:"preserve_owner"`
 	} `mapstructure:"file_transfer"`
 	CommandExec struct {
 		Enabled bool   `mapstructure:"enabled"`
 		Command string `mapstructure:"command"`
 	} `mapstructure:"command_exec"`
+	Steps    []StepConfig      `mapstructure:"steps"`
+	Secrets  map[string]string `mapstructure:"secrets"`
+	Executor string            `mapstructure:"executor"`
+}
+
+// 初始化步骤类型
+const (
+	StepUpload        = "upload"          // 上传文件或目录
+	StepDownload      = "download"        // 下载文件或目录
+	StepExec          = "exec"            // 执行命令
+	StepScript        = "script"          // 上传本地脚本并执行
+	StepTemplate      = "template"        // 渲染模板后上传
+	StepWaitForPort   = "wait-for-port"   // 等待实例端口可连接
+	StepWaitForFile   = "wait-for-file"   // 等待实例文件存在
+	StepRebootAndWait = "reboot-and-wait" // 重启实例并等待SSH恢复
+)
+
+// 步骤执行策略
+const (
+	RunOnce   = "run_once" // 成功执行后不再执行
+	RunAlways = "always"   // 每次初始化都执行
+)
+
+type StepConfig struct {
+	Name       string `mapstructure:"name"`
+	Type       string `mapstructure:"type"`
+	LocalPath  string `mapstructure:"local_path"`
+	RemotePath string `mapstructure:"remote_path"`
+	Command    string `mapstructure:"command"`
+	Host       string `mapstructure:"host"`
+	Port       int    `mapstructure:"port"`
+	Timeout    int64  `mapstructure:"timeout"`
+	Retries    int    `mapstructure:"retries"`
+	RetryDelay int64  `mapstructure:"retry_delay"`
+	Run        string `mapstructure:"run"`
+	// 上传时是否以 Go 模板渲染文件，TemplatePatterns 为空时渲染所有文件
+	Template         bool     `mapstructure:"template"`
+	TemplatePatterns []string `mapstructure:"template_patterns"`
+	// 上传方式（sftp/incremental/tar/auto）、排除的文件以及是否保留本地属主
+	Transfer      string   `mapstructure:"transfer"`
+	Excludes      []string `mapstructure:"excludes"`
+	PreserveOwner bool     `mapstructure:"preserve_owner"`
+	// exec/script 命令的断言：预期退出码（默认只接受0）、标准输出必须匹配和不能匹配的正则表达式
+	ExpectExitCodes []int  `mapstructure:"expect_exit_codes"`
+	StdoutMatch     string `mapstructure:"stdout_match"`
+	StdoutNotMatch  string `mapstructure:"stdout_not_match"`
+	// exec/script/reboot-and-wait 命令的环境变量（KEY=VALUE）、是否通过 sudo 执行以及工作目录
+	Env     []string `mapstructure:"env"`
+	Sudo    bool     `mapstructure:"sudo"`
+	Workdir string   `mapstructure:"workdir"`
+}
+
+// Pipeline 返回按顺序执行的初始化步骤，兼容旧的 file_transfer 和 command_exec 配置（排在 steps 之前）
+func (f *FeatureConfig) Pipeline() []StepConfig {
+	steps := make([]StepConfig, 0, len(f.Steps)+2)
+	if f.FileTransfer.Enabled {
+		steps = append(steps, StepConfig{
+			Name:             "file_transfer",
+			Type:             StepUpload,
+			LocalPath:        f.FileTransfer.LocalPath,
+			RemotePath:       f.FileTransfer.RemotePath,
+			Template:         f.FileTransfer.Template,
+			TemplatePatterns: f.FileTransfer.TemplatePatterns,
+			Transfer:         f.FileTransfer.Transfer,
+			Excludes:         f.FileTransfer.Excludes,
+			PreserveOwner:    f.FileTransfer.PreserveOwner,
+		})
+	}
+	if f.CommandExec.Enabled {
+		steps = append(steps, StepConfig{
+			Name:    "command_exec",
+			Type:    StepExec,
+			Command: f.CommandExec.Command,
+		})
+	}
+	for i, step := range f.Steps {
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("%d-%s", i+1, step.Type)
+		}
+		steps = append(steps, step)
+	}
+	return steps
 }
 
 type DomainBindingConfig struct {
@@ -74,11 +214,53 @@ type DomainBindingConfig struct {
 	Domain     string `mapstructure:"domain"`
 	SubDomain  string `mapstructure:"subdomain"`
 	RecordLine string `mapstructure:"record_line"`
+	// 记录类型：A（默认，开启 ipv6 时同时维护 AAAA 记录）或 AAAA（只维护 AAAA 记录）
 	RecordType string `mapstructure:"record_type"`
 	PraseNum   int    `mapstructure:"prase_num"`
 	TTL        uint64 `mapstructure:"ttl"`
+	// 同时为实例的IPv6地址维护 AAAA 记录
+	IPv6 bool `mapstructure:"ipv6"`
+	// 写入记录备注的所有者标记，只修改和删除带此标记的记录，默认为 cvmspot:<实例管理器名称>
+	Owner string `mapstructure:"owner"`
+	// 是否接管值为当前实例IP但没有所有者标记的记录（如旧版本创建的记录）
+	Adopt bool `mapstructure:"adopt"`
+	// 子域名存在 CNAME 或 URL 转发记录时的处理方式：skip（默认，不维护记录）或 replace（删除冲突记录）
+	OnConflict string `mapstructure:"on_conflict"`
+	// 按可用区或地域为实例记录选择解析线路，未匹配的实例使用 record_line
+	Lines []DNSLineConfig `mapstructure:"lines"`
+	// 记录权重，未配置时不设置权重
+	Weight DNSWeightConfig `mapstructure:"weight"`
+	// 每个实例单独的主机记录模板，如 frp-{{.Index}} 或 {{.InstanceId}}.frp，为空时不创建
+	HostnameTemplate string `mapstructure:"hostname_template"`
+}
+
+// DNSLineConfig 可用区或地域所在实例使用的解析线路
+type DNSLineConfig struct {
+	Line    string   `mapstructure:"line"`
+	Zones   []string `mapstructure:"zones"`
+	Regions []string `mapstructure:"regions"`
+}
+
+// 记录权重来源
+const (
+	WeightByCPU    = "cpu"    // 实例CPU核数
+	WeightByMemory = "memory" // 实例内存（GB）
+	WeightByHealth = "health" // 实例运行中且初始化完成为 healthy，否则为 unhealthy
+)
+
+// DNSWeightConfig 记录权重（1-100），同一线路下的记录按权重分配解析
+type DNSWeightConfig struct {
+	By        string `mapstructure:"by"`
+	Healthy   uint64 `mapstructure:"healthy"`
+	Unhealthy uint64 `mapstructure:"unhealthy"`
 }
 
+// DNS记录冲突处理方式
+const (
+	ConflictSkip    = "skip"
+	ConflictReplace = "replace"
+)
+
 type AutoMaintenanceConfig struct {
 	Enabled       bool   `mapstructure:"enabled"`
 	CheckInterval int64  `mapstructure:"check_interval"`
@@ -92,36 +274,121 @@ type InstanceBindingManager struct {
 	Instance        InstanceConfig        `mapstructure:"instance"`
 	Feature         FeatureConfig         `mapstructure:"feature"`
 	DomainBinding   DomainBindingConfig   `mapstructure:"domain_binding"`
+	DomainBindings  []DomainBindingConfig `mapstructure:"domain_bindings"`
 	AutoMaintenance AutoMaintenanceConfig `mapstructure:"auto_maintenance"`
 }
 
+// Bindings 返回开启的域名绑定，兼容旧的 domain_binding 配置（排在 domain_bindings 之前）
+func (ibm *InstanceBindingManager) Bindings() []DomainBindingConfig {
+	bindings := make([]DomainBindingConfig, 0, len(ibm.DomainBindings)+1)
+	if ibm.DomainBinding.Enabled {
+		bindings = append(bindings, ibm.DomainBinding)
+	}
+	for _, db := range ibm.DomainBindings {
+		if db.Enabled {
+			bindings = append(bindings, db)
+		}
+	}
+	return bindings
+}
+
+// FQDN 返回域名绑定的完整域名，如 frp.test.com
+func (db *DomainBindingConfig) FQDN() string {
+	return db.SubDomain + "." + db.Domain
+}
+
 type LogConfig struct {
 	LogPath string `mapstructure:"log_path"`
 	Level   string `mapstructure:"level"`
 }
 
 type TConfig struct {
-	SecretId  string `mapstructure:"secret_id"`
-	SecretKey string `mapstructure:"secret_key"`
-	TagKey    string `mapstructure:"tag_key"`
+	SecretId  string         `mapstructure:"secret_id"`
+	SecretKey string         `mapstructure:"secret_key"`
+	TagKey    string         `mapstructure:"tag_key"`
+	APIRetry  APIRetryConfig `mapstructure:"api_retry"`
+}
+
+// APIRetryConfig 腾讯云接口调用的重试和限频配置
+type APIRetryConfig struct {
+	MaxRetries int   `mapstructure:"max_retries"` // 最大重试次数，-1 表示不重试
+	BaseDelay  int64 `mapstructure:"base_delay"`  // 首次重试等待时间（毫秒），之后按指数增长
+	MaxDelay   int64 `mapstructure:"max_delay"`   // 最长重试等待时间（毫秒）
+	RateLimit  int   `mapstructure:"rate_limit"`  // 每个接口每秒最多调用次数（所有实例管理器和地域共享）
+}
+
+type UserDataConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	LocalPath   string `mapstructure:"local_path"`
+	Template    bool   `mapstructure:"template"`
+	WaitMarker  string `mapstructure:"wait_marker"`
+	WaitTimeout int64  `mapstructure:"wait_timeout"`
+}
+
+type JumpHostConfig struct {
+	Host                string   `mapstructure:"host"`
+	Port                int      `mapstructure:"port"`
+	Username            string   `mapstructure:"username"`
+	Password            string   `mapstructure:"password"`
+	PrivateKeyPath      string   `mapstructure:"private_key_path"`
+	HostKeyFingerprints []string `mapstructure:"host_key_fingerprints"`
+}
+
+type SshConfig struct {
+	KnownHostsPath string `mapstructure:"known_hosts_path"`
+}
+
+// DefaultProvisionMaxParallel 默认同时初始化的实例数量
+const DefaultProvisionMaxParallel = 5
+
+type ProvisionConfig struct {
+	StatePath string `mapstructure:"state_path"`
+	// 待确认的实例创建请求（ClientToken）记录文件
+	LaunchStatePath string `mapstructure:"launch_state_path"`
+	LogDir          string `mapstructure:"log_dir"`
+	MaxParallel     int    `mapstructure:"max_parallel"`
+	// 开始初始化前等待实例SSH就绪的总时长（秒）
+	SSHWaitTimeout int64 `mapstructure:"ssh_wait_timeout"`
+	// 初始化配置变化后，已初始化的实例逐个重新初始化，某个实例失败后停止
+	Rolling bool `mapstructure:"rolling"`
 }
 
 type Config struct {
 	TConfig   TConfig
 	IBManager []InstanceBindingManager
 	LogConfig LogConfig
+	SshConfig SshConfig
+	Provision ProvisionConfig
 	IsCli     bool
 	Uin       string
 	Other     map[string]interface{}
 }
 
 type UserConfig struct {
-	Username string `mapstructure:"username"`
-	Password string `mapstructure:"password"`
+	Username            string   `mapstructure:"username"`
+	Password            string   `mapstructure:"password"`
+	HostKeyFingerprints []string `mapstructure:"host_key_fingerprints"`
+	// 首次连接时主机密钥的校验方式，见 HostKeyVerifyTAT
+	HostKeyVerify string `mapstructure:"host_key_verify"`
 }
 
 func (cfg *Config) SetConfig() {
 	cfg.Other = make(map[string]interface{})
 	cfg.Other["execFlagTagKey"] = "exec"
-	cfg.Other["execFlagTagVal"] = "true"
+}
+
+// ResolveSecrets 解析模板密钥，值为 env:变量名 时从环境变量读取
+func (f *FeatureConfig) ResolveSecrets() (map[string]string, error) {
+	secrets := make(map[string]string, len(f.Secrets))
+	for key, val := range f.Secrets {
+		if strings.HasPrefix(val, "env:") {
+			name := strings.TrimPrefix(val, "env:")
+			val = strings.TrimSpace(os.Getenv(name))
+			if val == "" {
+				return nil, fmt.Errorf("密钥 %s 对应的环境变量 %s 未设置", key, name)
+			}
+		}
+		secrets[key] = val
+	}
+	return secrets, nil
 }
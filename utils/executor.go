@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 实例初始化执行器类型
+const (
+	ExecutorSSH = "ssh" // 通过 SSH/SFTP 执行（默认）
+	ExecutorTAT = "tat" // 通过腾讯云自动化助手（TAT）执行，实例无需开放22端口
+)
+
+// Executor 在实例上执行初始化操作，SClient 和 TAT 执行器均实现此接口
+type Executor interface {
+	UploadWithOptions(localPath, remotePath string, opts UploadOptions) error
+	UploadBytes(data []byte, remoteFilePath string) error
+	Download(remotePath, localPath string) error
+	ExecCommand(command string) (string, error)
+	Run(command string) (*ExecResult, error)
+	RunWithOptions(command string, opts RunOptions) (*ExecResult, error)
+	RemoteExists(remotePath string) (bool, error)
+	CheckRemotePort(host string, port int) error
+	SetOutput(stdout, stderr io.Writer)
+	Close() error
+}
+
+// RunOptions 执行命令的附加选项，环境变量和 sudo 密码不会写入日志
+type RunOptions struct {
+	Env          map[string]string // 命令的环境变量，值可能包含密钥
+	Sudo         bool              // 是否通过 sudo 执行
+	SudoPassword string            // sudo 密码，为空时要求免密 sudo
+}
+
+// ExecResult 远程命令执行结果
+type ExecResult struct {
+	Command  string
+	ExitCode int    // 退出码，被信号终止或无法获取时为-1
+	Signal   string // 终止命令的信号（如 KILL），正常退出时为空
+	Stdout   string
+	Stderr   string
+	Output   string // 按输出顺序合并的标准输出和标准错误
+	Duration time.Duration
+}
+
+// Err 命令非正常结束（退出码非0或被信号终止）时返回包含退出码的错误
+func (r *ExecResult) Err() error {
+	if r.ExitCode == 0 && r.Signal == "" {
+		return nil
+	}
+	if r.Signal != "" {
+		return fmt.Errorf("执行命令失败: %w, 信号 %s, 输出: %s", &ExitCodeError{Code: r.ExitCode}, r.Signal, r.Output)
+	}
+	return fmt.Errorf("执行命令失败: %w, 输出: %s", &ExitCodeError{Code: r.ExitCode}, r.Output)
+}
+
+// ExitCodeError 远程命令以非0退出码结束
+type ExitCodeError struct {
+	Code int
+}
+
+func (e *ExitCodeError) Error() string {
+	return fmt.Sprintf("退出码 %d", e.Code)
+}
+
+// ExitCode 从命令错误中提取退出码，err 为空时返回0，无法获取时返回-1
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) {
+		return sshErr.ExitStatus()
+	}
+	var codeErr *ExitCodeError
+	if errors.As(err, &codeErr) {
+		return codeErr.Code
+	}
+	return -1
+}
+
+// ShellQuote 以单引号转义字符串，用于拼接远程 shell 命令
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// EnvAssigns 将环境变量按名称排序转为 KEY='VALUE' 形式
+func EnvAssigns(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assigns := make([]string, 0, len(names))
+	for _, name := range names {
+		assigns = append(assigns, name+"="+ShellQuote(env[name]))
+	}
+	return assigns
+}
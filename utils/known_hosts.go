@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultKnownHostsPath 默认主机密钥存储文件
+const DefaultKnownHostsPath = "./known_hosts"
+
+// 首次连接实例时主机密钥的校验方式
+const (
+	HostKeyVerifyNone = ""    // 不校验，直接信任并记录（TOFU）
+	HostKeyVerifyTAT  = "tat" // 通过自动化助手（TAT）读取实例的主机公钥，主机密钥必须与之一致
+)
+
+// HostKeyReadCommand 读取实例全部主机公钥的命令
+const HostKeyReadCommand = "cat /etc/ssh/ssh_host_*_key.pub"
+
+// hostKeyEntry 单个实例的主机密钥记录
+type hostKeyEntry struct {
+	owner string // 所属实例管理器
+	key   ssh.PublicKey
+}
+
+// HostKeyStore 以实例ID为键的主机密钥存储（首次连接信任，之后严格校验）
+// 文件格式每行为: <实例ID> <实例管理器> <密钥类型> <Base64公钥>
+type HostKeyStore struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*hostKeyEntry
+}
+
+// NewHostKeyStore 加载主机密钥存储，文件不存在时返回空存储
+func NewHostKeyStore(path string) (*HostKeyStore, error) {
+	if path == "" {
+		path = DefaultKnownHostsPath
+	}
+	s := &HostKeyStore{
+		path:    path,
+		entries: make(map[string]*hostKeyEntry),
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("打开主机密钥文件失败: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("主机密钥文件 %s 第 %d 行格式错误", path, lineNum)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[2]))
+		if err != nil {
+			return nil, fmt.Errorf("主机密钥文件 %s 第 %d 行解析失败: %v", path, lineNum, err)
+		}
+		s.entries[fields[0]] = &hostKeyEntry{owner: fields[1], key: key}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取主机密钥文件失败: %v", err)
+	}
+
+	return s, nil
+}
+
+// HostKeyMismatchError 主机密钥与已记录的密钥或配置的指纹不一致，重试不会恢复
+type HostKeyMismatchError struct {
+	InstanceId string
+	Hostname   string
+	Want       string // 已记录的密钥指纹，或逗号分隔的配置指纹列表
+	Got        string // 实际的密钥指纹
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("实例 %s(%s) 主机密钥不匹配，可能存在中间人攻击: 预期 %s, 实际 %s", e.InstanceId, e.Hostname, e.Want, e.Got)
+}
+
+// Callback 返回指定实例的主机密钥校验函数
+// 已记录的实例必须与记录的密钥一致；未记录的实例首次连接时，fingerprints（SHA256 指纹，来自配置或通过 TAT 读取）
+// 不为空时必须匹配其中之一，为空时直接信任（TOFU），校验通过后保存
+func (s *HostKeyStore) Callback(instanceId, owner string, fingerprints []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if entry, ok := s.entries[instanceId]; ok {
+			if bytes.Equal(entry.key.Marshal(), key.Marshal()) {
+				return nil
+			}
+			return &HostKeyMismatchError{
+				InstanceId: instanceId,
+				Hostname:   hostname,
+				Want:       ssh.FingerprintSHA256(entry.key),
+				Got:        fingerprint,
+			}
+		}
+
+		if len(fingerprints) > 0 && !containsFingerprint(fingerprints, fingerprint) {
+			return &HostKeyMismatchError{
+				InstanceId: instanceId,
+				Hostname:   hostname,
+				Want:       strings.Join(fingerprints, ","),
+				Got:        fingerprint,
+			}
+		}
+
+		s.entries[instanceId] = &hostKeyEntry{owner: owner, key: key}
+		if err := s.save(); err != nil {
+			delete(s.entries, instanceId)
+			return err
+		}
+		return nil
+	}
+}
+
+// Known 判断是否已记录实例的主机密钥
+func (s *HostKeyStore) Known(instanceId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.entries[instanceId]
+	return ok
+}
+
+// Remove 删除指定实例的主机密钥记录（实例销毁时调用）
+func (s *HostKeyStore) Remove(instanceIds ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := false
+	for _, id := range instanceIds {
+		if _, ok := s.entries[id]; ok {
+			delete(s.entries, id)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return s.save()
+}
+
+// Prune 删除实例管理器 owner 下已不存在的实例记录（如竞价实例被回收），返回被删除的实例ID
+func (s *HostKeyStore) Prune(owner string, alive map[string]bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := make([]string, 0)
+	for id, entry := range s.entries {
+		if entry.owner == owner && !alive[id] {
+			delete(s.entries, id)
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	return removed, s.save()
+}
+
+// save 写入临时文件后替换，避免写入中断导致文件损坏，调用方需持有锁
+func (s *HostKeyStore) save() error {
+	var buf bytes.Buffer
+	for id, entry := range s.entries {
+		buf.WriteString(id + " " + entry.owner + " ")
+		buf.Write(ssh.MarshalAuthorizedKey(entry.key))
+	}
+
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("创建主机密钥目录失败: %v", err)
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("写入主机密钥文件失败: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("保存主机密钥文件失败: %v", err)
+	}
+	return nil
+}
+
+// ParseHostKeyFingerprints 解析主机公钥文件内容（每行一个 authorized_keys 格式的公钥），返回 SHA256 指纹
+func ParseHostKeyFingerprints(content string) ([]string, error) {
+	fingerprints := make([]string, 0)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("解析主机公钥失败: %v", err)
+		}
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+	}
+	if len(fingerprints) == 0 {
+		return nil, fmt.Errorf("未读取到主机公钥")
+	}
+	return fingerprints, nil
+}
+
+func containsFingerprint(fingerprints []string, fingerprint string) bool {
+	for _, fp := range fingerprints {
+		fp = strings.TrimSpace(fp)
+		if !strings.HasPrefix(fp, "SHA256:") {
+			fp = "SHA256:" + fp
+		}
+		if fp == fingerprint {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// storedKeys 返回存储中的实例ID和密钥指纹
+func storedKeys(s *HostKeyStore) map[string]string {
+	keys := make(map[string]string, len(s.entries))
+	for id, entry := range s.entries {
+		keys[id] = entry.owner + " " + ssh.FingerprintSHA256(entry.key)
+	}
+	return keys
+}
+
+func TestHostKeyStoreCallback(t *testing.T) {
+	keyA, keyB := newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey()
+	fpA, fpB := ssh.FingerprintSHA256(keyA), ssh.FingerprintSHA256(keyB)
+
+	tests := []struct {
+		name         string
+		stored       ssh.PublicKey // 连接前已记录的密钥
+		fingerprints []string
+		key          ssh.PublicKey // 实例实际的密钥
+		wantMismatch bool
+		wantStored   string // 连接后记录的密钥指纹，为空表示未记录
+	}{
+		{name: "首次连接记录密钥", key: keyA, wantStored: fpA},
+		{name: "已记录密钥一致", stored: keyA, key: keyA, wantStored: fpA},
+		{name: "已记录密钥不一致", stored: keyA, key: keyB, wantMismatch: true, wantStored: fpA},
+		{name: "首次连接指纹在列表中", fingerprints: []string{fpB, fpA}, key: keyA, wantStored: fpA},
+		{name: "指纹不带 SHA256 前缀", fingerprints: []string{" " + strings.TrimPrefix(fpA, "SHA256:")}, key: keyA, wantStored: fpA},
+		{name: "首次连接指纹不在列表中", fingerprints: []string{fpB}, key: keyA, wantMismatch: true},
+		{name: "已记录时以记录的密钥为准", stored: keyA, fingerprints: []string{fpB}, key: keyA, wantStored: fpA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			s, err := NewHostKeyStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.stored != nil {
+				if err := s.Callback("ins-a", "web", nil)("1.2.3.4:22", nil, tt.stored); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = s.Callback("ins-a", "web", tt.fingerprints)("1.2.3.4:22", nil, tt.key)
+			var mismatch *HostKeyMismatchError
+			if errors.As(err, &mismatch) != tt.wantMismatch {
+				t.Fatalf("Callback() error = %v, wantMismatch %v", err, tt.wantMismatch)
+			}
+			if !tt.wantMismatch && err != nil {
+				t.Fatalf("Callback() error = %v", err)
+			}
+			if tt.wantMismatch && mismatch.Got != ssh.FingerprintSHA256(tt.key) {
+				t.Errorf("HostKeyMismatchError.Got = %s, want %s", mismatch.Got, ssh.FingerprintSHA256(tt.key))
+			}
+
+			// 重新加载后记录不变
+			reloaded, err := NewHostKeyStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{}
+			if tt.wantStored != "" {
+				want["ins-a"] = "web " + tt.wantStored
+			}
+			for _, store := range []*HostKeyStore{s, reloaded} {
+				if got := storedKeys(store); !maps.Equal(got, want) {
+					t.Errorf("记录的密钥 = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHostKeyStoreRemoveAndPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	s, err := NewHostKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []struct{ id, owner string }{
+		{"ins-a", "web"}, {"ins-b", "web"}, {"ins-c", "db"}, {"1.2.3.4:22", "@jump"},
+	} {
+		if err := s.Callback(host.id, host.owner, nil)(host.id, nil, newTestSigner(t).PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := s.Prune("web", map[string]bool{"ins-a": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(removed, ",") != "ins-b" {
+		t.Errorf("Prune() = %v, want [ins-b]", removed)
+	}
+	if err := s.Remove("ins-c", "ins-missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("ins-missing"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewHostKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for id := range storedKeys(reloaded) {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "1.2.3.4:22,ins-a" {
+		t.Errorf("重新加载后的实例 = %v, want [1.2.3.4:22 ins-a]", ids)
+	}
+}
+
+func TestHostKeyStoreSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "known_hosts")
+	s, err := NewHostKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newTestSigner(t).PublicKey()
+	if err := s.Callback("ins-a", "web", nil)("1.2.3.4:22", nil, key); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("主机密钥文件权限 = %o, want 600", info.Mode().Perm())
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("保存后不应保留临时文件: %v", err)
+	}
+
+	// 上次写入中断留下的临时文件不影响加载，下次保存时被覆盖
+	if err := os.WriteFile(path+".tmp", []byte("ins-x web ssh-ed25519 AAAA"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewHostKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"ins-a": "web " + ssh.FingerprintSHA256(key)}
+	if got := storedKeys(reloaded); !maps.Equal(got, want) {
+		t.Errorf("重新加载后的记录 = %v, want %v", got, want)
+	}
+	if err := reloaded.Remove("ins-a"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || len(data) != 0 {
+		t.Errorf("删除全部记录后文件内容 = %q, %v", data, err)
+	}
+}
+
+func TestNewHostKeyStoreInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "空行和注释", content: "\n# comment\n"},
+		{name: "缺少字段", content: "ins-a web\n", wantErr: true},
+		{name: "公钥无效", content: "ins-a web ssh-ed25519 invalid\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewHostKeyStore(path); (err != nil) != tt.wantErr {
+				t.Errorf("NewHostKeyStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseHostKeyFingerprints(t *testing.T) {
+	keyA, keyB := newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey()
+	lineA := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(keyA))) + " root@localhost"
+	lineB := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(keyB)))
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{name: "多个公钥", content: lineA + "\n\n" + lineB + "\n", want: []string{ssh.FingerprintSHA256(keyA), ssh.FingerprintSHA256(keyB)}},
+		{name: "没有公钥", content: "\n", wantErr: true},
+		{name: "公钥无效", content: lineA + "\ncat: /etc/ssh/ssh_host_*_key.pub: No such file or directory\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHostKeyFingerprints(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseHostKeyFingerprints() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("ParseHostKeyFingerprints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultLaunchStatePath 默认待确认实例创建请求记录文件
+const DefaultLaunchStatePath = "./pending_launches.json"
+
+// PendingLaunch 已发起但尚未确认的实例创建请求
+// 创建请求超时等结果未知时，下次使用相同的 ClientToken 重新请求，腾讯云保证不会重复创建
+type PendingLaunch struct {
+	Manager     string    `json:"manager"`
+	Zone        string    `json:"zone"`
+	ClientToken string    `json:"client_token"`
+	Count       int64     `json:"count"`
+	InstanceIds []string  `json:"instance_ids,omitempty"` // 创建成功后返回的实例ID，为空表示结果未知
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type launchState struct {
+	Nonce    string            `json:"nonce"` // 随机值，参与生成 ClientToken，记录文件重建后不会复用已使用过的 ClientToken
+	Seq      map[string]uint64 `json:"seq"`   // 实例管理器/可用区 -> 已发起的创建请求序号
+	Launches []*PendingLaunch  `json:"launches"`
+}
+
+// LaunchStore 记录待确认的实例创建请求，保存为JSON文件
+type LaunchStore struct {
+	path  string
+	mu    sync.Mutex
+	state launchState
+}
+
+// NewLaunchStore 加载待确认的实例创建请求，文件不存在时返回空存储
+func NewLaunchStore(path string) (*LaunchStore, error) {
+	if path == "" {
+		path = DefaultLaunchStatePath
+	}
+	s := &LaunchStore{
+		path:  path,
+		state: launchState{Seq: make(map[string]uint64)},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("读取实例创建请求记录失败: %v", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("解析实例创建请求记录 %s 失败: %v", path, err)
+		}
+		if s.state.Seq == nil {
+			s.state.Seq = make(map[string]uint64)
+		}
+	}
+	if s.state.Nonce == "" {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("生成实例创建请求随机值失败: %v", err)
+		}
+		s.state.Nonce = hex.EncodeToString(nonce)
+	}
+	return s, nil
+}
+
+// Begin 记录新的创建请求并返回，ClientToken 由记录文件的随机值、实例管理器、可用区和请求序号确定
+func (s *LaunchStore) Begin(manager, zone string, count int64) (*PendingLaunch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := manager + "/" + zone
+	s.state.Seq[key]++
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", s.state.Nonce, key, s.state.Seq[key])))
+	launch := &PendingLaunch{
+		Manager:     manager,
+		Zone:        zone,
+		ClientToken: "cvmspot-" + hex.EncodeToString(sum[:])[:32],
+		Count:       count,
+		CreatedAt:   time.Now(),
+	}
+	s.state.Launches = append(s.state.Launches, launch)
+	copied := *launch
+	return &copied, s.save()
+}
+
+// Pending 返回实例管理器待确认的创建请求副本，包含在其他可用区（如重启后重新选择了可用区）发起的请求
+func (s *LaunchStore) Pending(manager string) []*PendingLaunch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	launches := make([]*PendingLaunch, 0)
+	for _, l := range s.state.Launches {
+		if l.Manager == manager {
+			copied := *l
+			copied.InstanceIds = append([]string(nil), l.InstanceIds...)
+			launches = append(launches, &copied)
+		}
+	}
+	return launches
+}
+
+// SetInstances 记录创建请求返回的实例ID
+func (s *LaunchStore) SetInstances(clientToken string, instanceIds []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.state.Launches {
+		if l.ClientToken == clientToken {
+			l.InstanceIds = append([]string(nil), instanceIds...)
+			return s.save()
+		}
+	}
+	return nil
+}
+
+// Done 删除已确认（或确定失败）的创建请求
+func (s *LaunchStore) Done(clientToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, l := range s.state.Launches {
+		if l.ClientToken == clientToken {
+			s.state.Launches = append(s.state.Launches[:i], s.state.Launches[i+1:]...)
+			return s.save()
+		}
+	}
+	return nil
+}
+
+// save 写入临时文件后替换，调用方需持有锁
+func (s *LaunchStore) save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化实例创建请求记录失败: %v", err)
+	}
+
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("创建实例创建请求记录目录失败: %v", err)
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("写入实例创建请求记录失败: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("保存实例创建请求记录失败: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLaunchStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "launches.json")
+	s, err := NewLaunchStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.Begin("web", "ap-guangzhou-3", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Begin("web", "ap-guangzhou-6", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Begin("db", "ap-guangzhou-3", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新加载后按实例管理器返回所有可用区的请求
+	s, err = NewLaunchStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := s.Pending("web")
+	if len(pending) != 2 || pending[0].ClientToken != first.ClientToken || pending[1].ClientToken != second.ClientToken {
+		t.Fatalf("Pending() = %+v", pending)
+	}
+	if pending[0].Zone != "ap-guangzhou-3" || pending[1].Zone != "ap-guangzhou-6" {
+		t.Errorf("Pending() zones = %s, %s", pending[0].Zone, pending[1].Zone)
+	}
+	if err := s.Done(first.ClientToken); err != nil {
+		t.Fatal(err)
+	}
+	if pending := s.Pending("web"); len(pending) != 1 {
+		t.Errorf("Done() 后 Pending() = %+v", pending)
+	}
+
+	// 删除记录文件后序号重置，ClientToken 不应与之前的请求相同
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewLaunchStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := s.Begin("web", "ap-guangzhou-3", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ClientToken == first.ClientToken {
+		t.Errorf("记录文件重建后复用了 ClientToken %s", first.ClientToken)
+	}
+}
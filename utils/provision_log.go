@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProvisionLogDir 默认实例初始化日志目录
+const DefaultProvisionLogDir = "./provision_logs"
+
+const provisionLogTimeFormat = "2006-01-02 15:04:05.000"
+
+// ProvisionLog 单次实例初始化的日志文件，保存在 <日志目录>/<实例ID>/<开始时间>.log
+// 每行格式: <时间> [<步骤>] [<类型>] <内容>，类型为 run、step、stdout、stderr
+type ProvisionLog struct {
+	file *os.File
+	mu   sync.Mutex
+	step string
+}
+
+// NewProvisionLog 为实例创建本次初始化的日志文件
+func NewProvisionLog(dir, instanceId string) (*ProvisionLog, error) {
+	if dir == "" {
+		dir = DefaultProvisionLogDir
+	}
+	insDir := filepath.Join(dir, filepath.Base(instanceId))
+	if err := os.MkdirAll(insDir, 0755); err != nil {
+		return nil, fmt.Errorf("创建实例初始化日志目录失败: %v", err)
+	}
+
+	name := filepath.Join(insDir, time.Now().Format("20060102-150405.000")+".log")
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("创建实例初始化日志文件失败: %v", err)
+	}
+
+	l := &ProvisionLog{file: file, step: "-"}
+	l.write("run", "开始初始化实例 "+instanceId)
+	return l, nil
+}
+
+// StepStart 记录步骤开始，之后的命令输出归属该步骤
+func (l *ProvisionLog) StepStart(step, stepType string) {
+	l.mu.Lock()
+	l.step = step
+	l.mu.Unlock()
+	l.write("step", "开始执行，类型 "+stepType)
+}
+
+// StepEnd 记录步骤结束时间、耗时、退出码和错误
+func (l *ProvisionLog) StepEnd(duration time.Duration, err error) {
+	msg := fmt.Sprintf("执行成功，耗时 %.3fs", duration.Seconds())
+	if err != nil {
+		msg = fmt.Sprintf("执行失败，耗时 %.3fs，退出码 %d，错误: %v", duration.Seconds(), ExitCode(err), err)
+	}
+	l.write("step", msg)
+	l.mu.Lock()
+	l.step = "-"
+	l.mu.Unlock()
+}
+
+// Note 记录当前步骤的说明信息（如重试）
+func (l *ProvisionLog) Note(msg string) {
+	l.write("step", msg)
+}
+
+// Stdout 返回写入命令标准输出的 Writer
+func (l *ProvisionLog) Stdout() io.Writer {
+	return &provisionLogWriter{log: l, stream: "stdout"}
+}
+
+// Stderr 返回写入命令标准错误的 Writer
+func (l *ProvisionLog) Stderr() io.Writer {
+	return &provisionLogWriter{log: l, stream: "stderr"}
+}
+
+// Close 记录初始化结果并关闭日志文件
+func (l *ProvisionLog) Close(err error) error {
+	if err != nil {
+		l.write("run", "初始化失败: "+err.Error())
+	} else {
+		l.write("run", "初始化完成")
+	}
+	return l.file.Close()
+}
+
+func (l *ProvisionLog) write(stream, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().Format(provisionLogTimeFormat)
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		fmt.Fprintf(l.file, "%s [%s] [%s] %s\n", now, l.step, stream, line)
+	}
+}
+
+type provisionLogWriter struct {
+	log    *ProvisionLog
+	stream string
+}
+
+func (w *provisionLogWriter) Write(p []byte) (int, error) {
+	w.log.write(w.stream, string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
+
+// ProvisionLogFiles 返回实例所有初始化日志文件，按时间从早到晚排序
+func ProvisionLogFiles(dir, instanceId string) ([]string, error) {
+	if dir == "" {
+		dir = DefaultProvisionLogDir
+	}
+	files, err := filepath.Glob(filepath.Join(dir, filepath.Base(instanceId), "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultProvisionStatePath 默认实例初始化状态文件
+const DefaultProvisionStatePath = "./provision_state.json"
+
+// 步骤执行状态
+const (
+	StepStatusSuccess = "success"
+	StepStatusFailed  = "failed"
+	StepStatusSkipped = "skipped"
+)
+
+// StepStatus 单个初始化步骤在某个实例上的执行状态
+type StepStatus struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	Hash       string    `json:"hash,omitempty"` // 执行时步骤配置的内容哈希
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// InstanceProvision 单个实例的初始化状态
+type InstanceProvision struct {
+	Manager   string                 `json:"manager"`
+	Index     int                    `json:"index,omitempty"` // 实例在实例管理器中的序号，从1开始
+	Steps     map[string]*StepStatus `json:"steps"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+// ProvisionStore 以实例ID为键记录初始化步骤状态，保存为JSON文件
+type ProvisionStore struct {
+	path      string
+	mu        sync.Mutex
+	instances map[string]*InstanceProvision
+}
+
+// NewProvisionStore 加载初始化状态，文件不存在时返回空存储
+func NewProvisionStore(path string) (*ProvisionStore, error) {
+	if path == "" {
+		path = DefaultProvisionStatePath
+	}
+	s := &ProvisionStore{
+		path:      path,
+		instances: make(map[string]*InstanceProvision),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取初始化状态文件失败: %v", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.instances); err != nil {
+			return nil, fmt.Errorf("解析初始化状态文件 %s 失败: %v", path, err)
+		}
+	}
+	return s, nil
+}
+
+// StepSucceeded 判断实例的指定步骤是否已按哈希为 hash 的配置执行成功
+func (s *ProvisionStore) StepSucceeded(instanceId, step, hash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ins, ok := s.instances[instanceId]
+	if !ok {
+		return false
+	}
+	status, ok := ins.Steps[step]
+	return ok && status.Status == StepStatusSuccess && status.Hash == hash
+}
+
+// Index 返回实例在实例管理器中的序号，首次调用时分配实例管理器内最小的空闲序号并保存
+// 序号在实例删除（Remove/Prune）前保持不变，之后可被新实例复用
+func (s *ProvisionStore) Index(instanceId, manager string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ins, ok := s.instances[instanceId]
+	if ok && ins.Index > 0 {
+		return ins.Index, nil
+	}
+	used := make(map[int]bool)
+	for _, other := range s.instances {
+		if other.Manager == manager {
+			used[other.Index] = true
+		}
+	}
+	index := 1
+	for used[index] {
+		index++
+	}
+	if !ok {
+		ins = &InstanceProvision{Manager: manager, Steps: make(map[string]*StepStatus)}
+		s.instances[instanceId] = ins
+	}
+	ins.Index = index
+	ins.UpdatedAt = time.Now()
+	return index, s.save()
+}
+
+// SetStep 记录实例的步骤执行状态并保存
+func (s *ProvisionStore) SetStep(instanceId, manager string, status *StepStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ins, ok := s.instances[instanceId]
+	if !ok {
+		ins = &InstanceProvision{Manager: manager, Steps: make(map[string]*StepStatus)}
+		s.instances[instanceId] = ins
+	}
+	copied := *status
+	ins.Steps[status.Name] = &copied
+	ins.UpdatedAt = time.Now()
+	return s.save()
+}
+
+// Get 返回实例初始化状态的副本，不存在时返回 nil
+func (s *ProvisionStore) Get(instanceId string) *InstanceProvision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ins, ok := s.instances[instanceId]
+	if !ok {
+		return nil
+	}
+	copied := &InstanceProvision{
+		Manager:   ins.Manager,
+		Index:     ins.Index,
+		Steps:     make(map[string]*StepStatus, len(ins.Steps)),
+		UpdatedAt: ins.UpdatedAt,
+	}
+	for name, status := range ins.Steps {
+		st := *status
+		copied.Steps[name] = &st
+	}
+	return copied
+}
+
+// Remove 删除指定实例的初始化状态（实例销毁时调用）
+func (s *ProvisionStore) Remove(instanceIds ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := false
+	for _, id := range instanceIds {
+		if _, ok := s.instances[id]; ok {
+			delete(s.instances, id)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return s.save()
+}
+
+// Prune 删除实例管理器 manager 下已不存在实例的初始化状态，返回被删除的实例ID
+func (s *ProvisionStore) Prune(manager string, alive map[string]bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := make([]string, 0)
+	for id, ins := range s.instances {
+		if ins.Manager == manager && !alive[id] {
+			delete(s.instances, id)
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	return removed, s.save()
+}
+
+// save 写入临时文件后替换，调用方需持有锁
+func (s *ProvisionStore) save() error {
+	data, err := json.MarshalIndent(s.instances, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化初始化状态失败: %v", err)
+	}
+
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("创建初始化状态目录失败: %v", err)
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("写入初始化状态文件失败: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("保存初始化状态文件失败: %v", err)
+	}
+	return nil
+}
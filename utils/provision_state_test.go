@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestProvisionStoreIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewProvisionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		instanceId string
+		manager    string
+		remove     bool
+		want       int
+	}{
+		{instanceId: "ins-a", manager: "web", want: 1},
+		{instanceId: "ins-b", manager: "web", want: 2},
+		{instanceId: "ins-c", manager: "db", want: 1},
+		{instanceId: "ins-a", manager: "web", want: 1},
+		{instanceId: "ins-a", manager: "web", remove: true},
+		{instanceId: "ins-d", manager: "web", want: 1},
+		{instanceId: "ins-e", manager: "web", want: 3},
+		{instanceId: "ins-b", manager: "web", want: 2},
+	}
+	for _, step := range steps {
+		if step.remove {
+			if err := s.Remove(step.instanceId); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got, err := s.Index(step.instanceId, step.manager)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != step.want {
+			t.Errorf("Index(%s, %s) = %d, want %d", step.instanceId, step.manager, got, step.want)
+		}
+	}
+
+	// 重新加载后序号不变
+	s, err = NewProvisionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Index("ins-e", "web"); got != 3 {
+		t.Errorf("重新加载后 Index(ins-e) = %d, want 3", got)
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+// StringValue 返回字符串指针的值，指针为空时返回空字符串
+func StringValue(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// Int64Value 返回整数指针的值，指针为空时返回0
+func Int64Value(p *int64) int64 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// Uint64Value 返回无符号整数指针的值，指针为空时返回0
+func Uint64Value(p *uint64) uint64 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// BoolValue 返回布尔指针的值，指针为空时返回 false
+func BoolValue(p *bool) bool {
+	if p == nil {
+		return false
+	}
+	return *p
+}
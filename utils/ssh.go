@@ -2,12 +2,14 @@ package utils
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -16,91 +18,186 @@ import (
 )
 
 type SClient struct {
-	sshClient  *ssh.Client
-	sftpClient *sftp.Client
-	log        *logrus.Logger
+	sshClient   *ssh.Client
+	sftpClient  *sftp.Client
+	jumpClients []*ssh.Client // 跳板机连接，按连接顺序保存
+	stdout      io.Writer     // 命令标准输出的额外写入目标
+	stderr      io.Writer     // 命令标准错误的额外写入目标
+	log         *logrus.Logger
 }
 
-// NewSftpClient 创建SFTP客户端
-func NewSClient(host string, port int, username, password string, log *logrus.Logger) (*SClient, error) {
+// JumpHost 跳板机配置（ProxyJump），按顺序逐级连接
+type JumpHost struct {
+	Host            string
+	Port            int
+	Username        string
+	Password        string
+	PrivateKeyPath  string
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// clientConfig 根据跳板机配置生成SSH配置，优先使用私钥认证
+func (j JumpHost) clientConfig() (*ssh.ClientConfig, error) {
+	auth := make([]ssh.AuthMethod, 0, 2)
+	if j.PrivateKeyPath != "" {
+		keyBytes, err := os.ReadFile(j.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("读取跳板机 %s 私钥失败: %v", j.Host, err)
+		}
+		signer, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("解析跳板机 %s 私钥失败: %v", j.Host, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if j.Password != "" {
+		auth = append(auth, ssh.Password(j.Password))
+	}
+
+	return &ssh.ClientConfig{
+		User:            j.Username,
+		Auth:            auth,
+		HostKeyCallback: j.HostKeyCallback,
+		Timeout:         10 * time.Second,
+	}, nil
+}
+
+// NewSClient 创建SSH/SFTP客户端，hostKeyCallback 用于校验实例主机密钥
+// 指定 jumpHosts 时依次经过跳板机连接目标主机（与 ssh -J 语义一致）
+func NewSClient(host string, port int, username, password string, hostKeyCallback ssh.HostKeyCallback, log *logrus.Logger, jumpHosts ...JumpHost) (*SClient, error) {
 	// 创建SSH配置
 	config := &ssh.ClientConfig{
 		User: username,
 		Auth: []ssh.AuthMethod{
 			ssh.Password(password),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
 		Timeout:         10 * time.Second,
 	}
 
 	// 连接SSH服务器
-	sshClient, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", host, port), config)
+	sshClient, jumpClients, err := dialSSH(fmt.Sprintf("%s:%d", host, port), config, jumpHosts)
 	if err != nil {
-		return nil, fmt.Errorf("SSH连接失败: %v", err)
+		return nil, fmt.Errorf("SSH连接失败: %w", err)
+	}
+
+	client := &SClient{
+		sshClient:   sshClient,
+		jumpClients: jumpClients,
+		log:         log,
 	}
 
 	// 创建SFTP客户端
 	sftpClient, err := sftp.NewClient(sshClient)
 	if err != nil {
-		sshClient.Close()
+		client.Close()
 		return nil, fmt.Errorf("SFTP客户端创建失败: %v", err)
 	}
+	client.sftpClient = sftpClient
 
-	client := &SClient{
-		sshClient:  sshClient,
-		sftpClient: sftpClient,
-		log:        log,
-	}
 	return client, nil
 }
 
+// dialSSH 连接目标主机，存在跳板机时通过上一跳的连接转发到下一跳
+func dialSSH(addr string, config *ssh.ClientConfig, jumpHosts []JumpHost) (*ssh.Client, []*ssh.Client, error) {
+	if len(jumpHosts) == 0 {
+		client, err := ssh.Dial("tcp", addr, config)
+		return client, nil, err
+	}
+
+	jumpClients := make([]*ssh.Client, 0, len(jumpHosts))
+	closeAll := func() {
+		for i := len(jumpClients) - 1; i >= 0; i-- {
+			jumpClients[i].Close()
+		}
+	}
+
+	var prev *ssh.Client
+	for _, jump := range jumpHosts {
+		jumpConfig, err := jump.clientConfig()
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		jumpAddr := fmt.Sprintf("%s:%d", jump.Host, jump.Port)
+		client, err := dialVia(prev, jumpAddr, jumpConfig)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("连接跳板机 %s 失败: %w", jumpAddr, err)
+		}
+		jumpClients = append(jumpClients, client)
+		prev = client
+	}
+
+	client, err := dialVia(prev, addr, config)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return client, jumpClients, nil
+}
+
+// dialVia 通过已建立的SSH连接转发TCP并在其上建立新的SSH连接，via 为空时直接连接
+func dialVia(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if via == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
+
 // Close 关闭连接
 func (c *SClient) Close() error {
 	c.log.Info("正在关闭SSH/SFTP连接")
 	if c.sftpClient != nil {
 		c.sftpClient.Close()
 	}
+	var err error
 	if c.sshClient != nil {
-		err := c.sshClient.Close()
+		err = c.sshClient.Close()
 		if err != nil {
 			c.log.Errorf("关闭SSH连接失败: %v", err)
-			return err
 		}
 	}
+	// 由近及远关闭跳板机连接
+	for i := len(c.jumpClients) - 1; i >= 0; i-- {
+		c.jumpClients[i].Close()
+	}
+	if err != nil {
+		return err
+	}
 	c.log.Info("SSH/SFTP连接已关闭")
 	return nil
 }
 
 // Upload 上传文件或文件夹
 func (c *SClient) Upload(localPath, remotePath string) error {
-	c.log.WithFields(logrus.Fields{
-		"localPath":  localPath,
-		"remotePath": remotePath,
-	}).Info("开始上传文件/目录")
-
-	// 获取本地文件信息
-	localInfo, err := os.Stat(localPath)
-	if err != nil {
-		c.log.Errorf("获取本地路径信息失败: %v", err)
-		return fmt.Errorf("获取本地路径信息失败: %v", err)
-	}
-
-	// 确保远程目录存在
-	if err := c.ensureRemoteDir(remotePath); err != nil {
-		return err
-	}
+	return c.UploadWithOptions(localPath, remotePath, UploadOptions{})
+}
 
-	// 如果是目录，上传整个目录
-	if localInfo.IsDir() {
-		return c.uploadDir(localPath, remotePath)
+// uploadFile 上传单个文件，relPath 为传给 render 的相对路径
+func (c *SClient) uploadFile(localFilePath, remoteFilePath, relPath string, render Renderer) error {
+	if render != nil {
+		content, err := os.ReadFile(localFilePath)
+		if err != nil {
+			return fmt.Errorf("读取本地文件失败: %v", err)
+		}
+		content, err = render(relPath, content)
+		if err != nil {
+			return err
+		}
+		return c.UploadBytes(content, remoteFilePath)
 	}
 
-	// 如果是文件，上传单个文件
-	return c.uploadFile(localPath, remotePath+"/"+filepath.Base(localPath))
-}
-
-// uploadFile 上传单个文件
-func (c *SClient) uploadFile(localFilePath, remoteFilePath string) error {
 	// 打开本地文件
 	localFile, err := os.Open(localFilePath)
 	if err != nil {
@@ -109,7 +206,6 @@ func (c *SClient) uploadFile(localFilePath, remoteFilePath string) error {
 	defer localFile.Close()
 	// 创建远程文件
 	remoteFile, err := c.sftpClient.Create(remoteFilePath)
-	c.sftpClient.Create(remoteFilePath)
 	if err != nil {
 		return fmt.Errorf("创建远程文件失败: %v", err)
 	}
@@ -126,37 +222,21 @@ func (c *SClient) uploadFile(localFilePath, remoteFilePath string) error {
 	return nil
 }
 
-// uploadDir 上传整个目录
-func (c *SClient) uploadDir(localDirPath, remoteDirPath string) error {
-	// 遍历本地目录
-	err := filepath.Walk(localDirPath, func(localPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// 计算相对路径
-		relPath, err := filepath.Rel(localDirPath, localPath)
-		if err != nil {
-			return fmt.Errorf("计算相对路径失败: %v", err)
-		}
-
-		// 转换Windows路径分隔符为Linux格式
-		relPath = strings.ReplaceAll(relPath, "\\", "/")
-
-		// 构建远程路径
-		remotePath := path.Join(remoteDirPath, relPath)
-
-		// 如果是目录，确保远程目录存在
-		if info.IsDir() {
-			return c.ensureRemoteDir(remotePath)
-		}
-
-		// 上传文件
-		return c.uploadFile(localPath, remotePath)
-	})
+// UploadBytes 将内容写入远程文件，远程目录不存在时创建
+func (c *SClient) UploadBytes(data []byte, remoteFilePath string) error {
+	if err := c.ensureRemoteDir(path.Dir(remoteFilePath)); err != nil {
+		return err
+	}
 
+	remoteFile, err := c.sftpClient.Create(remoteFilePath)
 	if err != nil {
-		return err
+		return fmt.Errorf("创建远程文件失败: %v", err)
+	}
+	defer remoteFile.Close()
+
+	c.log.WithField("remote", remoteFilePath).Debug("文件正在上传...")
+	if _, err := remoteFile.Write(data); err != nil {
+		return fmt.Errorf("上传文件内容失败: %v", err)
 	}
 	return nil
 }
@@ -264,70 +344,198 @@ func (c *SClient) ensureRemoteDir(remoteDir string) error {
 	return nil
 }
 
-// ExecCommand 执行SSH命令并流式收集日志
+// ExecCommand 执行SSH命令并流式收集日志，返回合并的输出，退出码非0时返回错误
 func (c *SClient) ExecCommand(command string) (string, error) {
+	result, err := c.Run(command)
+	if err != nil {
+		return "", err
+	}
+	if err := result.Err(); err != nil {
+		c.log.WithFields(logrus.Fields{
+			"error":  err,
+			"output": result.Output,
+		}).Error("执行SSH命令失败")
+		return result.Output, err
+	}
+	return result.Output, nil
+}
+
+// Run 执行SSH命令并流式收集日志，返回退出码、标准输出和标准错误，命令以非0退出码结束不视为错误
+func (c *SClient) Run(command string) (*ExecResult, error) {
+	return c.RunWithOptions(command, RunOptions{})
+}
+
+// RunWithOptions 同 Run，日志只记录原始命令
+// 设置了环境变量或 sudo 时，远程执行 sh -s 并通过标准输入传入环境变量和命令，避免密钥出现在远程进程的命令行中，
+// 此时命令的标准输入为 /dev/null
+func (c *SClient) RunWithOptions(command string, opts RunOptions) (*ExecResult, error) {
 	c.log.WithField("command", command).Info("开始执行SSH命令")
+	start := time.Now()
+
+	remote, stdin := command, io.Reader(nil)
+	if len(opts.Env) > 0 || opts.Sudo {
+		script := "exec sh -c " + ShellQuote(command) + " </dev/null\n"
+		if len(opts.Env) > 0 {
+			script = "export " + strings.Join(EnvAssigns(opts.Env), " ") + "\n" + script
+		}
+		remote, stdin = "sh -s", strings.NewReader(script)
+		if opts.Sudo {
+			remote = "sudo -n sh -s"
+			if opts.SudoPassword != "" {
+				prompt, err := c.sudoNeedsPassword()
+				if err != nil {
+					c.log.Error(err)
+					return nil, err
+				}
+				if prompt {
+					// sudo -S 逐字节读取密码，剩余内容作为 sh 的脚本
+					remote = "sudo -S -p '' sh -s"
+					stdin = io.MultiReader(strings.NewReader(opts.SudoPassword+"\n"), stdin)
+				}
+			}
+		}
+	}
 
 	session, err := c.sshClient.NewSession()
 	if err != nil {
 		c.log.Errorf("创建SSH会话失败: %v", err)
-		return "", fmt.Errorf("创建SSH会话失败: %v", err)
+		return nil, fmt.Errorf("创建SSH会话失败: %v", err)
 	}
 	defer session.Close()
+	session.Stdin = stdin
 
 	// 创建管道获取实时输出
 	stdoutPipe, err := session.StdoutPipe()
 	if err != nil {
 		c.log.Errorf("获取标准输出管道失败: %v", err)
-		return "", fmt.Errorf("获取标准输出管道失败: %v", err)
+		return nil, fmt.Errorf("获取标准输出管道失败: %v", err)
 	}
 
 	stderrPipe, err := session.StderrPipe()
 	if err != nil {
 		c.log.Errorf("获取标准错误管道失败: %v", err)
-		return "", fmt.Errorf("获取标准错误管道失败: %v", err)
+		return nil, fmt.Errorf("获取标准错误管道失败: %v", err)
 	}
 
 	// 启动命令
-	if err := session.Start(command); err != nil {
+	if err := session.Start(remote); err != nil {
 		c.log.Errorf("启动命令失败: %v", err)
-		return "", fmt.Errorf("启动命令失败: %v", err)
+		return nil, fmt.Errorf("启动命令失败: %v", err)
 	}
 
-	// 创建缓冲区收集输出
-	var outputBuf strings.Builder
+	// 创建缓冲区收集输出，标准输出和标准错误并发写入
+	var outputBuf, stdoutBuf, stderrBuf strings.Builder
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	collect := func(line string, buf *strings.Builder, w io.Writer) {
+		mu.Lock()
+		defer mu.Unlock()
+		outputBuf.WriteString(line + "\n")
+		buf.WriteString(line + "\n")
+		if w != nil {
+			io.WriteString(w, line+"\n")
+		}
+	}
 
 	// 实时读取标准输出
+	wg.Add(2)
 	go func() {
+		defer wg.Done()
 		scanner := bufio.NewScanner(stdoutPipe)
 		for scanner.Scan() {
 			line := scanner.Text()
-			outputBuf.WriteString(line + "\n")
+			collect(line, &stdoutBuf, c.stdout)
 			c.log.WithField("output", line).Info("命令输出")
 		}
 	}()
 
 	// 实时读取标准错误
 	go func() {
+		defer wg.Done()
 		scanner := bufio.NewScanner(stderrPipe)
 		for scanner.Scan() {
 			line := scanner.Text()
-			outputBuf.WriteString(line + "\n")
+			collect(line, &stderrBuf, c.stderr)
 			c.log.WithField("error", line).Warn("命令错误输出")
 		}
 	}()
 
 	// 等待命令完成
+	wg.Wait()
 	err = session.Wait()
-	output := outputBuf.String()
 
+	result := &ExecResult{
+		Command:  command,
+		Stdout:   stdoutBuf.String(),
+		Stderr:   stderrBuf.String(),
+		Output:   outputBuf.String(),
+		Duration: time.Since(start),
+	}
+	var exitErr *ssh.ExitError
+	var missingErr *ssh.ExitMissingError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitStatus()
+		result.Signal = exitErr.Signal()
+		if result.Signal != "" {
+			result.ExitCode = -1
+		}
+	case errors.As(err, &missingErr):
+		// 连接断开等原因未收到退出状态
+		result.ExitCode = -1
+		result.Signal = "unknown"
+	default:
+		return result, fmt.Errorf("执行命令失败: %v, 输出: %s", err, result.Output)
+	}
+	return result, nil
+}
+
+// sudoNeedsPassword 在单独的SSH会话中执行 sudo -n true，判断 sudo 是否需要输入密码
+// 免密 sudo 或凭据已缓存时 sudo -S 不读取标准输入，密码会被 sh -s 当作命令执行并出现在错误输出中，
+// 因此只在确认需要密码时才发送密码
+func (c *SClient) sudoNeedsPassword() (bool, error) {
+	session, err := c.sshClient.NewSession()
 	if err != nil {
-		c.log.WithFields(logrus.Fields{
-			"error":  err,
-			"output": output,
-		}).Error("执行SSH命令失败")
-		return output, fmt.Errorf("执行命令失败: %v, 输出: %s", err, output)
+		return false, fmt.Errorf("创建SSH会话失败: %v", err)
+	}
+	defer session.Close()
+
+	err = session.Run("sudo -n true")
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.As(err, &exitErr):
+		return true, nil
+	default:
+		return false, fmt.Errorf("检查 sudo 是否需要密码失败: %v", err)
 	}
+}
+
+// SetOutput 设置命令标准输出和标准错误的额外写入目标（如实例初始化日志），为 nil 时不写入
+func (c *SClient) SetOutput(stdout, stderr io.Writer) {
+	c.stdout = stdout
+	c.stderr = stderr
+}
 
-	return output, nil
+// RemoteExists 判断远程文件或目录是否存在
+func (c *SClient) RemoteExists(remotePath string) (bool, error) {
+	_, err := c.sftpClient.Stat(remotePath)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("获取远程路径信息失败: %v", err)
+}
+
+// CheckRemotePort 通过SSH连接从实例内部连接 host:port，判断端口是否可连接
+func (c *SClient) CheckRemotePort(host string, port int) error {
+	conn, err := c.sshClient.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
 }
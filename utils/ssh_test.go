@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// testExec 测试SSH服务端收到的命令和标准输入
+type testExec struct {
+	command string
+	stdin   string
+}
+
+// testSSHServer 只支持 exec 请求的SSH服务端，按 exitCode 返回命令的退出码
+type testSSHServer struct {
+	addr     string
+	hostKey  ssh.PublicKey
+	exitCode func(command string) uint32
+
+	mu    sync.Mutex
+	execs []testExec
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newTestSSHServer(t *testing.T, exitCode func(command string) uint32) *testSSHServer {
+	t.Helper()
+	signer := newTestSigner(t)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testSSHServer{addr: listener.Addr().String(), hostKey: signer.PublicKey(), exitCode: exitCode}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(ch, requests)
+	}
+}
+
+func (s *testSSHServer) session(ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range requests {
+		if req.Type != "exec" || len(req.Payload) < 4 {
+			req.Reply(false, nil)
+			continue
+		}
+		command := string(req.Payload[4 : 4+binary.BigEndian.Uint32(req.Payload)])
+		req.Reply(true, nil)
+
+		stdin, _ := io.ReadAll(ch)
+		s.mu.Lock()
+		s.execs = append(s.execs, testExec{command: command, stdin: string(stdin)})
+		s.mu.Unlock()
+
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{s.exitCode(command)}))
+		return
+	}
+}
+
+// newTestSClient 连接测试SSH服务端，不创建 SFTP 客户端
+func newTestSClient(t *testing.T, s *testSSHServer) *SClient {
+	t.Helper()
+	client, err := ssh.Dial("tcp", s.addr, &ssh.ClientConfig{
+		User:            "ubuntu",
+		Auth:            []ssh.AuthMethod{ssh.Password("x")},
+		HostKeyCallback: ssh.FixedHostKey(s.hostKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	c := &SClient{sshClient: client, log: log}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSClientRunWithOptionsSudo(t *testing.T) {
+	const password = "p@ss'word"
+	tests := []struct {
+		name         string
+		opts         RunOptions
+		sudoPrompt   bool // sudo -n true 是否失败（需要密码）
+		commands     []string
+		sendPassword bool
+	}{
+		{
+			name:     "无选项",
+			commands: []string{"id"},
+		},
+		{
+			name:     "环境变量",
+			opts:     RunOptions{Env: map[string]string{"A": "1"}},
+			commands: []string{"sh -s"},
+		},
+		{
+			name:     "免密 sudo",
+			opts:     RunOptions{Sudo: true},
+			commands: []string{"sudo -n sh -s"},
+		},
+		{
+			name:     "配置了密码但 sudo 不需要密码",
+			opts:     RunOptions{Sudo: true, SudoPassword: password},
+			commands: []string{"sudo -n true", "sudo -n sh -s"},
+		},
+		{
+			name:         "sudo 需要密码",
+			opts:         RunOptions{Sudo: true, SudoPassword: password},
+			sudoPrompt:   true,
+			commands:     []string{"sudo -n true", "sudo -S -p '' sh -s"},
+			sendPassword: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSSHServer(t, func(command string) uint32 {
+				if command == "sudo -n true" && tt.sudoPrompt {
+					return 1
+				}
+				return 0
+			})
+			c := newTestSClient(t, s)
+
+			result, err := c.RunWithOptions("id", tt.opts)
+			if err != nil {
+				t.Fatalf("RunWithOptions() error = %v", err)
+			}
+			if result.ExitCode != 0 {
+				t.Errorf("RunWithOptions() exit = %d, want 0", result.ExitCode)
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			commands := make([]string, 0, len(s.execs))
+			for _, e := range s.execs {
+				commands = append(commands, e.command)
+			}
+			if strings.Join(commands, "|") != strings.Join(tt.commands, "|") {
+				t.Fatalf("执行的命令 = %q, want %q", commands, tt.commands)
+			}
+
+			stdin := s.execs[len(s.execs)-1].stdin
+			if got := strings.HasPrefix(stdin, password+"\n"); got != tt.sendPassword {
+				t.Errorf("标准输入以密码开头 = %v, want %v", got, tt.sendPassword)
+			}
+			if !tt.sendPassword && strings.Contains(stdin, password) {
+				t.Errorf("标准输入不应包含密码: %q", stdin)
+			}
+			for _, e := range s.execs[:len(s.execs)-1] {
+				if e.stdin != "" {
+					t.Errorf("命令 %q 的标准输入 = %q, want 空", e.command, e.stdin)
+				}
+			}
+			if len(tt.opts.Env) > 0 && !strings.Contains(stdin, "export A='1'\n") {
+				t.Errorf("标准输入缺少环境变量: %q", stdin)
+			}
+		})
+	}
+}
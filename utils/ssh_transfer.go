@@ -0,0 +1,402 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 上传方式
+const (
+	TransferSFTP        = "sftp"        // 逐个文件通过 SFTP 上传（默认）
+	TransferIncremental = "incremental" // 比较大小/修改时间/sha256，只上传变化的文件
+	TransferTar         = "tar"         // 打包为 tar.gz 通过单个SSH会话传输并在远程解压
+	TransferAuto        = "auto"        // 文件数量较多时使用 tar，否则使用 incremental
+)
+
+const (
+	autoTarFileCount = 100 // auto 方式下文件数量达到该值时使用 tar
+	hashBatchSize    = 100 // 每次远程计算 sha256 的文件数量
+)
+
+// UploadOptions 上传选项
+type UploadOptions struct {
+	Transfer      string   // 上传方式，为空时使用 sftp
+	Excludes      []string // 排除的文件，匹配相对路径或文件名，支持通配符
+	PreserveOwner bool     // 是否保留本地文件的属主（uid/gid），需要远程用户有权限
+	Render        Renderer // 上传前处理文件内容，为空时原样上传
+}
+
+// UploadEntry 待上传的本地文件或目录
+type UploadEntry struct {
+	LocalPath  string
+	RemotePath string
+	RelPath    string // 相对路径（以 / 分隔），用于排除匹配和模板渲染
+	Info       os.FileInfo
+}
+
+// UploadWithOptions 按选项上传文件或文件夹，文件权限和修改时间与本地保持一致
+func (c *SClient) UploadWithOptions(localPath, remotePath string, opts UploadOptions) error {
+	c.log.WithFields(logrus.Fields{
+		"localPath":  localPath,
+		"remotePath": remotePath,
+		"transfer":   opts.Transfer,
+	}).Info("开始上传文件/目录")
+
+	entries, err := CollectUploadEntries(localPath, remotePath, opts.Excludes)
+	if err != nil {
+		return err
+	}
+
+	transfer := opts.Transfer
+	if transfer == TransferAuto {
+		transfer = TransferIncremental
+		if len(entries) >= autoTarFileCount {
+			transfer = TransferTar
+		}
+	}
+
+	switch transfer {
+	case "", TransferSFTP:
+		return c.uploadEntries(entries, remotePath, opts)
+	case TransferIncremental:
+		return c.uploadIncremental(entries, remotePath, opts)
+	case TransferTar:
+		return c.uploadTar(entries, remotePath, opts)
+	default:
+		return fmt.Errorf("不支持的上传方式: %s", opts.Transfer)
+	}
+}
+
+// CollectUploadEntries 遍历本地路径，返回排除后的文件和目录（按遍历顺序，目录在其文件之前），单个文件上传到 remotePath 目录下
+func CollectUploadEntries(localPath, remotePath string, excludes []string) ([]*UploadEntry, error) {
+	localInfo, err := os.Stat(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("获取本地路径信息失败: %v", err)
+	}
+	if !localInfo.IsDir() {
+		base := filepath.Base(localPath)
+		return []*UploadEntry{{
+			LocalPath:  localPath,
+			RemotePath: path.Join(remotePath, base),
+			RelPath:    base,
+			Info:       localInfo,
+		}}, nil
+	}
+
+	entries := make([]*UploadEntry, 0)
+	err = filepath.Walk(localPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return fmt.Errorf("计算相对路径失败: %v", err)
+		}
+		if relPath == "." {
+			return nil
+		}
+		relPath = filepath.ToSlash(relPath)
+		if len(excludes) > 0 && matchAny(excludes, relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entries = append(entries, &UploadEntry{
+			LocalPath:  p,
+			RemotePath: path.Join(remotePath, relPath),
+			RelPath:    relPath,
+			Info:       info,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// uploadEntries 逐个上传文件
+func (c *SClient) uploadEntries(entries []*UploadEntry, remotePath string, opts UploadOptions) error {
+	if err := c.ensureRemoteDir(remotePath); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Info.IsDir() {
+			if err := c.ensureRemoteDir(e.RemotePath); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.uploadEntry(e, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadEntry 上传单个文件并同步权限、修改时间和属主
+func (c *SClient) uploadEntry(e *UploadEntry, opts UploadOptions) error {
+	if err := c.uploadFile(e.LocalPath, e.RemotePath, e.RelPath, opts.Render); err != nil {
+		return err
+	}
+	return c.syncAttributes(e, opts)
+}
+
+// syncAttributes 同步远程文件的权限、修改时间（渲染后的文件不同步修改时间）和属主
+func (c *SClient) syncAttributes(e *UploadEntry, opts UploadOptions) error {
+	if err := c.sftpClient.Chmod(e.RemotePath, e.Info.Mode().Perm()); err != nil {
+		return fmt.Errorf("设置远程文件 %s 权限失败: %v", e.RemotePath, err)
+	}
+	if opts.Render == nil {
+		if err := c.sftpClient.Chtimes(e.RemotePath, e.Info.ModTime(), e.Info.ModTime()); err != nil {
+			return fmt.Errorf("设置远程文件 %s 修改时间失败: %v", e.RemotePath, err)
+		}
+	}
+	if opts.PreserveOwner {
+		hdr, err := tar.FileInfoHeader(e.Info, "")
+		if err == nil {
+			if err := c.sftpClient.Chown(e.RemotePath, hdr.Uid, hdr.Gid); err != nil {
+				return fmt.Errorf("设置远程文件 %s 属主失败: %v", e.RemotePath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// uploadIncremental 只上传变化的文件：大小不同或修改时间不同且 sha256 不同
+func (c *SClient) uploadIncremental(entries []*UploadEntry, remotePath string, opts UploadOptions) error {
+	if err := c.ensureRemoteDir(remotePath); err != nil {
+		return err
+	}
+
+	changed := make([]*UploadEntry, 0)
+	candidates := make([]*UploadEntry, 0) // 大小相同但需要比较 sha256 的文件
+	localHashes := make(map[string]string)
+	for _, e := range entries {
+		if e.Info.IsDir() {
+			if err := c.ensureRemoteDir(e.RemotePath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		content, size, err := readForCompare(e, opts.Render)
+		if err != nil {
+			return err
+		}
+
+		remoteInfo, err := c.sftpClient.Stat(e.RemotePath)
+		if err != nil || remoteInfo.Size() != size {
+			changed = append(changed, e)
+			continue
+		}
+		if opts.Render == nil && remoteInfo.ModTime().Unix() == e.Info.ModTime().Unix() {
+			continue
+		}
+
+		if content == nil {
+			if content, err = os.ReadFile(e.LocalPath); err != nil {
+				return fmt.Errorf("读取本地文件失败: %v", err)
+			}
+		}
+		sum := sha256.Sum256(content)
+		localHashes[e.RemotePath] = hex.EncodeToString(sum[:])
+		candidates = append(candidates, e)
+	}
+
+	// 批量计算远程文件 sha256
+	for start := 0; start < len(candidates); start += hashBatchSize {
+		batch := candidates[start:min(start+hashBatchSize, len(candidates))]
+		remoteHashes, err := c.remoteSha256(batch)
+		if err != nil {
+			return err
+		}
+		for _, e := range batch {
+			if remoteHashes[e.RemotePath] != localHashes[e.RemotePath] {
+				changed = append(changed, e)
+				continue
+			}
+			// 内容相同，同步属性以便下次直接通过修改时间判断
+			if err := c.syncAttributes(e, opts); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.log.WithFields(logrus.Fields{
+		"总文件数": countFiles(entries),
+		"上传数":  len(changed),
+	}).Info("增量上传比较完成")
+
+	for _, e := range changed {
+		if err := c.uploadEntry(e, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readForCompare 返回用于比较的文件大小，需要渲染时同时返回渲染后的内容
+func readForCompare(e *UploadEntry, render Renderer) ([]byte, int64, error) {
+	if render == nil {
+		return nil, e.Info.Size(), nil
+	}
+	content, err := os.ReadFile(e.LocalPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("读取本地文件失败: %v", err)
+	}
+	content, err = render(e.RelPath, content)
+	if err != nil {
+		return nil, 0, err
+	}
+	return content, int64(len(content)), nil
+}
+
+// remoteSha256 在远程执行 sha256sum 计算文件哈希，返回 远程路径 -> 哈希
+func (c *SClient) remoteSha256(entries []*UploadEntry) (map[string]string, error) {
+	args := make([]string, 0, len(entries))
+	for _, e := range entries {
+		args = append(args, ShellQuote(e.RemotePath))
+	}
+
+	session, err := c.sshClient.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("创建SSH会话失败: %v", err)
+	}
+	defer session.Close()
+
+	// 文件不可读时 sha256sum 返回非0，已输出的结果仍然有效
+	output, _ := session.Output("sha256sum -- " + strings.Join(args, " "))
+	return parseSha256sum(output), nil
+}
+
+// parseSha256sum 解析 sha256sum 输出，返回 文件路径 -> 哈希
+// 每行格式为 "<哈希>  <路径>"（二进制模式为 "<哈希> *<路径>"），路径包含反斜杠或换行时行首为 "\"，路径中的 "\\" 和 "\n" 需要还原
+func parseSha256sum(output []byte) map[string]string {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		hash, file, ok := strings.Cut(line, " ")
+		if !ok || len(hash) != sha256.Size*2 || file == "" || (file[0] != ' ' && file[0] != '*') {
+			continue
+		}
+		file = file[1:]
+		if escaped {
+			file = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(file)
+		}
+		hashes[file] = hash
+	}
+	return hashes
+}
+
+// uploadTar 将文件打包为 tar.gz 通过单个SSH会话传输，在远程解压到 remotePath
+func (c *SClient) uploadTar(entries []*UploadEntry, remotePath string, opts UploadOptions) error {
+	session, err := c.sshClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("创建SSH会话失败: %v", err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("获取标准输入管道失败: %v", err)
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	ownerFlag := "--no-same-owner"
+	if opts.PreserveOwner {
+		ownerFlag = "--same-owner --numeric-owner"
+	}
+	command := fmt.Sprintf("mkdir -p %s && tar -xzpf - %s -C %s", ShellQuote(remotePath), ownerFlag, ShellQuote(remotePath))
+	if err := session.Start(command); err != nil {
+		return fmt.Errorf("启动远程解压失败: %v", err)
+	}
+
+	writeErr := writeTarGz(stdin, entries, opts.Render)
+	stdin.Close()
+	waitErr := session.Wait()
+	if writeErr != nil {
+		return fmt.Errorf("打包上传失败: %v", writeErr)
+	}
+	if waitErr != nil {
+		return fmt.Errorf("远程解压失败: %v, %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+
+	c.log.WithField("文件数", countFiles(entries)).Info("tar 上传完成")
+	return nil
+}
+
+// writeTarGz 将文件写入 tar.gz 流，保留权限、修改时间和属主
+func writeTarGz(w io.Writer, entries []*UploadEntry, render Renderer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, e := range entries {
+		hdr, err := tar.FileInfoHeader(e.Info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = e.RelPath
+		if e.Info.IsDir() {
+			hdr.Name += "/"
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		if !e.Info.Mode().IsRegular() {
+			continue
+		}
+
+		content, err := os.ReadFile(e.LocalPath)
+		if err != nil {
+			return fmt.Errorf("读取本地文件失败: %v", err)
+		}
+		if render != nil {
+			if content, err = render(e.RelPath, content); err != nil {
+				return err
+			}
+		}
+		hdr.Size = int64(len(content))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func countFiles(entries []*UploadEntry) int {
+	count := 0
+	for _, e := range entries {
+		if !e.Info.IsDir() {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSha256sum(t *testing.T) {
+	hashA := strings.Repeat("a", 64)
+	hashB := strings.Repeat("b", 64)
+	tests := []struct {
+		name   string
+		output string
+		want   map[string]string
+	}{
+		{name: "空输出", output: "", want: map[string]string{}},
+		{
+			name:   "普通文件",
+			output: hashA + "  /opt/app/a.conf\n" + hashB + "  /opt/app/b c.conf\n",
+			want:   map[string]string{"/opt/app/a.conf": hashA, "/opt/app/b c.conf": hashB},
+		},
+		{
+			name:   "路径包含两个空格",
+			output: hashA + "  /opt/app/a  b.conf\n",
+			want:   map[string]string{"/opt/app/a  b.conf": hashA},
+		},
+		{
+			name:   "二进制模式",
+			output: hashA + " */opt/app/a.bin\n",
+			want:   map[string]string{"/opt/app/a.bin": hashA},
+		},
+		{
+			name:   "路径包含反斜杠和换行",
+			output: `\` + hashA + `  /opt/app/a\\b\nc.conf` + "\n",
+			want:   map[string]string{"/opt/app/a\\b\nc.conf": hashA},
+		},
+		{
+			name:   "忽略错误信息和无效行",
+			output: "sha256sum: /opt/app/x: Permission denied\n" + "abc  /opt/app/short\n" + hashA + "  /opt/app/a.conf\n",
+			want:   map[string]string{"/opt/app/a.conf": hashA},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSha256sum([]byte(tt.output)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSha256sum() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSSHWaitTimeout 默认等待SSH就绪的总时长
+const DefaultSSHWaitTimeout = 300 * time.Second
+
+const (
+	sshWaitInitialInterval = 2 * time.Second
+	sshWaitMaxInterval     = 30 * time.Second
+	sshProbeTimeout        = 10 * time.Second
+)
+
+// DefaultSSHAuthGracePeriod 默认首次认证失败后继续重试的时长，实例启动时 cloud-init 可能仍在设置密码或密钥
+const DefaultSSHAuthGracePeriod = 60 * time.Second
+
+// SSHWaitOptions 等待SSH就绪的选项
+type SSHWaitOptions struct {
+	ProbeTCP        bool          // 登录前检查 TCP 连接和 SSH banner，经过跳板机时无法检查
+	AuthGracePeriod time.Duration // 首次认证失败后继续重试的时长，不大于0时使用 DefaultSSHAuthGracePeriod
+}
+
+// WaitForSSH 等待实例SSH就绪后返回已认证的连接，依次检查 TCP 连接、SSH banner 和登录认证，
+// 失败时按指数退避重试，直到 ctx 结束。opts.ProbeTCP 为 false 时跳过前两项直接尝试登录
+// 主机密钥不匹配时立即返回错误，认证失败持续超过 opts.AuthGracePeriod 后返回错误
+func WaitForSSH(ctx context.Context, addr string, opts SSHWaitOptions, connect func() (*SClient, error), log *logrus.Entry) (*SClient, error) {
+	grace := opts.AuthGracePeriod
+	if grace <= 0 {
+		grace = DefaultSSHAuthGracePeriod
+	}
+	interval := sshWaitInitialInterval
+	var authFailedAt time.Time
+	for attempt := 1; ; attempt++ {
+		stage, err := "", error(nil)
+		if opts.ProbeTCP {
+			stage, err = probeSSHBanner(ctx, addr)
+		}
+		if err == nil {
+			var client *SClient
+			if client, err = connect(); err == nil {
+				if attempt > 1 {
+					log.WithField("尝试次数", attempt).Info("SSH已就绪")
+				}
+				return client, nil
+			}
+			stage = "handshake"
+		}
+
+		fields := logrus.Fields{
+			"阶段":   stage,
+			"尝试次数": attempt,
+			"重试间隔": interval,
+		}
+		var mismatch *HostKeyMismatchError
+		switch {
+		case errors.As(err, &mismatch):
+			log.WithFields(fields).Errorf("SSH主机密钥校验失败，停止重试: %v", err)
+			return nil, err
+		case isAuthError(err):
+			fields["阶段"] = "auth"
+			if authFailedAt.IsZero() {
+				authFailedAt = time.Now()
+			}
+			if time.Since(authFailedAt) >= grace {
+				log.WithFields(fields).Errorf("SSH认证持续失败，停止重试: %v", err)
+				return nil, fmt.Errorf("SSH认证失败，请检查用户名、密码或密钥: %v", err)
+			}
+			log.WithFields(fields).Warnf("SSH认证失败: %v", err)
+		default:
+			log.WithFields(fields).Debugf("SSH未就绪: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("等待SSH就绪超时（%s 阶段）: %v", fields["阶段"], err)
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, sshWaitMaxInterval)
+	}
+}
+
+// isAuthError 判断是否为SSH认证失败（用户名、密码或密钥错误）
+func isAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// probeSSHBanner 建立 TCP 连接并读取 SSH 版本标识，返回失败的阶段
+func probeSSHBanner(ctx context.Context, addr string) (string, error) {
+	dialer := net.Dialer{Timeout: sshProbeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "tcp", err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(sshProbeTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "banner", fmt.Errorf("读取SSH banner失败: %v", err)
+	}
+	if !strings.HasPrefix(line, "SSH-") {
+		return "banner", fmt.Errorf("无效的SSH banner: %q", strings.TrimSpace(line))
+	}
+	return "", nil
+}
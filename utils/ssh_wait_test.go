@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestWaitForSSHFailFast(t *testing.T) {
+	mismatch := &HostKeyMismatchError{InstanceId: "ins-a", Hostname: "1.2.3.4:22", Want: "SHA256:a", Got: "SHA256:b"}
+	tests := []struct {
+		name     string
+		err      error
+		grace    time.Duration // 为0时使用 1ns，认证失败立即停止
+		wantStop bool
+	}{
+		{name: "主机密钥不匹配", err: fmt.Errorf("SSH连接失败: %w", fmt.Errorf("ssh: handshake failed: %w", mismatch)), wantStop: true},
+		{name: "跳板机主机密钥不匹配", err: fmt.Errorf("连接跳板机 1.2.3.4:22 失败: %w", mismatch), wantStop: true},
+		{name: "认证失败", err: errors.New("SSH连接失败: ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain"), wantStop: true},
+		{name: "宽限期内认证失败继续重试", err: errors.New("SSH连接失败: ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain"), grace: time.Hour},
+		{name: "连接被拒绝", err: errors.New("SSH连接失败: dial tcp 1.2.3.4:22: connect: connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := logrus.New()
+			log.SetOutput(io.Discard)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			grace := tt.grace
+			if grace == 0 {
+				grace = time.Nanosecond
+			}
+			calls := 0
+			_, err := WaitForSSH(ctx, "", SSHWaitOptions{AuthGracePeriod: grace}, func() (*SClient, error) {
+				calls++
+				return nil, tt.err
+			}, logrus.NewEntry(log))
+			if err == nil {
+				t.Fatal("WaitForSSH() error = nil")
+			}
+			if stopped := ctx.Err() == nil; stopped != tt.wantStop {
+				t.Errorf("WaitForSSH() 提前停止 = %v, want %v（调用 %d 次）: %v", stopped, tt.wantStop, calls, err)
+			}
+			if tt.wantStop && calls != 1 {
+				t.Errorf("WaitForSSH() 调用 %d 次, want 1", calls)
+			}
+		})
+	}
+}
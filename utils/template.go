@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"text/template"
+)
+
+// Renderer 上传前处理文件内容，relPath 为相对上传根目录的路径（使用 / 分隔）
+type Renderer func(relPath string, content []byte) ([]byte, error)
+
+// RenderTemplate 以 Go 模板渲染内容，缺少变量时返回错误
+func RenderTemplate(name string, content []byte, data interface{}) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("解析模板 %s 失败: %v", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("渲染模板 %s 失败: %v", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// RenderTemplateFile 以 Go 模板渲染本地文件
+func RenderTemplateFile(localPath string, data interface{}) ([]byte, error) {
+	content, err := os.ReadFile(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取模板文件失败: %v", err)
+	}
+	return RenderTemplate(localPath, content, data)
+}
+
+// TemplateRenderer 返回以 data 渲染模板的 Renderer
+// patterns 为空时渲染所有文件，否则只渲染相对路径或文件名匹配任一 patterns 的文件
+func TemplateRenderer(data interface{}, patterns []string) Renderer {
+	return func(relPath string, content []byte) ([]byte, error) {
+		if !matchAny(patterns, relPath) {
+			return content, nil
+		}
+		return RenderTemplate(relPath, content, data)
+	}
+}
+
+func matchAny(patterns []string, relPath string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(pattern)
+		if ok, _ := path.Match(pattern, relPath); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(relPath)); ok {
+			return true
+		}
+	}
+	return false
+}